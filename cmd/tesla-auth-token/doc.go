@@ -1,4 +1,5 @@
 /*
-Tesla-auth-token writes a provided OAuth token to the system keyring.
+Tesla-auth-token writes a provided OAuth token to the system keyring, or obtains one by logging in
+with a browser. It can also print the claims (expiration time, scopes, etc.) of a saved token.
 */
 package main
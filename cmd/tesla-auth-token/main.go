@@ -3,21 +3,52 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
+	"github.com/greenmission/vehicle-command/pkg/account"
 	"github.com/greenmission/vehicle-command/pkg/cli"
 )
 
 func usage() {
 	w := flag.CommandLine.Output()
-	fmt.Fprintf(w, "usage: %s [-token-name token_name] [file]\n", filepath.Base(os.Args[0]))
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, "usage: %s [-token-name token_name] [file]\n", name)
+	fmt.Fprintf(w, "       %s [-token-name token_name] [OPTION...] login\n", name)
+	fmt.Fprintf(w, "       %s [-token-name token_name] inspect\n", name)
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Reads OAuth token from stdin or file and saves it under token_name in the system")
 	fmt.Fprintf(w, "keyring. The token_name defaults to $%s.\n", cli.EnvTeslaTokenName)
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "The login command obtains access and refresh tokens by opening a Tesla login")
+	fmt.Fprintln(w, "page in your browser. Requires an OAuth client ID.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "The inspect command prints the expiration time, scopes, client ID, and region")
+	fmt.Fprintln(w, "of the saved token.")
+	fmt.Fprintln(w, "")
+	flag.PrintDefaults()
+}
+
+// openBrowser makes a best-effort attempt to open url in the user's web browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
 }
 
 func main() {
@@ -32,7 +63,22 @@ func main() {
 		return
 	}
 
+	var (
+		login     account.LoginConfig
+		scopes    string
+		noBrowser bool
+		timeout   time.Duration
+	)
 	flag.StringVar(&config.KeyringTokenName, "token-name", "", "Name to use for keyring entry")
+	flag.StringVar(&config.OAuthClientID, "oauth-client-id", "", "OAuth client `ID` for login. Defaults to $"+cli.EnvTeslaClientID+".")
+	flag.StringVar(&login.ClientSecret, "client-secret", "", "OAuth client `secret` for login, if the client has one")
+	flag.StringVar(&login.AuthorizeURL, "authorize-url", account.DefaultAuthorizeURL, "OAuth authorization endpoint `URL` for login")
+	flag.StringVar(&config.OAuthTokenURL, "oauth-token-url", "", "OAuth token endpoint `URL` for login. Defaults to $"+cli.EnvTeslaTokenURL+" or "+account.DefaultTokenURL+".")
+	flag.StringVar(&scopes, "scopes", strings.Join(account.DefaultScopes, " "), "Space-separated OAuth `scopes` to request during login")
+	flag.StringVar(&login.ListenAddress, "listen", account.DefaultListenAddress, "`Address` of the local login callback listener")
+	flag.StringVar(&login.RedirectURL, "redirect-uri", "", "Login redirect `URI` registered for the client ID. Defaults to the callback listener's URL.")
+	flag.BoolVar(&noBrowser, "no-browser", false, "Print login URL instead of opening a browser")
+	flag.DurationVar(&timeout, "login-timeout", 5*time.Minute, "How long to wait for login to complete")
 	flag.Usage = usage
 	flag.Parse()
 	config.ReadFromEnvironment()
@@ -42,6 +88,27 @@ func main() {
 		return
 	}
 
+	if flag.NArg() == 1 && flag.Arg(0) == "login" {
+		login.ClientID = config.OAuthClientID
+		login.TokenURL = config.OAuthTokenURL
+		login.Scopes = strings.Fields(scopes)
+		if err := runLogin(config, login, noBrowser, timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Login failed: %s\n", err)
+			return
+		}
+		returnCode = 0
+		return
+	}
+
+	if flag.NArg() == 1 && flag.Arg(0) == "inspect" {
+		if err := runInspect(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error inspecting token: %s\n", err)
+			return
+		}
+		returnCode = 0
+		return
+	}
+
 	var token []byte
 	switch flag.NArg() {
 	case 0:
@@ -68,3 +135,71 @@ func main() {
 
 	returnCode = 0
 }
+
+func runLogin(config *cli.Config, login account.LoginConfig, noBrowser bool, timeout time.Duration) error {
+	if login.ClientID == "" {
+		return fmt.Errorf("must provide OAuth client ID using -oauth-client-id or $%s", cli.EnvTeslaClientID)
+	}
+	visit := func(url string) error {
+		fmt.Printf("Open the following URL in your browser to log in:\n\n\t%s\n\n", url)
+		if !noBrowser {
+			if err := openBrowser(url); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't open browser: %s\n", err)
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	token, err := account.Login(ctx, login, visit)
+	if err != nil {
+		return err
+	}
+
+	if err := config.SaveTokenToKeyring(token.AccessToken); err != nil {
+		return err
+	}
+	if token.RefreshToken == "" {
+		fmt.Println("Saved access token. The server did not provide a refresh token; request the offline_access scope to enable automatic renewal.")
+		return nil
+	}
+	if err := config.SaveRefreshTokenToKeyring(token.RefreshToken); err != nil {
+		return err
+	}
+	fmt.Printf("Saved access and refresh tokens. Set $%s to allow tesla-control to renew the access token automatically.\n", cli.EnvTeslaClientID)
+	return nil
+}
+
+func runInspect(config *cli.Config) error {
+	token, err := config.LoadTokenFromKeyring()
+	if err != nil {
+		return err
+	}
+	info, err := account.ParseTokenInfo(token)
+	if err != nil {
+		return err
+	}
+
+	expiry := "never"
+	if !info.Expiry.IsZero() {
+		expiry = info.Expiry.Local().Format(time.RFC1123)
+		if info.Expired() {
+			expiry += " (expired)"
+		} else {
+			expiry += fmt.Sprintf(" (in %s)", time.Until(info.Expiry).Round(time.Second))
+		}
+	}
+	refresh := "no"
+	if _, err := config.LoadRefreshTokenFromKeyring(); err == nil {
+		refresh = "yes"
+	}
+
+	fmt.Printf("Expires:       %s\n", expiry)
+	fmt.Printf("Scopes:        %s\n", strings.Join(info.Scopes, " "))
+	fmt.Printf("Client ID:     %s\n", info.ClientID)
+	fmt.Printf("Region:        %s\n", info.Region)
+	fmt.Printf("Audiences:     %s\n", strings.Join(info.Audiences, " "))
+	fmt.Printf("Refresh token: %s\n", refresh)
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/greenmission/vehicle-command/pkg/account"
 	"github.com/greenmission/vehicle-command/pkg/cli"
+	"github.com/greenmission/vehicle-command/pkg/connector/ble"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/vcsec"
 	"github.com/greenmission/vehicle-command/pkg/vehicle"
@@ -28,8 +29,10 @@ type Handler func(ctx context.Context, acct *account.Account, car *vehicle.Vehic
 
 type Command struct {
 	help             string
-	requiresAuth     bool // True if command requires client-to-vehicle authentication (private key)
-	requiresFleetAPI bool // True if command requires client-to-server authentication (OAuth token)
+	requiresAuth     bool     // True if command requires client-to-vehicle authentication (private key)
+	requiresFleetAPI bool     // True if command requires client-to-server authentication (OAuth token)
+	standalone       bool     // True if command doesn't connect to a vehicle or account
+	scopes           []string // OAuth scopes, any one of which permits the command (see requiredScopes)
 	args             []Argument
 	optional         []Argument
 	handler          Handler
@@ -41,6 +44,9 @@ func configureFlags(c *cli.Config, commandName string, forceBLE bool) error {
 	if !ok {
 		return ErrUnknownCommand
 	}
+	if info.standalone {
+		return nil
+	}
 	c.Flags = cli.FlagBLE
 	if info.requiresAuth {
 		c.Flags |= cli.FlagPrivateKey | cli.FlagVIN
@@ -64,6 +70,30 @@ func configureFlags(c *cli.Config, commandName string, forceBLE bool) error {
 	return err
 }
 
+var chargingScopes = []string{account.ScopeChargingCommands, account.ScopeVehicleCommands}
+
+// requiredScopes returns the OAuth scopes, any one of which permits the command over the
+// Internet. Vehicle commands default to account.ScopeVehicleCommands.
+func (c *Command) requiredScopes() []string {
+	if c.scopes != nil || c.standalone || c.requiresFleetAPI {
+		return c.scopes
+	}
+	return []string{account.ScopeVehicleCommands}
+}
+
+// checkScopes returns an error if acct is known to lack the OAuth scopes the command requires.
+func checkScopes(acct *account.Account, commandName string, info *Command) error {
+	if acct == nil || acct.TokenInfo() == nil {
+		return nil
+	}
+	token := acct.TokenInfo()
+	scopes := info.requiredScopes()
+	if len(scopes) == 0 || len(token.Scopes) == 0 || token.HasAnyScope(scopes...) {
+		return nil
+	}
+	return fmt.Errorf("%s requires OAuth scope %s", commandName, strings.Join(scopes, " or "))
+}
+
 var (
 	ErrRequiresOAuth      = errors.New("command requires a FleetAPI OAuth token")
 	ErrRequiresVIN        = errors.New("command requires a VIN")
@@ -76,6 +106,9 @@ func checkReadiness(commandName string, havePrivateKey, haveOAuth, haveVIN bool)
 	if !ok {
 		return nil, ErrUnknownCommand
 	}
+	if info.standalone {
+		return info, nil
+	}
 	if info.requiresFleetAPI {
 		if !haveOAuth {
 			return nil, ErrRequiresOAuth
@@ -103,6 +136,9 @@ func execute(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, a
 	if err != nil {
 		return err
 	}
+	if err := checkScopes(acct, args[0], info); err != nil {
+		return err
+	}
 
 	if len(args)-1 < len(info.args) || len(args)-1 > len(info.args)+len(info.optional) {
 		writeErr("Invalid number of command line arguments: %d (%d required, %d optional).", len(args), len(info.args), len(info.optional))
@@ -308,6 +344,46 @@ var commands = map[string]*Command{
 			return acct.UpdateKey(ctx, publicKey, args["NAME"])
 		},
 	},
+	"ble-scan": &Command{
+		help:       "List vehicle BLE beacons in range, matching them against comma-separated VINS",
+		standalone: true,
+		optional: []Argument{
+			Argument{name: "VINS", help: "comma-separated list of VINs to match against beacons"},
+			Argument{name: "SECONDS", help: "duration of scan (default 5)"},
+		},
+		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			var vins []string
+			if args["VINS"] != "" {
+				vins = strings.Split(args["VINS"], ",")
+			}
+			seconds := 5
+			if s, ok := args["SECONDS"]; ok {
+				var err error
+				if seconds, err = strconv.Atoi(s); err != nil || seconds <= 0 {
+					return fmt.Errorf("%w: SECONDS must be a positive integer", ErrCommandLineArgs)
+				}
+			}
+			ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+			defer cancel()
+			beacons, err := ble.Scan(ctx, vins)
+			if err != nil {
+				return err
+			}
+			if len(beacons) == 0 {
+				fmt.Println("No vehicles found")
+				return nil
+			}
+			fmt.Printf("%-17s  %4s  %-11s  %-18s  %s\n", "ADDRESS", "RSSI", "CONNECTABLE", "LOCAL NAME", "VIN")
+			for _, beacon := range beacons {
+				vin := beacon.VIN
+				if vin == "" {
+					vin = "?"
+				}
+				fmt.Printf("%-17s  %4d  %-11t  %-18s  %s\n", beacon.Address, beacon.RSSI, beacon.Connectable, beacon.LocalName, vin)
+			}
+			return nil
+		},
+	},
 	"get": &Command{
 		help:             "GET an owner API http ENDPOINT. Hostname will be taken from -config.",
 		requiresAuth:     false,
@@ -412,6 +488,7 @@ var commands = map[string]*Command{
 		help:             "Set charge limit to PERCENT",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		args: []Argument{
 			Argument{name: "PERCENT", help: "Charging limit"},
 		},
@@ -427,6 +504,7 @@ var commands = map[string]*Command{
 		help:             "Set charge current to AMPS",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		args: []Argument{
 			Argument{name: "AMPS", help: "Charging current"},
 		},
@@ -442,6 +520,7 @@ var commands = map[string]*Command{
 		help:             "Start charging",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.ChargeStart(ctx)
 		},
@@ -450,6 +529,7 @@ var commands = map[string]*Command{
 		help:             "Stop charging",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.ChargeStop(ctx)
 		},
@@ -458,6 +538,7 @@ var commands = map[string]*Command{
 		help:             "Schedule charging to MINS minutes after midnight and enable daily scheduling",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		args: []Argument{
 			Argument{name: "MINS", help: "Time after midnight in minutes"},
 		},
@@ -475,6 +556,7 @@ var commands = map[string]*Command{
 		help:             "Cancel scheduled charge start",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.ScheduleCharging(ctx, false, 0*time.Hour)
 		},
@@ -572,6 +654,7 @@ var commands = map[string]*Command{
 		help:             "Wake up vehicle",
 		requiresAuth:     false,
 		requiresFleetAPI: false,
+		scopes:           []string{account.ScopeVehicleDeviceData, account.ScopeVehicleCommands},
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.Wakeup(ctx)
 		},
@@ -612,6 +695,7 @@ var commands = map[string]*Command{
 		help:             "Open charge port",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.OpenChargePort(ctx)
 		},
@@ -620,6 +704,7 @@ var commands = map[string]*Command{
 		help:             "Close charge port",
 		requiresAuth:     true,
 		requiresFleetAPI: false,
+		scopes:           chargingScopes,
 		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
 			return car.CloseChargePort(ctx)
 		},
@@ -732,6 +817,21 @@ var commands = map[string]*Command{
 			return nil
 		},
 	},
+	"list-vehicles": &Command{
+		help:             "List VINs, names, and states of vehicles on the account",
+		requiresAuth:     false,
+		requiresFleetAPI: true,
+		handler: func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			vehicles, err := acct.ListVehicles(ctx)
+			if err != nil {
+				return err
+			}
+			for _, v := range vehicles {
+				fmt.Printf("%s\t%s\t%s\n", v.VIN, v.State, v.DisplayName)
+			}
+			return nil
+		},
+	},
 	"auto-seat-and-climate": &Command{
 		help:             "Turn on automatic seat heating and HVAC",
 		requiresAuth:     true,
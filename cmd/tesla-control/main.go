@@ -142,6 +142,10 @@ func main() {
 				writeErr("Missing required flag: %s", err)
 				return
 			}
+			if info := commands[args[0]]; info.standalone {
+				status = runCommand(nil, nil, args)
+				return
+			}
 		}
 	}
 
@@ -150,6 +154,17 @@ func main() {
 		return
 	}
 
+	// Catch expired tokens and missing scopes before connecting so the user gets a clear error
+	// message instead of an HTTP status code.
+	var scopes []string
+	if len(args) > 0 {
+		scopes = commands[args[0]].requiredScopes()
+	}
+	if err := config.CheckToken(scopes...); err != nil {
+		writeErr("Error: %s", err)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
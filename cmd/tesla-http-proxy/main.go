@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/cache"
 	"github.com/greenmission/vehicle-command/pkg/cli"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 	"github.com/greenmission/vehicle-command/pkg/proxy"
@@ -43,6 +44,7 @@ func main() {
 		verbose      bool
 		host         string
 		port         int
+		sessionDir   string
 	)
 
 	config, err := cli.NewConfig(cli.FlagPrivateKey)
@@ -64,6 +66,7 @@ func main() {
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
 	flag.StringVar(&host, "host", "localhost", "Proxy server `hostname`")
 	flag.IntVar(&port, "port", defaultPort, "`Port` to listen on")
+	flag.StringVar(&sessionDir, "session-dir", "", "Share vehicle sessions with other proxy instances through files in `directory`")
 	flag.Usage = Usage
 	config.RegisterCommandLineFlags()
 	flag.Parse()
@@ -97,6 +100,11 @@ func main() {
 	if err != nil {
 		return
 	}
+	if sessionDir != "" {
+		if p.SessionStore, err = cache.NewFileStore(sessionDir); err != nil {
+			return
+		}
+	}
 	addr := fmt.Sprintf("%s:%d", host, port)
 	log.Info("Listening on %s", addr)
 
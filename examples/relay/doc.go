@@ -0,0 +1,15 @@
+/*
+Relay forwards commands between remote clients and a vehicle over BLE. Run it on a device that's
+within BLE range of the vehicle:
+
+	./relay -vin YOUR_VIN -listen :7654
+
+Clients connect to the relay using [github.com/greenmission/vehicle-command/pkg/connector/stream]:
+
+	conn, err := stream.Dial(ctx, "tcp", "relay.local:7654", vin)
+
+The relay serves one client at a time. Commands are authenticated end-to-end, so the relay does not
+need a private key, but it should only listen on trusted networks. Use -network unix to listen on a
+Unix domain socket instead.
+*/
+package main
@@ -0,0 +1,73 @@
+// Example program: Relay commands from stream clients to a vehicle over BLE.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	debugger "github.com/greenmission/vehicle-command/internal/log"
+
+	"github.com/greenmission/vehicle-command/pkg/connector/ble"
+	"github.com/greenmission/vehicle-command/pkg/connector/stream"
+)
+
+func main() {
+	logger := log.New(os.Stderr, "", 0)
+	status := 1
+	defer func() {
+		os.Exit(status)
+	}()
+
+	var (
+		vin     string
+		network string
+		address string
+		debug   bool
+	)
+	flag.StringVar(&vin, "vin", "", "Vehicle Identification Number (`VIN`) of the car")
+	flag.StringVar(&network, "network", "tcp", "Listen on `network` (tcp or unix)")
+	flag.StringVar(&address, "listen", "localhost:7654", "Listen on `address`")
+	flag.BoolVar(&debug, "debug", false, "Enable debugging of TX/RX packets")
+	flag.Parse()
+
+	if debug {
+		debugger.SetLevel(debugger.LevelDebug)
+	}
+
+	if vin == "" {
+		logger.Printf("Must specify VIN")
+		return
+	}
+
+	listener, err := stream.Listen(network, address, vin)
+	if err != nil {
+		logger.Printf("Failed to listen on %s: %s", address, err)
+		return
+	}
+	defer listener.Close()
+	logger.Printf("Listening on %s", listener.Addr())
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			logger.Printf("Failed to accept connection: %s", err)
+			return
+		}
+		// Connect to the vehicle on demand so that the relay doesn't hold the BLE link (and keep
+		// the vehicle awake) while no clients are connected.
+		car, err := ble.NewConnection(context.Background(), vin)
+		if err != nil {
+			logger.Printf("Failed to connect to vehicle: %s", err)
+			client.Close()
+			continue
+		}
+		if err := stream.Relay(context.Background(), client, car); err != nil {
+			logger.Printf("Relay stopped: %s", err)
+		}
+		client.Close()
+		car.Close()
+	}
+}
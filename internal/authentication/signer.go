@@ -81,6 +81,24 @@ func ImportSessionInfo(private ECDHPrivateKey, verifierName, encodedInfo []byte,
 	return signer, nil
 }
 
+// Counter returns the anti-replay counter of the last message authorized by s.
+func (s *Signer) Counter() uint32 {
+	return s.counter
+}
+
+// Epoch returns the identifier of the Verifier's current session epoch.
+func (s *Signer) Epoch() []byte {
+	return append([]byte{}, s.epoch[:]...)
+}
+
+// AdvanceCounter ensures the next message authorized by s uses a counter greater than counter. This
+// allows clients that share session state to avoid reusing each other's counters.
+func (s *Signer) AdvanceCounter(counter uint32) {
+	if s.counter < counter {
+		s.counter = counter
+	}
+}
+
 // ExportSessionInfo can be used to write session state to disk, allowing for later resumption using
 // ImportSessionInfo.
 func (s *Signer) ExportSessionInfo() ([]byte, error) {
@@ -0,0 +1,190 @@
+// Package connectortest provides fake implementations of connector.Connector for testing packages
+// that wrap Connectors or send commands through them.
+package connectortest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+// VIN is the VIN reported by Connectors.
+const VIN = "0123456789ABCDEFG"
+
+// inboxSize is the number of replies a Connector can queue before Send blocks.
+const inboxSize = 100
+
+// Handler returns the message a Connector delivers in reply to request, or nil if the vehicle
+// doesn't reply. If Handler returns an error, Send returns it without delivering a reply.
+type Handler func(request *universal.RoutableMessage) (*universal.RoutableMessage, error)
+
+// Connector is a connector.Connector that records the messages it sends. If it has a Handler, it
+// delivers the Handler's replies to its inbox.
+type Connector struct {
+	auth    connector.AuthMethod
+	handler Handler
+	inbox   chan []byte
+
+	lock    sync.Mutex
+	sent    [][]byte
+	errs    []error
+	sendErr error
+	closed  bool
+}
+
+// New returns a Connector that prefers auth and passes each message it sends to handler. The
+// handler may be nil.
+func New(auth connector.AuthMethod, handler Handler) *Connector {
+	return &Connector{auth: auth, handler: handler, inbox: make(chan []byte, inboxSize)}
+}
+
+func (c *Connector) Receive() <-chan []byte                    { return c.inbox }
+func (c *Connector) VIN() string                               { return VIN }
+func (c *Connector) PreferredAuthMethod() connector.AuthMethod { return c.auth }
+func (c *Connector) RetryInterval() time.Duration              { return time.Millisecond }
+
+func (c *Connector) Close() {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+}
+
+// Send returns the next error queued by FailNext, if any, or else the error set by SetSendError.
+// Otherwise it records buffer and delivers the Handler's reply.
+func (c *Connector) Send(ctx context.Context, buffer []byte) error {
+	c.lock.Lock()
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		c.lock.Unlock()
+		return err
+	}
+	if c.sendErr != nil {
+		c.lock.Unlock()
+		return c.sendErr
+	}
+	c.sent = append(c.sent, buffer)
+	c.lock.Unlock()
+
+	if c.handler == nil {
+		return nil
+	}
+	var request universal.RoutableMessage
+	if err := proto.Unmarshal(buffer, &request); err != nil {
+		return err
+	}
+	reply, err := c.handler(&request)
+	if err != nil || reply == nil {
+		return err
+	}
+	encoded, err := proto.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	c.inbox <- encoded
+	return nil
+}
+
+// FailNext causes the next len(errs) calls to Send to return errs, in order.
+func (c *Connector) FailNext(errs ...error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errs = append(c.errs, errs...)
+}
+
+// SetSendError causes Send to return err until SetSendError is called again. A nil err clears it.
+func (c *Connector) SetSendError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sendErr = err
+}
+
+// Sent returns the messages that Send accepted.
+func (c *Connector) Sent() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([][]byte(nil), c.sent...)
+}
+
+// Closed returns true if Close has been called.
+func (c *Connector) Closed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Deliver simulates the vehicle sending message on its own initiative.
+func (c *Connector) Deliver(message []byte) {
+	c.inbox <- message
+}
+
+// CloseInbox simulates the transport failing. The caller must not call Send or Deliver afterwards.
+func (c *Connector) CloseInbox() {
+	close(c.inbox)
+}
+
+// Reply returns a message addressed to the sender of request.
+func Reply(request *universal.RoutableMessage) *universal.RoutableMessage {
+	return &universal.RoutableMessage{
+		ToDestination:   request.GetFromDestination(),
+		FromDestination: request.GetToDestination(),
+		RequestUuid:     request.GetUuid(),
+	}
+}
+
+// Echo is a Handler that replies to each message with a copy of its payload.
+func Echo(request *universal.RoutableMessage) (*universal.RoutableMessage, error) {
+	reply := Reply(request)
+	reply.Payload = &universal.RoutableMessage_ProtobufMessageAsBytes{
+		ProtobufMessageAsBytes: request.GetProtobufMessageAsBytes(),
+	}
+	return reply, nil
+}
+
+// FleetAPIConnector is a Connector that also implements connector.FleetAPIConnector. It records
+// Fleet API calls and replies to each command with its endpoint.
+type FleetAPIConnector struct {
+	*Connector
+
+	fleetLock sync.Mutex
+	endpoints []string
+	wakeups   int
+}
+
+// NewFleetAPI returns a FleetAPIConnector. See New.
+func NewFleetAPI(auth connector.AuthMethod, handler Handler) *FleetAPIConnector {
+	return &FleetAPIConnector{Connector: New(auth, handler)}
+}
+
+func (f *FleetAPIConnector) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
+	f.fleetLock.Lock()
+	defer f.fleetLock.Unlock()
+	f.endpoints = append(f.endpoints, endpoint)
+	return []byte(endpoint), nil
+}
+
+func (f *FleetAPIConnector) Wakeup(ctx context.Context) error {
+	f.fleetLock.Lock()
+	defer f.fleetLock.Unlock()
+	f.wakeups++
+	return nil
+}
+
+// Endpoints returns the endpoints passed to SendFleetAPICommand.
+func (f *FleetAPIConnector) Endpoints() []string {
+	f.fleetLock.Lock()
+	defer f.fleetLock.Unlock()
+	return append([]string(nil), f.endpoints...)
+}
+
+// Wakeups returns the number of times Wakeup has been called.
+func (f *FleetAPIConnector) Wakeups() int {
+	f.fleetLock.Lock()
+	defer f.fleetLock.Unlock()
+	return f.wakeups
+}
@@ -0,0 +1,129 @@
+package connectortest
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+// Vehicle simulates a vehicle that executes every command it receives and replies with a copy of
+// the command's payload. Use its Handle method as a Connector's Handler.
+//
+// An authenticated Vehicle also answers session info requests, and only executes messages that
+// pass verification. Messages that fail verification are answered with an error and the
+// vehicle's current session info, as a real vehicle would.
+type Vehicle struct {
+	key authentication.ECDHPrivateKey
+
+	lock       sync.Mutex
+	executions map[string]int
+	verifiers  map[universal.Domain]*authentication.Verifier
+}
+
+// NewVehicle returns a Vehicle that executes unauthenticated commands.
+func NewVehicle() *Vehicle {
+	return &Vehicle{
+		executions: make(map[string]int),
+		verifiers:  make(map[universal.Domain]*authentication.Verifier),
+	}
+}
+
+// NewAuthenticatedVehicle returns a Vehicle with a new private key.
+func NewAuthenticatedVehicle() (*Vehicle, error) {
+	v := NewVehicle()
+	var err error
+	if v.key, err = authentication.NewECDHPrivateKey(rand.Reader); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Handle is a Handler that executes request.
+func (v *Vehicle) Handle(request *universal.RoutableMessage) (*universal.RoutableMessage, error) {
+	reply := Reply(request)
+	payload := request.GetProtobufMessageAsBytes()
+	if v.key != nil {
+		var err error
+		if payload, err = v.authenticate(request, reply); err != nil {
+			return nil, err
+		}
+	}
+	if payload != nil {
+		v.lock.Lock()
+		v.executions[string(payload)]++
+		v.lock.Unlock()
+		reply.Payload = &universal.RoutableMessage_ProtobufMessageAsBytes{
+			ProtobufMessageAsBytes: payload,
+		}
+	}
+	return reply, nil
+}
+
+// Executions returns the number of times the command with payload has been executed.
+func (v *Vehicle) Executions(payload []byte) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.executions[string(payload)]
+}
+
+// ResetSessions simulates the vehicle rebooting, which starts new session epochs.
+func (v *Vehicle) ResetSessions() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.verifiers = make(map[universal.Domain]*authentication.Verifier)
+}
+
+// verifier returns the Verifier for domain, creating one if needed.
+func (v *Vehicle) verifier(domain universal.Domain, publicKey []byte) (*authentication.Verifier, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if verifier, ok := v.verifiers[domain]; ok {
+		return verifier, nil
+	}
+	verifier, err := authentication.NewVerifier(v.key, []byte(VIN), domain, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	v.verifiers[domain] = verifier
+	return verifier, nil
+}
+
+// authenticate returns the payload of request if request is authentic. Otherwise, it sets the
+// error status and session info that the vehicle would send in reply.
+func (v *Vehicle) authenticate(request, reply *universal.RoutableMessage) ([]byte, error) {
+	domain := request.GetToDestination().GetDomain()
+	if sessionRequest := request.GetSessionInfoRequest(); sessionRequest != nil {
+		verifier, err := v.verifier(domain, sessionRequest.GetPublicKey())
+		if err != nil {
+			return nil, err
+		}
+		return nil, verifier.SetSessionInfo(request.GetUuid(), reply)
+	}
+	publicKey := request.GetSignatureData().GetSignerIdentity().GetPublicKey()
+	verifier, err := v.verifier(domain, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := verifier.Verify(request)
+	var sigErr *authentication.InvalidSignatureError
+	if errors.As(err, &sigErr) {
+		reply.SignedMessageStatus = &universal.MessageStatus{
+			OperationStatus:    universal.OperationStatus_E_OPERATIONSTATUS_ERROR,
+			SignedMessageFault: sigErr.Code,
+		}
+		reply.Payload = &universal.RoutableMessage_SessionInfo{SessionInfo: sigErr.EncodedInfo}
+		reply.SubSigData = &universal.RoutableMessage_SignatureData{
+			SignatureData: &signatures.SignatureData{
+				SigType: &signatures.SignatureData_SessionInfoTag{
+					SessionInfoTag: &signatures.HMAC_Signature_Data{Tag: sigErr.Tag},
+				},
+			},
+		}
+		return nil, nil
+	}
+	return payload, err
+}
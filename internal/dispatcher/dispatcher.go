@@ -3,8 +3,10 @@ package dispatcher
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/greenmission/vehicle-command/internal/authentication"
@@ -17,11 +19,24 @@ import (
 	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
 )
 
+// Defaults for values that can be changed using Options.
 var sessionInfoRequestTimeout = 5 * time.Second
 var commandTimeout = 5 * time.Second
 
 // Dispatcher objects send (encrypted) messages to a vehicle and route incoming messages to the
 // appropriate receiver object.
+//
+// A Dispatcher is safe for concurrent use. Multiple goroutines may Send commands at the same time,
+// including to the same domain:
+//
+//   - Anti-replay counters are allocated after a command is admitted to its domain's pipeline, so
+//     the vehicle never sees more commands in flight than its anti-replay window tolerates.
+//   - Infotainment commands are pipelined: up to 16 may be in flight at once.
+//   - VCSEC commands are queued: Send blocks until the Receiver of the previous authenticated VCSEC
+//     command has been closed. A goroutine must therefore close its Receiver before sending another
+//     authenticated VCSEC command, or it will block until its Context expires.
+//
+// Unauthenticated messages, including handshakes, aren't subject to these limits.
 type Dispatcher struct {
 	conn       connector.Connector
 	privateKey authentication.ECDHPrivateKey
@@ -33,20 +48,47 @@ type Dispatcher struct {
 
 	sessionLock sync.Mutex
 	sessions    map[universal.Domain]*session
+	pipelines   map[universal.Domain]chan struct{}
+
+	handlerLock  sync.Mutex
+	handlers     map[receiverKey]*receiver
+	handlerStats HandlerStats
 
-	handlerLock sync.Mutex
-	handlers    map[receiverKey]*receiver
+	subscriptionLock sync.Mutex
+	subscriptions    map[*subscription]struct{}
+
+	retryPolicy    atomic.Pointer[protocol.RetryPolicy]
+	sessionChanged atomic.Pointer[func()]
+
+	sessionInfoTimeout     time.Duration
+	commandExpiry          time.Duration
+	receiverBufferSize     int
+	subscriptionBufferSize int
+	receiverIdleTimeout    time.Duration
+	leakDetection          bool
+	counterReserver        CounterReserver
 }
 
 // New creates a Dispatcher from a Connector.
-func New(conn connector.Connector, privateKey authentication.ECDHPrivateKey) (*Dispatcher, error) {
+func New(conn connector.Connector, privateKey authentication.ECDHPrivateKey, options ...Option) (*Dispatcher, error) {
 	dispatcher := Dispatcher{
-		conn:       conn,
-		address:    make([]byte, addressLength),
-		sessions:   make(map[universal.Domain]*session),
-		handlers:   make(map[receiverKey]*receiver),
-		privateKey: privateKey,
-		done:       make(chan bool),
+		conn:          conn,
+		address:       make([]byte, addressLength),
+		sessions:      make(map[universal.Domain]*session),
+		pipelines:     make(map[universal.Domain]chan struct{}),
+		handlers:      make(map[receiverKey]*receiver),
+		subscriptions: make(map[*subscription]struct{}),
+		privateKey:    privateKey,
+		done:          make(chan bool),
+
+		sessionInfoTimeout:     sessionInfoRequestTimeout,
+		commandExpiry:          commandTimeout,
+		receiverBufferSize:     receiverBufferSize,
+		subscriptionBufferSize: subscriptionBufferSize,
+		receiverIdleTimeout:    receiverIdleTimeout,
+	}
+	for _, option := range options {
+		option(&dispatcher)
 	}
 	if _, err := rand.Read(dispatcher.address); err != nil {
 		return nil, err
@@ -62,6 +104,35 @@ func (d *Dispatcher) RetryInterval() time.Duration {
 	return d.conn.RetryInterval()
 }
 
+// SetRetryPolicy controls the delay between transmission attempts. If policy is nil,
+// protocol.DefaultRetryPolicy is used.
+func (d *Dispatcher) SetRetryPolicy(policy *protocol.RetryPolicy) {
+	d.retryPolicy.Store(policy)
+}
+
+// Backoff returns a protocol.Backoff for a new operation, using the Dispatcher's RetryPolicy.
+func (d *Dispatcher) Backoff() *protocol.Backoff {
+	return d.retryPolicy.Load().Backoff(d.conn.RetryInterval())
+}
+
+// OnSessionChange registers fn to be called whenever the vehicle creates or updates a session, or
+// a command is authorized using a session (which advances its anti-replay counter). The fn callback
+// is invoked synchronously, so it must return quickly and must not call back into d. Pass nil to
+// remove the callback.
+func (d *Dispatcher) OnSessionChange(fn func()) {
+	if fn == nil {
+		d.sessionChanged.Store(nil)
+	} else {
+		d.sessionChanged.Store(&fn)
+	}
+}
+
+func (d *Dispatcher) notifySessionChange() {
+	if fn := d.sessionChanged.Load(); fn != nil {
+		(*fn)()
+	}
+}
+
 // StartSession sends a blocking request start an authenticated session with a universal.Domain.
 func (d *Dispatcher) StartSession(ctx context.Context, domain universal.Domain) error {
 	var err error
@@ -119,27 +190,37 @@ func (d *Dispatcher) StartSessions(ctx context.Context, domains []universal.Doma
 	return nil
 }
 
-func (d *Dispatcher) createHandler(key *receiverKey) *receiver {
+func (d *Dispatcher) createHandler(key *receiverKey, requestID string) *receiver {
 	d.handlerLock.Lock()
 	defer d.handlerLock.Unlock()
 
 	now := time.Now()
 	recv := &receiver{
 		key:           key,
-		ch:            make(chan *universal.RoutableMessage, receiverBufferSize),
+		requestID:     requestID,
+		ch:            make(chan *universal.RoutableMessage, d.receiverBufferSize),
 		dispatcher:    d,
 		requestSentAt: now,
 		lastActive:    now,
+		stack:         d.captureStack(),
 	}
 
 	d.handlers[*key] = recv
+	d.handlerStats.Created++
 	return recv
 }
 
 func (d *Dispatcher) closeHandler(recv *receiver) {
 	d.handlerLock.Lock()
-	delete(d.handlers, *recv.key)
+	// The receiver may have been reaped, or closed already.
+	if d.handlers[*recv.key] == recv {
+		delete(d.handlers, *recv.key)
+		d.handlerStats.Closed++
+	}
 	d.handlerLock.Unlock()
+	if recv.release != nil {
+		recv.release()
+	}
 }
 
 func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, handler *receiver) {
@@ -149,9 +230,10 @@ func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, h
 		return
 	}
 
+	logTag := messageTag(message.GetRequestUuid(), handler.requestID)
 	tag := message.GetSignatureData().GetSessionInfoTag().GetTag()
 	if tag == nil {
-		log.Warning("[%02x] Discarding unauthenticated session info", message.GetRequestUuid())
+		log.Warning("%s Discarding unauthenticated session info", logTag)
 	}
 	var err error
 
@@ -160,24 +242,25 @@ func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, h
 
 	session, ok := d.sessions[domain]
 	if !ok {
-		log.Error("[%02x] Dropping session from unregistered domain %s", message.GetRequestUuid(), domain)
+		log.Error("%s Dropping session from unregistered domain %s", logTag, domain)
 		return
 	}
 
 	if session == nil {
 		if session, err = NewSession(d.privateKey, d.conn.VIN()); err != nil {
-			log.Error("[%02x] Error creating new session: %s", message.GetRequestUuid(), err)
+			log.Error("%s Error creating new session: %s", logTag, err)
 			return
 		}
 		d.sessions[domain] = session
 	}
 
 	if err = session.ProcessHello(message.GetRequestUuid(), sessionInfo, tag); err != nil {
-		log.Warning("[%02x] Session info error: %s", message.GetRequestUuid(), err)
+		log.Warning("%s Session info error: %s", logTag, err)
 		d.sessions[domain] = nil
 		return
 	}
-	log.Info("[%02x] Updated session info for %s", message.GetRequestUuid(), domain)
+	log.Info("%s Updated session info for %s", logTag, domain)
+	d.notifySessionChange()
 }
 
 func (d *Dispatcher) process(message *universal.RoutableMessage) {
@@ -204,9 +287,11 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 		return
 	}
 
-	switch d := destination.SubDestination.(type) {
+	switch dest := destination.SubDestination.(type) {
 	case *universal.Destination_Domain:
-		log.Debug("[%02x] Dropping message to %s", message.GetRequestUuid(), d.Domain)
+		if !d.publish(message) {
+			log.Debug("[%02x] Dropping message to %s", message.GetRequestUuid(), dest.Domain)
+		}
 		return
 	case *universal.Destination_RoutingAddress:
 		// Continue
@@ -224,9 +309,14 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 
 	d.handlerLock.Lock()
 	handler, ok := d.handlers[key]
+	if ok {
+		handler.lastActive = time.Now()
+	}
 	d.handlerLock.Unlock()
 	if !ok {
-		log.Warning("[%02x] Dropping message without registered handler %s", requestUUID, key.String())
+		if !d.publish(message) {
+			log.Warning("[%02x] Dropping message without registered handler %s", requestUUID, key.String())
+		}
 		return
 	}
 
@@ -240,8 +330,9 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 
 	select {
 	case handler.ch <- message:
+		log.Debug("%s Routed response to handler", messageTag(requestUUID, handler.requestID))
 	default:
-		log.Error("[%02x] Dropping response to command because response handler queue is full", requestUUID)
+		log.Error("%s Dropping response to command because response handler queue is full", messageTag(requestUUID, handler.requestID))
 	}
 }
 
@@ -275,8 +366,12 @@ func (d *Dispatcher) listen(ready chan<- struct{}) {
 	defer func() {
 		d.done <- true
 	}()
+	reap := time.NewTicker(d.reapInterval())
+	defer reap.Stop()
 	for {
 		select {
+		case now := <-reap.C:
+			d.reapReceivers(now)
 		case messageBytes, open := <-d.conn.Receive():
 			if !open {
 				return
@@ -304,6 +399,10 @@ func (d *Dispatcher) Stop() {
 		d.terminate = nil
 		<-d.done
 	}
+	if d.leakDetection {
+		d.reportOpenReceivers()
+	}
+	d.closeSubscriptions()
 }
 
 // Send a message to a vehicle.
@@ -343,6 +442,7 @@ func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessag
 		SubDestination: &universal.Destination_RoutingAddress{RoutingAddress: addr},
 	}
 
+	var release func()
 	if auth != connector.AuthMethodNone {
 		d.sessionLock.Lock()
 		session, ok := d.sessions[message.GetToDestination().GetDomain()]
@@ -351,39 +451,84 @@ func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessag
 			log.Warning("No session available for %s", message.GetToDestination().GetDomain())
 			return nil, protocol.ErrNoSession
 		}
-		if err := session.Authorize(ctx, message, auth); err != nil {
+		// The anti-replay counter must be allocated after reserving a place in the domain's
+		// pipeline so that counters reach the vehicle in an order it accepts.
+		var err error
+		if release, err = d.reserve(ctx, key.domain); err != nil {
 			return nil, err
 		}
+		if err = d.authorize(ctx, session, key.domain, message, auth); err != nil {
+			release()
+			return nil, err
+		}
+		d.notifySessionChange()
 	}
 
-	resp := d.createHandler(&key)
-	encodedMessage, err := proto.Marshal(message)
-	if err != nil {
-		return nil, err
-	}
+	requestID := connector.RequestID(ctx)
+	logTag := messageTag(uuid, requestID)
+	resp := d.createHandler(&key, requestID)
+	resp.release = release
+	var err error
 	defer func() {
 		if err != nil {
 			resp.Close()
 		}
 	}()
+	encodedMessage, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
 
+	log.Debug("%s Sending message to %s", logTag, key.domain)
+	backoff := d.Backoff()
 	for {
 		err = d.conn.Send(ctx, encodedMessage)
 		if err == nil {
 			return resp, nil
 		}
+		if errors.Is(err, protocol.ErrTransportChanged) {
+			// Resending the same message can't succeed. The caller must authorize a new one
+			// using the Connector's current PreferredAuthMethod.
+			log.Debug("%s Transport changed before transmission", logTag)
+			return nil, err
+		}
 		if !protocol.ShouldRetry(err) {
-			log.Warning("[%02x] Terminal transmission error: %s", message.GetUuid(), err)
+			log.Warning("%s Terminal transmission error: %s", logTag, err)
 			return nil, err
 		}
-		log.Debug("[%02x] Retrying transmission after error: %s", message.GetUuid(), err)
-		select {
-		case <-ctx.Done():
-			return nil, &protocol.CommandError{Err: ctx.Err(), PossibleSuccess: false, PossibleTemporary: true}
-		case <-time.After(d.conn.RetryInterval()):
-			continue
+		log.Debug("%s Retrying transmission after error: %s", logTag, err)
+		if err := backoff.Wait(ctx, err); err != nil {
+			return nil, &protocol.CommandError{Err: err, PossibleSuccess: false, PossibleTemporary: true}
+		}
+	}
+}
+
+// authorize adds authentication data to message, first reserving counters if d has a
+// CounterReserver.
+func (d *Dispatcher) authorize(ctx context.Context, session *session, domain universal.Domain, message *universal.RoutableMessage, auth connector.AuthMethod) error {
+	if d.counterReserver == nil {
+		return session.Authorize(ctx, message, auth, d.commandExpiry, false)
+	}
+	for {
+		if err := session.reserveCounters(ctx, int(domain), d.counterReserver, d.privateKey); err != nil {
+			return err
 		}
+		if err := session.Authorize(ctx, message, auth, d.commandExpiry, true); err != errCountersExhausted {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// messageTag formats a RoutableMessage UUID for log messages, including the caller's correlation
+// ID if one is available.
+func messageTag(uuid []byte, requestID string) string {
+	if requestID == "" {
+		return fmt.Sprintf("[%02x]", uuid)
 	}
+	return fmt.Sprintf("[%02x %s]", uuid, requestID)
 }
 
 // SessionInfoRequest returns a RoutableMesasge that initiates a handshake with a vehicle Domain.
@@ -423,12 +568,12 @@ func (d *Dispatcher) Cache() []CacheEntry {
 		if session == nil {
 			continue
 		}
-		encodedInfo := session.export()
+		encodedInfo, updatedAt := session.export()
 		if encodedInfo == nil {
 			continue
 		}
 		entry := CacheEntry{
-			CreatedAt:   time.Now(),
+			CreatedAt:   updatedAt,
 			Domain:      int(domain),
 			SessionInfo: encodedInfo,
 		}
@@ -452,6 +597,7 @@ func (d *Dispatcher) LoadCache(entries []CacheEntry) error {
 		if err != nil {
 			return fmt.Errorf("invalid cache: %s", err)
 		}
+		s.updatedAt = entry.CreatedAt
 		sessions[universal.Domain(entry.Domain)] = s
 	}
 
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
 	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
 )
 
@@ -860,3 +862,473 @@ func TestCache(t *testing.T) {
 		t.Errorf("Timed out waiting for response")
 	}
 }
+
+func TestOnSessionChange(t *testing.T) {
+	conn := newDummyConnector(t)
+	defer conn.Close()
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create private key: %s", err)
+	}
+	dispatcher, err := New(conn, key)
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	var changes atomic.Int32
+	dispatcher.OnSessionChange(func() { changes.Add(1) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+	if err := dispatcher.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.Stop()
+	if err := dispatcher.StartSession(ctx, testDomain); err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+	if n := changes.Load(); n != 1 {
+		t.Errorf("Expected one change after handshake but got %d", n)
+	}
+
+	rsp, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodHMAC)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rsp.Close()
+	if n := changes.Load(); n != 2 {
+		t.Errorf("Expected change after authorizing command but got %d changes", n)
+	}
+
+	rsp, err = dispatcher.Send(ctx, testCommand(), connector.AuthMethodNone)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rsp.Close()
+	if n := changes.Load(); n != 2 {
+		t.Errorf("Unauthenticated command changed session")
+	}
+}
+
+func unsolicitedMessage(from universal.Domain, payload []byte) *universal.RoutableMessage {
+	return &universal.RoutableMessage{
+		ToDestination: &universal.Destination{
+			SubDestination: &universal.Destination_Domain{Domain: universal.Domain_DOMAIN_BROADCAST},
+		},
+		FromDestination: &universal.Destination{
+			SubDestination: &universal.Destination_Domain{Domain: from},
+		},
+		Payload: &universal.RoutableMessage_ProtobufMessageAsBytes{ProtobufMessageAsBytes: payload},
+		Uuid:    testUUID(),
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	dispatcher, conn := getTestSetup(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+
+	wantPayload := func(message *universal.RoutableMessage) bool {
+		return bytes.Equal(message.GetProtobufMessageAsBytes(), []byte("wanted"))
+	}
+	messages := dispatcher.Subscribe(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY, wantPayload)
+	all := dispatcher.Subscribe(ctx, universal.Domain_DOMAIN_BROADCAST, nil)
+
+	conn.EnqueueReply(t, encodeRoutableMessage(t, unsolicitedMessage(universal.Domain_DOMAIN_INFOTAINMENT, []byte("wanted"))))
+	conn.EnqueueReply(t, encodeRoutableMessage(t, unsolicitedMessage(universal.Domain_DOMAIN_VEHICLE_SECURITY, []byte("unwanted"))))
+	conn.EnqueueReply(t, encodeRoutableMessage(t, unsolicitedMessage(universal.Domain_DOMAIN_VEHICLE_SECURITY, []byte("wanted"))))
+
+	select {
+	case message := <-messages:
+		if message.GetFromDestination().GetDomain() != universal.Domain_DOMAIN_VEHICLE_SECURITY || !wantPayload(message) {
+			t.Errorf("Subscription received wrong message: %v", message)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timed out waiting for message")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-all:
+		case <-ctx.Done():
+			t.Fatalf("Broadcast subscription received %d of 3 messages", i)
+		}
+	}
+	select {
+	case message := <-messages:
+		t.Errorf("Subscription received unexpected message: %v", message)
+	default:
+	}
+}
+
+func TestSubscriptionClosed(t *testing.T) {
+	dispatcher, conn := getTestSetup(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := dispatcher.Subscribe(ctx, universal.Domain_DOMAIN_BROADCAST, nil)
+	stopped := dispatcher.Subscribe(context.Background(), universal.Domain_DOMAIN_BROADCAST, nil)
+
+	timeout := time.After(quiescentDelay)
+	cancel()
+	select {
+	case _, ok := <-cancelled:
+		if ok {
+			t.Errorf("Received unexpected message")
+		}
+	case <-timeout:
+		t.Errorf("Subscription wasn't closed after context was cancelled")
+	}
+
+	dispatcher.Stop()
+	select {
+	case _, ok := <-stopped:
+		if ok {
+			t.Errorf("Received unexpected message")
+		}
+	case <-timeout:
+		t.Errorf("Subscription wasn't closed after dispatcher stopped")
+	}
+}
+
+func TestCommandExpiry(t *testing.T) {
+	const defaultExpiry = 5 * time.Second
+	if expiry := commandExpiry(context.Background(), defaultExpiry); expiry != defaultExpiry {
+		t.Errorf("Expected default expiry %s but got %s", defaultExpiry, expiry)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if expiry := commandExpiry(ctx, defaultExpiry); expiry <= defaultExpiry || expiry > 20*time.Second {
+		t.Errorf("Expected expiry to track context deadline but got %s", expiry)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if expiry := commandExpiry(ctx, defaultExpiry); expiry != maxCommandExpiry {
+		t.Errorf("Expected expiry to be capped at %s but got %s", maxCommandExpiry, expiry)
+	}
+	if expiry := commandExpiry(ctx, 10*time.Minute); expiry != 10*time.Minute {
+		t.Errorf("Expected cap to be raised to default expiry but got %s", expiry)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if expiry := commandExpiry(ctx, defaultExpiry); expiry != minCommandExpiry {
+		t.Errorf("Expected minimum expiry %s but got %s", minCommandExpiry, expiry)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	conn := newDummyConnector(t)
+	defer conn.Close()
+	dispatcher, err := New(conn, nil,
+		WithSessionInfoTimeout(time.Minute),
+		WithCommandExpiry(2*time.Minute),
+		WithReceiverBufferSize(3),
+		WithSubscriptionBufferSize(4),
+		WithReceiverBufferSize(0), // Ignored
+	)
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	if dispatcher.sessionInfoTimeout != time.Minute {
+		t.Errorf("Unexpected session info timeout: %s", dispatcher.sessionInfoTimeout)
+	}
+	if dispatcher.commandExpiry != 2*time.Minute {
+		t.Errorf("Unexpected command expiry: %s", dispatcher.commandExpiry)
+	}
+	if dispatcher.receiverBufferSize != 3 {
+		t.Errorf("Unexpected receiver buffer size: %d", dispatcher.receiverBufferSize)
+	}
+	if dispatcher.subscriptionBufferSize != 4 {
+		t.Errorf("Unexpected subscription buffer size: %d", dispatcher.subscriptionBufferSize)
+	}
+
+	recv := dispatcher.createHandler(&receiverKey{domain: testDomain}, "")
+	defer recv.Close()
+	if cap(recv.ch) != 3 {
+		t.Errorf("Receiver buffer size not applied: %d", cap(recv.ch))
+	}
+	if recv.requestSentAt = time.Now().Add(-30 * time.Second); recv.expired() {
+		t.Errorf("Receiver expired before session info timeout")
+	}
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	dispatcher, conn := getTestSetup(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+
+	var pending []protocol.Receiver
+	for i := 0; i < pipelineDepth; i++ {
+		recv, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodHMAC)
+		if err != nil {
+			t.Fatalf("Unexpected error sending command %d: %s", i, err)
+		}
+		pending = append(pending, recv)
+	}
+
+	blockedCtx, blockedCancel := context.WithTimeout(ctx, quiescentDelay/5)
+	defer blockedCancel()
+	if _, err := dispatcher.Send(blockedCtx, testCommand(), connector.AuthMethodHMAC); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected command beyond pipeline depth to block, but got %v", err)
+	}
+
+	// Unauthenticated messages don't use anti-replay counters and aren't limited.
+	if recv, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodNone); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else {
+		recv.Close()
+	}
+
+	pending[0].Close()
+	pending[0].Close() // Closing twice must not free a second slot
+	recv, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodHMAC)
+	if err != nil {
+		t.Fatalf("Unexpected error after closing receiver: %s", err)
+	}
+	pending[0] = recv
+
+	blockedCtx, blockedCancel = context.WithTimeout(ctx, quiescentDelay/5)
+	defer blockedCancel()
+	if _, err := dispatcher.Send(blockedCtx, testCommand(), connector.AuthMethodHMAC); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected command beyond pipeline depth to block, but got %v", err)
+	}
+	for _, recv := range pending {
+		recv.Close()
+	}
+}
+
+func TestVehicleSecurityCommandsQueued(t *testing.T) {
+	dispatcher, conn := getTestSetup(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+	if err := dispatcher.StartSession(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY); err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+
+	command := func() *universal.RoutableMessage {
+		message := testCommand()
+		message.ToDestination = &universal.Destination{
+			SubDestination: &universal.Destination_Domain{Domain: universal.Domain_DOMAIN_VEHICLE_SECURITY},
+		}
+		return message
+	}
+
+	first, err := dispatcher.Send(ctx, command(), connector.AuthMethodHMAC)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		recv, err := dispatcher.Send(ctx, command(), connector.AuthMethodHMAC)
+		if err == nil {
+			recv.Close()
+		}
+		queued <- err
+	}()
+
+	// Infotainment commands aren't held up by the VCSEC queue.
+	if recv, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodHMAC); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else {
+		recv.Close()
+	}
+
+	select {
+	case err := <-queued:
+		t.Fatalf("Second VCSEC command wasn't queued behind the first: %v", err)
+	case <-time.After(quiescentDelay / 5):
+	}
+
+	first.Close()
+	if err := <-queued; err != nil {
+		t.Errorf("Unexpected error sending queued command: %s", err)
+	}
+}
+
+func TestReapIdleReceivers(t *testing.T) {
+	conn := newDummyConnector(t)
+	defer conn.Close()
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create private key: %s", err)
+	}
+	dispatcher, err := New(conn, key, WithReceiverIdleTimeout(time.Minute), WithLeakDetection())
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+	if err := dispatcher.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.Stop()
+	if err := dispatcher.StartSession(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY); err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+	command := testCommand()
+	command.ToDestination = &universal.Destination{
+		SubDestination: &universal.Destination_Domain{Domain: universal.Domain_DOMAIN_VEHICLE_SECURITY},
+	}
+
+	closed, err := dispatcher.Send(ctx, testCommand(), connector.AuthMethodNone)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	closed.Close()
+	leaked, err := dispatcher.Send(ctx, command, connector.AuthMethodHMAC)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stack := leaked.(*receiver).stack; !bytes.Contains(stack, []byte("TestReapIdleReceivers")) {
+		t.Errorf("Stack trace wasn't recorded: %s", stack)
+	}
+
+	stats := dispatcher.HandlerStats()
+	// The session handshake accounts for one of the closed receivers.
+	if stats.Active != 1 || stats.Created != 3 || stats.Closed != 2 || stats.Reaped != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	dispatcher.reapReceivers(time.Now().Add(30 * time.Second))
+	if stats := dispatcher.HandlerStats(); stats.Active != 1 {
+		t.Errorf("Receivers reaped before idle timeout: %+v", stats)
+	}
+	dispatcher.reapReceivers(time.Now().Add(2 * time.Minute))
+	if stats := dispatcher.HandlerStats(); stats.Active != 0 || stats.Reaped != 1 {
+		t.Errorf("Unexpected stats after reaping: %+v", stats)
+	}
+
+	// The leaked receiver's place in the VCSEC queue must be freed.
+	recv, err := dispatcher.Send(ctx, command, connector.AuthMethodHMAC)
+	if err != nil {
+		t.Fatalf("Queue wasn't released by reaping: %s", err)
+	}
+	recv.Close()
+	leaked.Close()
+	if stats := dispatcher.HandlerStats(); stats.Closed != 3 {
+		t.Errorf("Closing a reaped receiver shouldn't count as a close: %+v", stats)
+	}
+}
+
+// sharedCounters simulates storage shared by clients that use the same private key.
+type sharedCounters struct {
+	lock      sync.Mutex
+	entry     *CacheEntry
+	blockSize uint32
+	calls     int
+}
+
+func (s *sharedCounters) reserve(ctx context.Context, entry CacheEntry) (CacheEntry, uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	current := entry
+	var info signatures.SessionInfo
+	if err := proto.Unmarshal(current.SessionInfo, &info); err != nil {
+		return entry, 0, err
+	}
+	if s.entry != nil {
+		var stored signatures.SessionInfo
+		if err := proto.Unmarshal(s.entry.SessionInfo, &stored); err != nil {
+			return entry, 0, err
+		}
+		if bytes.Equal(stored.GetEpoch(), info.GetEpoch()) && stored.GetCounter() > info.GetCounter() {
+			current = *s.entry
+			info.Counter = stored.GetCounter()
+		}
+	}
+	limit := info.GetCounter() + s.blockSize
+	reserved := current
+	info.Counter = limit
+	var err error
+	if reserved.SessionInfo, err = proto.Marshal(&info); err != nil {
+		return entry, 0, err
+	}
+	s.entry = &reserved
+	return current, limit, nil
+}
+
+func TestCounterReserver(t *testing.T) {
+	shared := &sharedCounters{blockSize: 3}
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create private key: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+
+	first, err := New(newDummyConnector(t), key, WithCounterReserver(shared.reserve))
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	if err := first.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+	if err := first.StartSession(ctx, testDomain); err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+
+	second, err := New(newDummyConnector(t), key, WithCounterReserver(shared.reserve))
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	if err := second.LoadCache(first.Cache()); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Stop()
+
+	used := make(map[uint32]bool)
+	for i := 0; i < 10; i++ {
+		for _, d := range []*Dispatcher{first, second} {
+			message := testCommand()
+			recv, err := d.Send(ctx, message, connector.AuthMethodHMAC)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			recv.Close()
+			counter := message.GetSignatureData().GetHMAC_PersonalizedData().GetCounter()
+			if used[counter] {
+				t.Fatalf("Counter %d was used by two commands", counter)
+			}
+			used[counter] = true
+		}
+	}
+	// Each dispatcher reserves a new block after using blockSize counters.
+	if expected := 2 * ((10 + int(shared.blockSize) - 1) / int(shared.blockSize)); shared.calls != expected {
+		t.Errorf("Expected %d reservations but got %d", expected, shared.calls)
+	}
+}
+
+func TestTinyReceiverIdleTimeout(t *testing.T) {
+	conn := newDummyConnector(t)
+	defer conn.Close()
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create private key: %s", err)
+	}
+	dispatcher, err := New(conn, key, WithReceiverIdleTimeout(1))
+	if err != nil {
+		t.Fatalf("Couldn't initialize dispatcher: %s", err)
+	}
+	if interval := dispatcher.reapInterval(); interval != minReapInterval {
+		t.Errorf("Expected reap interval %s but got %s", minReapInterval, interval)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quiescentDelay)
+	defer cancel()
+	if err := dispatcher.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Stop()
+}
@@ -0,0 +1,77 @@
+package dispatcher
+
+import "time"
+
+// Option configures optional Dispatcher behavior.
+type Option func(*Dispatcher)
+
+// WithSessionInfoTimeout sets how long after sending a request the Dispatcher accepts session info
+// included in the vehicle's response. Session info that arrives later is discarded as stale.
+func WithSessionInfoTimeout(timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		if timeout > 0 {
+			d.sessionInfoTimeout = timeout
+		}
+	}
+}
+
+// WithCommandExpiry sets how long the vehicle should accept an authenticated command after it's
+// sent, when the Context passed to Send doesn't have a deadline. If the Context has a deadline, the
+// command expires at the deadline instead, but no later than 30 seconds or expiry after it's sent,
+// whichever is longer.
+func WithCommandExpiry(expiry time.Duration) Option {
+	return func(d *Dispatcher) {
+		if expiry > 0 {
+			d.commandExpiry = expiry
+		}
+	}
+}
+
+// WithReceiverBufferSize sets the number of responses to a single request that can be queued
+// before further responses are dropped.
+func WithReceiverBufferSize(size int) Option {
+	return func(d *Dispatcher) {
+		if size > 0 {
+			d.receiverBufferSize = size
+		}
+	}
+}
+
+// WithSubscriptionBufferSize sets the number of unsolicited messages that can be queued for each
+// subscription before further messages are dropped.
+func WithSubscriptionBufferSize(size int) Option {
+	return func(d *Dispatcher) {
+		if size > 0 {
+			d.subscriptionBufferSize = size
+		}
+	}
+}
+
+// WithReceiverIdleTimeout sets how long a receiver can go without receiving a message before the
+// Dispatcher assumes the caller forgot to close it. Idle receivers are unregistered and a warning
+// is logged.
+func WithReceiverIdleTimeout(timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		if timeout > 0 {
+			d.receiverIdleTimeout = timeout
+		}
+	}
+}
+
+// WithLeakDetection records the stack trace of each call that creates a receiver, and includes it
+// in the warning logged when the receiver is found to have been leaked. Receivers that are still
+// open when the Dispatcher stops are also reported. This has a performance cost and is intended
+// for debugging.
+func WithLeakDetection() Option {
+	return func(d *Dispatcher) {
+		d.leakDetection = true
+	}
+}
+
+// WithCounterReserver causes the Dispatcher to reserve anti-replay counters using reserver before
+// authorizing commands. This allows clients in different processes to share sessions safely.
+func WithCounterReserver(reserver CounterReserver) Option {
+	return func(d *Dispatcher) {
+		d.counterReserver = reserver
+	}
+}
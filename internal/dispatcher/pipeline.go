@@ -0,0 +1,57 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+// pipelineDepth is the maximum number of authenticated commands that can be in flight to a domain
+// that accepts out-of-order commands. Commands may reach the vehicle in a different order than
+// their anti-replay counters were allocated, so this must be smaller than the vehicle's sliding
+// window (32 counter values) to ensure none are rejected as replays.
+const pipelineDepth = 16
+
+// pipelineDepthFor returns the number of authenticated commands that can be in flight to domain.
+//
+// Infotainment matches responses to requests by UUID and accepts counters anywhere within its
+// sliding window, so its commands are pipelined. VCSEC rejects commands that arrive out of order
+// and only processes one command at a time, so its commands are queued: each command waits until
+// the response to the previous one has been received and its Receiver closed.
+func pipelineDepthFor(domain universal.Domain) int {
+	if domain == universal.Domain_DOMAIN_VEHICLE_SECURITY {
+		return 1
+	}
+	return pipelineDepth
+}
+
+// pipeline returns the semaphore that limits in-flight commands to domain. Pipelines are kept
+// separately from sessions so that ordering is preserved when a session is replaced by a handshake.
+func (d *Dispatcher) pipeline(domain universal.Domain) chan struct{} {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+	p, ok := d.pipelines[domain]
+	if !ok {
+		p = make(chan struct{}, pipelineDepthFor(domain))
+		d.pipelines[domain] = p
+	}
+	return p
+}
+
+// reserve blocks until an authenticated command can be sent to domain, or until ctx is done. The
+// caller must allocate the command's anti-replay counter after reserve returns, and invoke release
+// once the command is no longer in flight. Calling release more than once has no effect.
+// Commands that are waiting at the same time may be admitted in any order.
+func (d *Dispatcher) reserve(ctx context.Context, domain universal.Domain) (release func(), err error) {
+	p := d.pipeline(domain)
+	select {
+	case p <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-p })
+	}, nil
+}
@@ -0,0 +1,107 @@
+package dispatcher
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+)
+
+// Default for a value that can be changed using WithReceiverIdleTimeout.
+var receiverIdleTimeout = 5 * time.Minute
+
+// minReapInterval bounds how often the Dispatcher checks for idle receivers, so that very short
+// idle timeouts don't result in a busy loop.
+const minReapInterval = 10 * time.Millisecond
+
+// HandlerStats describes the receivers a Dispatcher has created for pending commands. A steadily
+// increasing Active count, or a non-zero Reaped count, indicates a caller isn't closing the
+// receivers returned by Send.
+type HandlerStats struct {
+	// Active is the number of receivers that are currently registered.
+	Active int
+	// Created is the total number of receivers created.
+	Created uint64
+	// Closed is the total number of receivers closed by their callers.
+	Closed uint64
+	// Reaped is the total number of receivers that were removed after being idle for too long.
+	Reaped uint64
+}
+
+// HandlerStats returns statistics about d's receivers.
+func (d *Dispatcher) HandlerStats() HandlerStats {
+	d.handlerLock.Lock()
+	defer d.handlerLock.Unlock()
+	stats := d.handlerStats
+	stats.Active = len(d.handlers)
+	return stats
+}
+
+// reapInterval returns how often the Dispatcher checks for idle receivers.
+func (d *Dispatcher) reapInterval() time.Duration {
+	if interval := d.receiverIdleTimeout / 2; interval > minReapInterval {
+		return interval
+	}
+	return minReapInterval
+}
+
+// reapReceivers unregisters receivers that haven't received a message since before now minus the
+// idle timeout. This bounds the growth of d.handlers when callers forget to close receivers, and
+// frees their place in the domain's pipeline so that subsequent commands aren't blocked.
+//
+// Reaped receivers aren't closed, since the caller may still be reading from them, but they don't
+// receive any further messages.
+func (d *Dispatcher) reapReceivers(now time.Time) {
+	cutoff := now.Add(-d.receiverIdleTimeout)
+	var reaped []*receiver
+	d.handlerLock.Lock()
+	for key, recv := range d.handlers {
+		if recv.lastActive.Before(cutoff) {
+			delete(d.handlers, key)
+			reaped = append(reaped, recv)
+		}
+	}
+	d.handlerStats.Reaped += uint64(len(reaped))
+	d.handlerLock.Unlock()
+
+	for _, recv := range reaped {
+		if recv.release != nil {
+			recv.release()
+		}
+		d.reportLeak(recv, fmt.Sprintf("idle since %s", recv.lastActive.Format(time.RFC3339)))
+	}
+}
+
+// reportLeak logs a warning about a receiver that wasn't closed. If leak detection is enabled, the
+// warning includes the stack trace of the call that created the receiver.
+func (d *Dispatcher) reportLeak(recv *receiver, reason string) {
+	tag := messageTag(recv.key.uuid[:], recv.requestID)
+	if recv.stack == nil {
+		log.Warning("%s %s receiver was never closed (%s)", tag, recv.key.domain, reason)
+		return
+	}
+	log.Warning("%s %s receiver was never closed (%s); created at:\n%s", tag, recv.key.domain, reason, recv.stack)
+}
+
+// reportOpenReceivers logs a warning for each receiver that is still registered. It's invoked when
+// d stops if leak detection is enabled.
+func (d *Dispatcher) reportOpenReceivers() {
+	d.handlerLock.Lock()
+	open := make([]*receiver, 0, len(d.handlers))
+	for _, recv := range d.handlers {
+		open = append(open, recv)
+	}
+	d.handlerLock.Unlock()
+	for _, recv := range open {
+		d.reportLeak(recv, "open when dispatcher stopped")
+	}
+}
+
+// captureStack returns the current goroutine's stack trace if leak detection is enabled.
+func (d *Dispatcher) captureStack() []byte {
+	if !d.leakDetection {
+		return nil
+	}
+	return debug.Stack()
+}
@@ -28,10 +28,15 @@ func (r *receiverKey) String() string {
 // receiver represents a vehicle's pending response to a command.
 type receiver struct {
 	key           *receiverKey
+	requestID     string
 	ch            chan *universal.RoutableMessage
 	dispatcher    *Dispatcher
 	requestSentAt time.Time
 	lastActive    time.Time
+	// release, if not nil, frees the request's place in its domain's pipeline.
+	release func()
+	// stack records where the receiver was created, if leak detection is enabled.
+	stack []byte
 }
 
 // Recv returns a channel that receives responses to the command that created the receiver.
@@ -50,5 +55,9 @@ func (r *receiver) Close() {
 // expired returns true if the request was sent long enough ago that any included session info
 // should be discarded as stale.
 func (r *receiver) expired() bool {
-	return time.Now().After(r.requestSentAt.Add(sessionInfoRequestTimeout))
+	timeout := sessionInfoRequestTimeout
+	if r.dispatcher != nil {
+		timeout = r.dispatcher.sessionInfoTimeout
+	}
+	return time.Now().After(r.requestSentAt.Add(timeout))
 }
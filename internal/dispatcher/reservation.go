@@ -0,0 +1,74 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+)
+
+// errCountersExhausted indicates a session has used all of the counters reserved by its
+// CounterReserver.
+var errCountersExhausted = errors.New("dispatcher: reserved counters exhausted")
+
+// CounterReserver reserves anti-replay counters in storage that's shared with other clients using
+// the same private key, so that clients never authorize different commands with the same counter.
+//
+// The Dispatcher passes the session it's about to use. The CounterReserver returns the session the
+// Dispatcher should use instead, which is either entry or a newer session saved by another client,
+// and the highest counter the Dispatcher may use with it. The returned session's counter must be
+// the last counter used before the reservation.
+type CounterReserver func(ctx context.Context, entry CacheEntry) (CacheEntry, uint32, error)
+
+// reserveCounters ensures s has an unused reserved counter, calling reserver if needed.
+func (s *session) reserveCounters(ctx context.Context, domain int, reserver CounterReserver, private authentication.ECDHPrivateKey) error {
+	s.reserveLock.Lock()
+	defer s.reserveLock.Unlock()
+
+	s.lock.Lock()
+	if s.ctx == nil || !s.ready || s.ctx.Counter() < s.counterLimit {
+		s.lock.Unlock()
+		return nil
+	}
+	generation := s.generation
+	updatedAt := s.updatedAt
+	info, err := s.ctx.ExportSessionInfo()
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	entry, limit, err := reserver(ctx, CacheEntry{CreatedAt: updatedAt, Domain: domain, SessionInfo: info})
+	if err != nil {
+		return err
+	}
+	var reserved signatures.SessionInfo
+	if err := proto.Unmarshal(entry.SessionInfo, &reserved); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.generation != generation || s.ctx == nil {
+		// The vehicle updated the session while the reservation was in progress, so the reserved
+		// counters may not apply to it. The caller will make another reservation.
+		return nil
+	}
+	if !bytes.Equal(reserved.GetEpoch(), s.ctx.Epoch()) {
+		// Another client has a newer session.
+		signer, err := authentication.ImportSessionInfo(private, s.vin, entry.SessionInfo, entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+		s.ctx = signer
+		s.updatedAt = entry.CreatedAt
+		s.generation++
+	}
+	s.ctx.AdvanceCounter(reserved.GetCounter())
+	s.counterLimit = limit
+	return nil
+}
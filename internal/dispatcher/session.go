@@ -30,6 +30,18 @@ type session struct {
 	private     authentication.ECDHPrivateKey
 	ready       bool
 	readySignal chan struct{}
+
+	// updatedAt is when the vehicle last sent session info, which is used to determine which of
+	// two sessions with different epochs is newer.
+	updatedAt time.Time
+	// generation is incremented whenever the vehicle updates the session, which invalidates any
+	// counters reserved using a CounterReserver.
+	generation uint64
+	// counterLimit is the highest counter reserved using a CounterReserver.
+	counterLimit uint32
+	// reserveLock serializes counter reservations. It's held while the CounterReserver accesses
+	// shared storage, so it must not be acquired while holding lock.
+	reserveLock sync.Mutex
 }
 
 // NewSession creates a new session object that can authorize commands going to
@@ -42,7 +54,44 @@ func NewSession(private authentication.ECDHPrivateKey, vin string) (*session, er
 	}, nil
 }
 
-func (s *session) Authorize(ctx context.Context, command *universal.RoutableMessage, method connector.AuthMethod) error {
+// minCommandExpiry is the shortest expiration time given to a command whose Context deadline is
+// imminent. The vehicle rejects commands that expire before they arrive, so there's no benefit to
+// expiring sooner.
+const minCommandExpiry = time.Second
+
+// maxCommandExpiry bounds how long a command remains valid when its Context has a distant deadline,
+// which limits how long a delayed copy of the command could be replayed to the vehicle. Commands
+// expire after defaultExpiry if it's longer.
+const maxCommandExpiry = 30 * time.Second
+
+// commandExpiry returns how long the vehicle should accept a command sent using ctx. Commands expire
+// at the ctx deadline, if it has one, so that slow connections don't result in commands being
+// rejected as expired while the caller is still waiting for them.
+func commandExpiry(ctx context.Context, defaultExpiry time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return defaultExpiry
+	}
+	limit := maxCommandExpiry
+	if defaultExpiry > limit {
+		limit = defaultExpiry
+	}
+	expiresIn := time.Until(deadline)
+	if expiresIn > limit {
+		return limit
+	}
+	if expiresIn < minCommandExpiry {
+		return minCommandExpiry
+	}
+	return expiresIn
+}
+
+// Authorize adds authentication data to command. The command expires at the ctx deadline, or after
+// defaultExpiry if ctx doesn't have a deadline.
+//
+// If limited is true, Authorize returns errCountersExhausted instead of using a counter that hasn't
+// been reserved using reserveCounters.
+func (s *session) Authorize(ctx context.Context, command *universal.RoutableMessage, method connector.AuthMethod, defaultExpiry time.Duration, limited bool) error {
 	var err error
 	for {
 		attempted := false
@@ -50,15 +99,20 @@ func (s *session) Authorize(ctx context.Context, command *universal.RoutableMess
 		case <-s.readySignal:
 			// Prevent a race condition where the goroutine may unblock but the
 			// session becomes invalid before it authorizes the command.
+			expiresIn := commandExpiry(ctx, defaultExpiry)
 			s.lock.Lock()
 			if s.ctx != nil && s.ready {
+				if limited && method != connector.AuthMethodNone && s.ctx.Counter() >= s.counterLimit {
+					s.lock.Unlock()
+					return errCountersExhausted
+				}
 				switch method {
 				case connector.AuthMethodNone:
 					err = nil
 				case connector.AuthMethodGCM:
-					err = s.ctx.Encrypt(command, commandTimeout)
+					err = s.ctx.Encrypt(command, expiresIn)
 				case connector.AuthMethodHMAC:
-					err = s.ctx.AuthorizeHMAC(command, commandTimeout)
+					err = s.ctx.AuthorizeHMAC(command, expiresIn)
 				default:
 					return errors.New("unrecognized authentication method")
 				}
@@ -87,17 +141,17 @@ func (s *session) VehiclePublicKeyBytes() []byte {
 	return s.ctx.RemotePublicKeyBytes()
 }
 
-func (s *session) export() []byte {
+func (s *session) export() ([]byte, time.Time) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if s.ctx == nil {
-		return nil
+		return nil, time.Time{}
 	}
 	info, err := s.ctx.ExportSessionInfo()
 	if err != nil {
-		return nil
+		return nil, time.Time{}
 	}
-	return info
+	return info, s.updatedAt
 }
 
 // ProcessHello verifies a session info message from the vehicle.
@@ -117,6 +171,11 @@ func (s *session) ProcessHello(challenge, info, tag []byte) error {
 	} else {
 		err = s.ctx.UpdateSignedSessionInfo(challenge, info, tag)
 	}
+	if err == nil {
+		s.generation++
+		s.updatedAt = time.Now()
+		s.counterLimit = 0
+	}
 
 	if err == nil && !s.ready {
 		s.ready = true
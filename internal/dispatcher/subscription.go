@@ -0,0 +1,98 @@
+package dispatcher
+
+import (
+	"context"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+var subscriptionBufferSize = 10
+
+// MessageFilter selects which messages are delivered to a subscription. A nil MessageFilter
+// accepts all messages.
+type MessageFilter func(message *universal.RoutableMessage) bool
+
+// subscription receives messages that the vehicle sends without a corresponding request.
+type subscription struct {
+	domain universal.Domain
+	filter MessageFilter
+	ch     chan *universal.RoutableMessage
+	done   chan struct{}
+}
+
+func (s *subscription) matches(message *universal.RoutableMessage) bool {
+	if s.domain != universal.Domain_DOMAIN_BROADCAST && s.domain != message.GetFromDestination().GetDomain() {
+		return false
+	}
+	return s.filter == nil || s.filter(message)
+}
+
+// Subscribe returns a channel that receives unsolicited messages from the vehicle: messages
+// addressed to a domain rather than to d, and messages that don't correspond to a pending request.
+// Only messages from domain that are accepted by filter are delivered. Use
+// universal.Domain_DOMAIN_BROADCAST to receive messages from all domains.
+//
+// The channel is closed when ctx is done or d is stopped. If the subscriber doesn't keep up with
+// incoming messages, excess messages are dropped rather than blocking delivery to other receivers.
+func (d *Dispatcher) Subscribe(ctx context.Context, domain universal.Domain, filter MessageFilter) <-chan *universal.RoutableMessage {
+	sub := &subscription{
+		domain: domain,
+		filter: filter,
+		ch:     make(chan *universal.RoutableMessage, d.subscriptionBufferSize),
+		done:   make(chan struct{}),
+	}
+	d.subscriptionLock.Lock()
+	d.subscriptions[sub] = struct{}{}
+	d.subscriptionLock.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.unsubscribe(sub)
+		case <-sub.done:
+		}
+	}()
+	return sub.ch
+}
+
+func (d *Dispatcher) unsubscribe(sub *subscription) {
+	d.subscriptionLock.Lock()
+	defer d.subscriptionLock.Unlock()
+	if _, ok := d.subscriptions[sub]; ok {
+		delete(d.subscriptions, sub)
+		close(sub.ch)
+		close(sub.done)
+	}
+}
+
+// closeSubscriptions removes all subscriptions, closing their channels.
+func (d *Dispatcher) closeSubscriptions() {
+	d.subscriptionLock.Lock()
+	defer d.subscriptionLock.Unlock()
+	for sub := range d.subscriptions {
+		delete(d.subscriptions, sub)
+		close(sub.ch)
+		close(sub.done)
+	}
+}
+
+// publish delivers an unsolicited message to matching subscriptions. Returns false if there weren't
+// any.
+func (d *Dispatcher) publish(message *universal.RoutableMessage) bool {
+	d.subscriptionLock.Lock()
+	defer d.subscriptionLock.Unlock()
+	delivered := false
+	for sub := range d.subscriptions {
+		if !sub.matches(message) {
+			continue
+		}
+		delivered = true
+		select {
+		case sub.ch <- message:
+		default:
+			log.Warning("[%02x] Dropping message because subscriber queue is full", message.GetUuid())
+		}
+	}
+	return delivered
+}
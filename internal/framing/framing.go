@@ -0,0 +1,90 @@
+// Package framing implements the length-prefixed datagram encoding used by stream-oriented
+// transports. Each datagram is preceded by its length, encoded as a 2-byte big-endian integer.
+package framing
+
+import (
+	"errors"
+	"io"
+)
+
+// HeaderLength is the number of bytes used to encode the length of a datagram.
+const HeaderLength = 2
+
+// MaxLength is the largest datagram that can be encoded.
+const MaxLength = 0xFFFF
+
+var (
+	// ErrMessageTooLong indicates a datagram exceeds the maximum length allowed by the encoding or
+	// by the transport.
+	ErrMessageTooLong = errors.New("framing: message too long")
+)
+
+// Encode returns message with a length prefix.
+func Encode(message []byte) ([]byte, error) {
+	if len(message) > MaxLength {
+		return nil, ErrMessageTooLong
+	}
+	out := make([]byte, 0, HeaderLength+len(message))
+	out = append(out, uint8(len(message)>>8), uint8(len(message)))
+	return append(out, message...), nil
+}
+
+// Read reads one length-prefixed datagram from r. Returns ErrMessageTooLong if the datagram is
+// longer than maxLength, in which case the stream can no longer be trusted to be aligned on a
+// frame boundary.
+func Read(r io.Reader, maxLength int) ([]byte, error) {
+	var header [HeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := 256*int(header[0]) + int(header[1])
+	if length > maxLength {
+		return nil, ErrMessageTooLong
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// A Decoder reassembles datagrams from fragments, such as BLE notifications, that are not aligned
+// with frame boundaries.
+type Decoder struct {
+	// MaxLength is the largest datagram the Decoder accepts.
+	MaxLength int
+	buffer    []byte
+}
+
+// Write appends p to d's input buffer.
+func (d *Decoder) Write(p []byte) {
+	d.buffer = append(d.buffer, p...)
+}
+
+// Reset discards any partially-received datagram.
+func (d *Decoder) Reset() {
+	d.buffer = []byte{}
+}
+
+// Next returns the next complete datagram in d's input buffer, or nil if a complete datagram
+// hasn't been received yet. If the next datagram exceeds d.MaxLength, then the input buffer is
+// discarded and Next returns ErrMessageTooLong.
+func (d *Decoder) Next() ([]byte, error) {
+	if len(d.buffer) < HeaderLength {
+		return nil, nil
+	}
+	length := 256*int(d.buffer[0]) + int(d.buffer[1])
+	if length > d.MaxLength {
+		d.Reset()
+		return nil, ErrMessageTooLong
+	}
+	if len(d.buffer) < HeaderLength+length {
+		return nil, nil
+	}
+	message := d.buffer[HeaderLength : HeaderLength+length]
+	d.buffer = d.buffer[HeaderLength+length:]
+	return message, nil
+}
@@ -0,0 +1,80 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	messages := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, 300)}
+	var stream []byte
+	for _, m := range messages {
+		encoded, err := Encode(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, encoded...)
+	}
+
+	// Feed the decoder one byte at a time to simulate fragmentation.
+	decoder := Decoder{MaxLength: 1024}
+	var decoded [][]byte
+	for _, b := range stream {
+		decoder.Write([]byte{b})
+		for {
+			message, err := decoder.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message == nil {
+				break
+			}
+			decoded = append(decoded, message)
+		}
+	}
+	if len(decoded) != len(messages) {
+		t.Fatalf("Expected %d messages but got %d", len(messages), len(decoded))
+	}
+	for i := range messages {
+		if !bytes.Equal(messages[i], decoded[i]) {
+			t.Errorf("Message %d: expected %02x but got %02x", i, messages[i], decoded[i])
+		}
+	}
+
+	r := bytes.NewReader(stream)
+	for i := range messages {
+		message, err := Read(r, MaxLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(messages[i], message) {
+			t.Errorf("Message %d: expected %02x but got %02x", i, messages[i], message)
+		}
+	}
+	if _, err := Read(r, MaxLength); err != io.EOF {
+		t.Errorf("Expected EOF but got %v", err)
+	}
+}
+
+func TestMessageTooLong(t *testing.T) {
+	if _, err := Encode(make([]byte, MaxLength+1)); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong but got %v", err)
+	}
+	encoded, err := Encode(make([]byte, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := Decoder{MaxLength: 10}
+	decoder.Write(encoded)
+	if _, err := decoder.Next(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong but got %v", err)
+	}
+	if _, err := Read(bytes.NewReader(encoded), 10); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong but got %v", err)
+	}
+	if _, err := Read(bytes.NewReader(encoded[:5]), MaxLength); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF but got %v", err)
+	}
+}
@@ -67,13 +67,31 @@ type Account struct {
 	UserAgent  string
 	authHeader string
 	Host       string
-	client     http.Client
+	client     *http.Client
+	tokenInfo  *TokenInfo
+	// tokens is set if the Account was created by NewWithTokenSource.
+	tokens *tokenTransport
 }
 
-// We don't parse JWTs beyond what's required to extract the API server domain name
+// An Option configures an Account.
+type Option func(*Account)
+
+// WithHTTPClient causes the Account, and the vehicle connections it creates, to send requests
+// using client. This allows callers to configure timeouts, TLS roots, outbound proxies and so on.
+// By default, an Account uses a client returned by [inet.NewHTTPClient].
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *Account) {
+		a.client = client
+	}
+}
+
+// We don't verify JWTs; the claims are only used to select the API server and for diagnostics.
 type oauthPayload struct {
-	Audiences []string `json:"aud"`
-	OUCode    string   `json:"ou_code"`
+	Audiences []string  `json:"aud"`
+	OUCode    string    `json:"ou_code"`
+	Expiry    int64     `json:"exp"`
+	Scopes    scopeList `json:"scp"`
+	ClientID  string    `json:"azp"`
 }
 
 var domainRegEx = regexp.MustCompile(`^[A-Za-z0-9-.]+$`) // We're mostly interested in stopping paths; the http package handles the rest.
@@ -81,6 +99,23 @@ var remappedDomains = map[string]string{}                // For use during devel
 
 const defaultDomain = "fleet-api.prd.na.vn.cloud.tesla.com"
 
+// parseToken extracts the payload of a JWT without verifying its signature.
+func parseToken(oauthToken string) (*oauthPayload, error) {
+	parts := strings.Split(oauthToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("client provided malformed OAuth token")
+	}
+	payloadJSON, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("client provided malformed OAuth token: %s (%s)", err, parts[1])
+	}
+	var payload oauthPayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, fmt.Errorf("client provided malformed OAuth token: %s", err)
+	}
+	return &payload, nil
+}
+
 func (p *oauthPayload) domain() string {
 	if len(remappedDomains) > 0 {
 		for _, a := range p.Audiences {
@@ -114,29 +149,41 @@ func (p *oauthPayload) domain() string {
 
 // New returns an [Account] that can be used to fetch a [vehicle.Vehicle].
 // Optional userAgent can be passed in - otherwise it will be generated from code
-func New(oauthToken, userAgent string) (*Account, error) {
-	parts := strings.Split(oauthToken, ".")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("client provided malformed OAuth token")
-	}
-	payloadJSON, err := base64.RawStdEncoding.DecodeString(parts[1])
+func New(oauthToken, userAgent string, options ...Option) (*Account, error) {
+	payload, err := parseToken(oauthToken)
 	if err != nil {
-		return nil, fmt.Errorf("client provided malformed OAuth token: %s (%s)", err, parts[1])
-	}
-	var payload oauthPayload
-	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
-		return nil, fmt.Errorf("client provided malformed OAuth token: %s", err)
+		return nil, err
 	}
 
 	domain := payload.domain()
 	if domain == "" {
 		return nil, fmt.Errorf("client provided OAuth token with invalid audiences")
 	}
-	return &Account{
+	acct := &Account{
 		UserAgent:  buildUserAgent(userAgent),
 		authHeader: "Bearer " + strings.TrimSpace(oauthToken),
 		Host:       domain,
-	}, nil
+		tokenInfo:  payload.info(),
+	}
+	for _, option := range options {
+		option(acct)
+	}
+	if acct.client == nil {
+		acct.client = inet.NewHTTPClient(nil)
+	}
+	return acct, nil
+}
+
+// TokenInfo returns the claims of the access token used to create the Account. If the Account was
+// created by [NewWithTokenSource], TokenInfo describes the access token most recently obtained from
+// the TokenSource instead, so that it reflects refreshed tokens.
+func (a *Account) TokenInfo() *TokenInfo {
+	if a.tokens != nil {
+		if info, err := ParseTokenInfo(a.tokens.current()); err == nil {
+			return info
+		}
+	}
+	return a.tokenInfo
 }
 
 // GetVehicle returns the Vehicle belonging to the account with the provided vin.
@@ -146,19 +193,26 @@ func New(oauthToken, userAgent string) (*Account, error) {
 // an AddKeyRequest; see documentation in [pkg/github.com/greenmission/vehicle-command/pkg/vehicle]. The
 // sessions parameter may also be nil, but providing a cache.SessionCache avoids a round-trip
 // handshake with the Vehicle in subsequent connections.
-func (a *Account) GetVehicle(ctx context.Context, vin string, privateKey authentication.ECDHPrivateKey, sessions *cache.SessionCache) (*vehicle.Vehicle, error) {
-	conn := inet.NewConnection(vin, a.authHeader, a.Host, a.UserAgent)
-	car, err := vehicle.NewVehicle(conn, privateKey, sessions)
+func (a *Account) GetVehicle(ctx context.Context, vin string, privateKey authentication.ECDHPrivateKey, sessions *cache.SessionCache, options ...vehicle.Option) (*vehicle.Vehicle, error) {
+	conn := a.Connection(vin)
+	car, err := vehicle.NewVehicle(conn, privateKey, sessions, options...)
 	if err != nil {
 		conn.Close()
 	}
 	return car, err
 }
 
+// Connection returns a Fleet API connection to the vehicle with the provided vin. Most clients
+// should use [Account.GetVehicle] instead; Connection is useful for wrapping the connector (for
+// example, to record traffic) before passing it to [vehicle.NewVehicle].
+func (a *Account) Connection(vin string) *inet.Connection {
+	return inet.NewConnectionWithClient(vin, a.authHeader, a.Host, a.UserAgent, a.client)
+}
+
 // Get sends an HTTP GET request to endpoint.
 //
 // The endpoint should contain only the path (e.g., "api/1/vehicles/foo"); the domain is determined
-// by the a.Host.
+// by the a.Host. If the server doesn't respond with 200 OK, the error is an *inet.HttpError.
 func (a *Account) Get(ctx context.Context, endpoint string) ([]byte, error) {
 	url := fmt.Sprintf("https://%s/%s", a.Host, endpoint)
 	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -174,21 +228,21 @@ func (a *Account) Get(ctx context.Context, endpoint string) ([]byte, error) {
 		return nil, fmt.Errorf("error fetching %s: %w", endpoint, err)
 	}
 	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		err := fmt.Errorf("http error when sending command to %s: %s", url, response.Status)
-		return nil, err
-	}
 	reader := io.LimitedReader{R: response.Body, N: connector.MaxResponseLength}
 	body, err := io.ReadAll(&reader)
 	if err != nil {
 		return nil, err
 	}
+	if response.StatusCode != http.StatusOK {
+		log.Debug("Server returned %s: %s", response.Status, body)
+		return nil, inet.NewHttpError(response.StatusCode, errorMessage(body), response.Header)
+	}
 	log.Debug("Received: %s\n", body)
 	return body, err
 }
 
 func (a *Account) sendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
-	return inet.SendFleetAPICommand(ctx, &a.client, a.UserAgent, a.authHeader, fmt.Sprintf("https://%s/%s", a.Host, endpoint), command)
+	return inet.SendFleetAPICommand(ctx, a.client, a.UserAgent, a.authHeader, fmt.Sprintf("https://%s/%s", a.Host, endpoint), command)
 }
 
 // Post sends an HTTP POST request to endpoint.
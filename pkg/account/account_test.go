@@ -1,9 +1,13 @@
 package account
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -73,6 +77,43 @@ func TestDomainExtraction(t *testing.T) {
 	}
 }
 
+func TestHTTPClientInjected(t *testing.T) {
+	var paths []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"response": null}`))
+	}))
+	defer server.Close()
+
+	payload := &oauthPayload{Audiences: []string{"https://fleet-api.prd.na.vn.cloud.tesla.com"}}
+	// The test server's certificate is only trusted by the client it provides.
+	acct, err := New(makeTestJWT(payload), "", WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("Returned error on valid JWT: %s", err)
+	}
+	acct.Host = strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := acct.Get(context.Background(), "api/1/vehicles"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := acct.Connection("5YJ3E1EA1JF000000").SendFleetAPICommand(context.Background(), "api/1/vehicles/5YJ3E1EA1JF000000/wake_up", nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(paths) != 2 || paths[0] != "/api/1/vehicles" || paths[1] != "/api/1/vehicles/5YJ3E1EA1JF000000/wake_up" {
+		t.Errorf("Unexpected requests: %v", paths)
+	}
+}
+
+func TestDefaultHTTPClientHasTimeout(t *testing.T) {
+	acct, err := New(makeTestJWT(&oauthPayload{}), "")
+	if err != nil {
+		t.Fatalf("Returned error on valid JWT: %s", err)
+	}
+	if acct.client == nil || acct.client.Timeout == 0 {
+		t.Errorf("Default HTTP client has no timeout")
+	}
+}
+
 func makeTestJWT(payload *oauthPayload) string {
 	jwtBody, _ := json.Marshal(payload)
 	return fmt.Sprintf("x.%s.y", b64Encode(string(jwtBody)))
@@ -0,0 +1,305 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+// fleetResponse is the envelope that Fleet API wraps around response bodies.
+type fleetResponse struct {
+	Response         json.RawMessage `json:"response"`
+	Pagination       *Pagination     `json:"pagination"`
+	Error            string          `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+}
+
+// errorMessage returns the Fleet API error message contained in body, or the raw body if it
+// doesn't contain one.
+func errorMessage(body []byte) string {
+	var reply fleetResponse
+	if err := json.Unmarshal(body, &reply); err == nil && reply.Error != "" {
+		if reply.ErrorDescription != "" {
+			return fmt.Sprintf("%s: %s", reply.Error, reply.ErrorDescription)
+		}
+		return reply.Error
+	}
+	return string(body)
+}
+
+// decodeResponse unmarshals the response field of a Fleet API reply into out.
+func decodeResponse(body []byte, out interface{}) (*fleetResponse, error) {
+	var reply fleetResponse
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return nil, fmt.Errorf("error decoding Fleet API response: %w", err)
+	}
+	if out != nil && len(reply.Response) > 0 {
+		if err := json.Unmarshal(reply.Response, out); err != nil {
+			return nil, fmt.Errorf("error decoding Fleet API response: %w", err)
+		}
+	}
+	return &reply, nil
+}
+
+func (a *Account) getJSON(ctx context.Context, endpoint string, query url.Values, out interface{}) (*fleetResponse, error) {
+	if len(query) > 0 {
+		endpoint = endpoint + "?" + query.Encode()
+	}
+	body, err := a.Get(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(body, out)
+}
+
+func (a *Account) postJSON(ctx context.Context, endpoint string, request, out interface{}) (*fleetResponse, error) {
+	body, err := a.sendFleetAPICommand(ctx, endpoint, request)
+	if err != nil {
+		var httpErr *inet.HttpError
+		if errors.As(err, &httpErr) {
+			decoded := *httpErr
+			decoded.Message = errorMessage([]byte(httpErr.Message))
+			return nil, &decoded
+		}
+		return nil, err
+	}
+	return decodeResponse(body, out)
+}
+
+// Pagination describes the position of a page within a paginated Fleet API response.
+type Pagination struct {
+	Previous *int `json:"previous"`
+	Next     *int `json:"next"`
+	Current  int  `json:"current"`
+	PerPage  int  `json:"per_page"`
+	Count    int  `json:"count"`
+	Pages    int  `json:"pages"`
+}
+
+// VehicleSummary describes a vehicle that belongs to or is shared with an account.
+type VehicleSummary struct {
+	ID          int64  `json:"id"`
+	VehicleID   int64  `json:"vehicle_id"`
+	VIN         string `json:"vin"`
+	DisplayName string `json:"display_name"`
+	// State is "online", "asleep", or "offline".
+	State      string `json:"state"`
+	InService  bool   `json:"in_service"`
+	AccessType string `json:"access_type"`
+	APIVersion int    `json:"api_version"`
+}
+
+// VehiclesPage fetches one page of the account's vehicles. Pages are numbered starting at 1. If
+// perPage is zero, the server's default page size is used. The returned Pagination is nil if the
+// server doesn't paginate the response.
+func (a *Account) VehiclesPage(ctx context.Context, page, perPage int) ([]*VehicleSummary, *Pagination, error) {
+	query := url.Values{}
+	if page > 0 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	if perPage > 0 {
+		query.Set("per_page", strconv.Itoa(perPage))
+	}
+	var vehicles []*VehicleSummary
+	reply, err := a.getJSON(ctx, "api/1/vehicles", query, &vehicles)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vehicles, reply.Pagination, nil
+}
+
+// ListVehicles returns all vehicles belonging to or shared with the account, fetching additional
+// pages as needed.
+func (a *Account) ListVehicles(ctx context.Context) ([]*VehicleSummary, error) {
+	var vehicles []*VehicleSummary
+	page := 1
+	for {
+		batch, pagination, err := a.VehiclesPage(ctx, page, 0)
+		if err != nil {
+			return nil, err
+		}
+		vehicles = append(vehicles, batch...)
+		// Guard against servers that return a non-advancing next page.
+		if pagination == nil || pagination.Next == nil || *pagination.Next <= page || len(batch) == 0 {
+			return vehicles, nil
+		}
+		page = *pagination.Next
+	}
+}
+
+// Endpoints that can be requested from [Account.VehicleData].
+const (
+	EndpointChargeState   = "charge_state"
+	EndpointClimateState  = "climate_state"
+	EndpointDriveState    = "drive_state"
+	EndpointLocationData  = "location_data"
+	EndpointVehicleState  = "vehicle_state"
+	EndpointVehicleConfig = "vehicle_config"
+	EndpointGUISettings   = "gui_settings"
+	EndpointClosuresState = "closures_state"
+)
+
+// VehicleData contains the state reported by a vehicle. Only the sections requested from
+// [Account.VehicleData] are populated. Timestamps are in milliseconds since the Unix epoch.
+type VehicleData struct {
+	VehicleSummary
+	ChargeState   *ChargeState   `json:"charge_state"`
+	ClimateState  *ClimateState  `json:"climate_state"`
+	DriveState    *DriveState    `json:"drive_state"`
+	VehicleState  *VehicleState  `json:"vehicle_state"`
+	VehicleConfig *VehicleConfig `json:"vehicle_config"`
+	// Raw holds the complete response, including fields that don't have a corresponding struct
+	// member.
+	Raw json.RawMessage `json:"-"`
+}
+
+type ChargeState struct {
+	BatteryLevel        int     `json:"battery_level"`
+	BatteryRange        float64 `json:"battery_range"`
+	ChargeLimitSOC      int     `json:"charge_limit_soc"`
+	ChargingState       string  `json:"charging_state"`
+	ChargeAmps          int     `json:"charge_amps"`
+	ChargerPower        int     `json:"charger_power"`
+	ChargePortDoorOpen  bool    `json:"charge_port_door_open"`
+	MinutesToFullCharge int     `json:"minutes_to_full_charge"`
+	Timestamp           int64   `json:"timestamp"`
+}
+
+type ClimateState struct {
+	InsideTemp           *float64 `json:"inside_temp"`
+	OutsideTemp          *float64 `json:"outside_temp"`
+	DriverTempSetting    float64  `json:"driver_temp_setting"`
+	PassengerTempSetting float64  `json:"passenger_temp_setting"`
+	IsClimateOn          bool     `json:"is_climate_on"`
+	Timestamp            int64    `json:"timestamp"`
+}
+
+type DriveState struct {
+	Latitude   float64  `json:"latitude"`
+	Longitude  float64  `json:"longitude"`
+	Heading    int      `json:"heading"`
+	Speed      *float64 `json:"speed"`
+	ShiftState *string  `json:"shift_state"`
+	Power      int      `json:"power"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
+type VehicleState struct {
+	Locked        bool    `json:"locked"`
+	Odometer      float64 `json:"odometer"`
+	CarVersion    string  `json:"car_version"`
+	SentryMode    bool    `json:"sentry_mode"`
+	IsUserPresent bool    `json:"is_user_present"`
+	Timestamp     int64   `json:"timestamp"`
+}
+
+type VehicleConfig struct {
+	CarType       string `json:"car_type"`
+	TrimBadging   string `json:"trim_badging"`
+	ExteriorColor string `json:"exterior_color"`
+	WheelType     string `json:"wheel_type"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// VehicleData fetches the state of a vehicle. If no endpoints are provided, the server returns
+// its default set. Requesting [EndpointLocationData] is required to obtain location on recent
+// firmware.
+//
+// The vehicle must be awake. If it isn't, the returned error is an *inet.HttpError with Code
+// http.StatusRequestTimeout.
+func (a *Account) VehicleData(ctx context.Context, vin string, endpoints ...string) (*VehicleData, error) {
+	query := url.Values{}
+	if len(endpoints) > 0 {
+		query.Set("endpoints", strings.Join(endpoints, ";"))
+	}
+	var data VehicleData
+	reply, err := a.getJSON(ctx, fmt.Sprintf("api/1/vehicles/%s/vehicle_data", url.PathEscape(vin)), query, &data)
+	if err != nil {
+		return nil, err
+	}
+	data.Raw = reply.Response
+	return &data, nil
+}
+
+// FleetStatus describes whether vehicles support, and have paired, the application's key.
+type FleetStatus struct {
+	KeyPairedVINs []string                    `json:"key_paired_vins"`
+	UnpairedVINs  []string                    `json:"unpaired_vins"`
+	VehicleInfo   map[string]*FleetStatusInfo `json:"vehicle_info"`
+}
+
+type FleetStatusInfo struct {
+	FirmwareVersion string `json:"firmware_version"`
+	// VehicleCommandProtocolRequired is true if the vehicle only accepts signed commands.
+	VehicleCommandProtocolRequired bool   `json:"vehicle_command_protocol_required"`
+	DiscountedDeviceData           bool   `json:"discounted_device_data"`
+	FleetTelemetryVersion          string `json:"fleet_telemetry_version"`
+	TotalNumberOfKeys              *int   `json:"total_number_of_keys"`
+}
+
+// KeyPaired returns true if the application's public key is enrolled on the vehicle with the
+// provided vin.
+func (s *FleetStatus) KeyPaired(vin string) bool {
+	for _, paired := range s.KeyPairedVINs {
+		if paired == vin {
+			return true
+		}
+	}
+	return false
+}
+
+// FleetStatus fetches the key pairing status and firmware information for vins.
+func (a *Account) FleetStatus(ctx context.Context, vins []string) (*FleetStatus, error) {
+	request := struct {
+		VINs []string `json:"vins"`
+	}{VINs: vins}
+	var status FleetStatus
+	if _, err := a.postJSON(ctx, "api/1/vehicles/fleet_status", &request, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// UserKey contains the metadata of a public key registered with [Account.UpdateKey].
+type UserKey struct {
+	PublicKey string `json:"public_key"`
+	Kind      string `json:"kind"`
+	Model     string `json:"model"`
+	Name      string `json:"name"`
+	Tag       string `json:"tag"`
+}
+
+// UserKeys fetches the metadata of public keys registered by the account.
+func (a *Account) UserKeys(ctx context.Context) ([]*UserKey, error) {
+	var keys []*UserKey
+	if _, err := a.getJSON(ctx, "api/1/users/keys", nil, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Region identifies the Fleet API server that hosts an account.
+type Region struct {
+	Region          string `json:"region"`
+	FleetAPIBaseURL string `json:"fleet_api_base_url"`
+}
+
+// Host returns the domain name of r.FleetAPIBaseURL, suitable for use as [Account.Host].
+func (r *Region) Host() string {
+	return strings.TrimSuffix(strings.TrimPrefix(r.FleetAPIBaseURL, "https://"), "/")
+}
+
+// Region fetches the region of the account.
+func (a *Account) Region(ctx context.Context) (*Region, error) {
+	var region Region
+	if _, err := a.getJSON(ctx, "api/1/users/region", nil, &region); err != nil {
+		return nil, err
+	}
+	return &region, nil
+}
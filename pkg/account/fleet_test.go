@@ -0,0 +1,227 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+const testVIN = "5YJ3E1EA1JF000000"
+
+// fleetServer is a fake of the Fleet API endpoints used by the typed Account methods.
+type fleetServer struct {
+	*httptest.Server
+	vehicles []*VehicleSummary
+	perPage  int
+	queries  []string
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}, pagination *Pagination) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response":   response,
+		"pagination": pagination,
+	})
+}
+
+func newFleetServer(t *testing.T) (*fleetServer, *Account) {
+	s := &fleetServer{perPage: 2}
+	for i := 0; i < 5; i++ {
+		s.vehicles = append(s.vehicles, &VehicleSummary{ID: int64(i), VIN: testVIN[:16] + strconv.Itoa(i), State: "online"})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/1/vehicles", func(w http.ResponseWriter, r *http.Request) {
+		s.queries = append(s.queries, r.URL.RawQuery)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		start := (page - 1) * s.perPage
+		end := start + s.perPage
+		if end > len(s.vehicles) {
+			end = len(s.vehicles)
+		}
+		pagination := &Pagination{Current: page, PerPage: s.perPage, Count: len(s.vehicles), Pages: (len(s.vehicles) + s.perPage - 1) / s.perPage}
+		if end < len(s.vehicles) {
+			next := page + 1
+			pagination.Next = &next
+		}
+		writeResponse(w, s.vehicles[start:end], pagination)
+	})
+	mux.HandleFunc("/api/1/vehicles/"+testVIN+"/vehicle_data", func(w http.ResponseWriter, r *http.Request) {
+		s.queries = append(s.queries, r.URL.RawQuery)
+		w.Write([]byte(`{"response": {"vin": "` + testVIN + `", "state": "online", "charge_state": {"battery_level": 71, "charging_state": "Stopped"}, "vehicle_state": {"locked": true, "car_version": "2024.2.7"}, "gui_settings": {"gui_24_hour_time": true}}}`))
+	})
+	mux.HandleFunc("/api/1/vehicles/asleep/vehicle_data", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestTimeout)
+		w.Write([]byte(`{"response": null, "error": "vehicle unavailable: vehicle is offline or asleep", "error_description": ""}`))
+	})
+	mux.HandleFunc("/api/1/vehicles/fleet_status", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			VINs []string `json:"vins"`
+		}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil || len(request.VINs) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_request", "error_description": "vins required"}`))
+			return
+		}
+		writeResponse(w, &FleetStatus{
+			KeyPairedVINs: request.VINs[:1],
+			UnpairedVINs:  request.VINs[1:],
+			VehicleInfo: map[string]*FleetStatusInfo{
+				request.VINs[0]: {FirmwareVersion: "2024.2.7", VehicleCommandProtocolRequired: true},
+			},
+		}, nil)
+	})
+	mux.HandleFunc("/api/1/users/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, []*UserKey{{PublicKey: "04abcd", Kind: "mobile_device", Name: "test"}}, nil)
+	})
+	mux.HandleFunc("/api/1/users/region", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, &Region{Region: "eu", FleetAPIBaseURL: "https://fleet-api.prd.eu.vn.cloud.tesla.com"}, nil)
+	})
+	s.Server = httptest.NewTLSServer(mux)
+
+	acct, err := New(makeTestJWT(&oauthPayload{}), "", WithHTTPClient(s.Client()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	acct.Host = strings.TrimPrefix(s.URL, "https://")
+	return s, acct
+}
+
+func TestListVehicles(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	vehicles, err := acct.ListVehicles(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(vehicles) != len(server.vehicles) {
+		t.Fatalf("Expected %d vehicles but got %d", len(server.vehicles), len(vehicles))
+	}
+	for i, v := range vehicles {
+		if v.VIN != server.vehicles[i].VIN || v.State != "online" {
+			t.Errorf("Unexpected vehicle %d: %+v", i, v)
+		}
+	}
+	if len(server.queries) != 3 || server.queries[2] != "page=3" {
+		t.Errorf("Unexpected requests: %v", server.queries)
+	}
+}
+
+func TestVehiclesPage(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	vehicles, pagination, err := acct.VehiclesPage(context.Background(), 2, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(vehicles) != 2 || vehicles[0].ID != 2 {
+		t.Errorf("Unexpected vehicles: %+v", vehicles)
+	}
+	if pagination == nil || pagination.Current != 2 || pagination.Next == nil || *pagination.Next != 3 || pagination.Count != 5 {
+		t.Errorf("Unexpected pagination: %+v", pagination)
+	}
+	if server.queries[0] != "page=2&per_page=2" {
+		t.Errorf("Unexpected query: %s", server.queries[0])
+	}
+}
+
+func TestVehicleData(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	data, err := acct.VehicleData(context.Background(), testVIN, EndpointChargeState, EndpointVehicleState)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if server.queries[0] != "endpoints=charge_state%3Bvehicle_state" {
+		t.Errorf("Unexpected query: %s", server.queries[0])
+	}
+	if data.VIN != testVIN || data.ChargeState == nil || data.ChargeState.BatteryLevel != 71 {
+		t.Errorf("Unexpected vehicle data: %+v", data)
+	}
+	if data.VehicleState == nil || !data.VehicleState.Locked || data.ClimateState != nil {
+		t.Errorf("Unexpected vehicle data: %+v", data)
+	}
+	if !strings.Contains(string(data.Raw), "gui_24_hour_time") {
+		t.Errorf("Raw response missing fields: %s", data.Raw)
+	}
+}
+
+func TestVehicleDataAsleep(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	_, err := acct.VehicleData(context.Background(), "asleep")
+	var httpErr *inet.HttpError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected HttpError but got %v", err)
+	}
+	if httpErr.Code != http.StatusRequestTimeout || httpErr.Message != "vehicle unavailable: vehicle is offline or asleep" {
+		t.Errorf("Unexpected error: %+v", httpErr)
+	}
+}
+
+func TestFleetStatus(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	other := "5YJ3E1EA1JF000001"
+	status, err := acct.FleetStatus(context.Background(), []string{testVIN, other})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !status.KeyPaired(testVIN) || status.KeyPaired(other) {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if info := status.VehicleInfo[testVIN]; info == nil || !info.VehicleCommandProtocolRequired {
+		t.Errorf("Unexpected vehicle info: %+v", status.VehicleInfo)
+	}
+
+	_, err = acct.FleetStatus(context.Background(), nil)
+	var httpErr *inet.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest || httpErr.Message != "invalid_request: vins required" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUserKeysAndRegion(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	keys, err := acct.UserKeys(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(keys) != 1 || keys[0].PublicKey != "04abcd" || keys[0].Name != "test" {
+		t.Errorf("Unexpected keys: %+v", keys)
+	}
+
+	region, err := acct.Region(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if region.Region != "eu" || region.Host() != "fleet-api.prd.eu.vn.cloud.tesla.com" {
+		t.Errorf("Unexpected region: %+v", region)
+	}
+}
+
+func TestGetReturnsHttpError(t *testing.T) {
+	server, acct := newFleetServer(t)
+	defer server.Close()
+
+	_, err := acct.Get(context.Background(), "api/1/unknown")
+	var httpErr *inet.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
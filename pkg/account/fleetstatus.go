@@ -0,0 +1,181 @@
+package account
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultFleetStatusTTL is the duration for which a FleetStatusCache reuses fleet status results
+// when no TTL is specified.
+const DefaultFleetStatusTTL = 5 * time.Minute
+
+// Route describes how commands should be sent to a vehicle.
+type Route int
+
+const (
+	// RouteUnknown indicates the fleet status endpoint didn't report on the vehicle.
+	RouteUnknown Route = iota
+	// RouteSigned indicates commands should use the vehicle command protocol.
+	RouteSigned
+	// RouteREST indicates the vehicle doesn't support the vehicle command protocol, so commands
+	// must use REST endpoints.
+	RouteREST
+	// RouteKeyNotPaired indicates the vehicle requires signed commands but the application's key
+	// isn't paired. Commands will fail until the key is added to the vehicle.
+	RouteKeyNotPaired
+)
+
+func (r Route) String() string {
+	switch r {
+	case RouteSigned:
+		return "signed"
+	case RouteREST:
+		return "REST"
+	case RouteKeyNotPaired:
+		return "key not paired"
+	}
+	return "unknown"
+}
+
+// VehicleStatus summarizes fleet status for a single vehicle.
+type VehicleStatus struct {
+	Route Route
+	// Info is nil if the server didn't provide vehicle details.
+	Info *FleetStatusInfo
+}
+
+// Vehicle returns the status of the vehicle with the provided vin.
+func (s *FleetStatus) Vehicle(vin string) *VehicleStatus {
+	status := VehicleStatus{Info: s.VehicleInfo[vin]}
+	if s.KeyPaired(vin) {
+		status.Route = RouteSigned
+		return &status
+	}
+	for _, unpaired := range s.UnpairedVINs {
+		if unpaired != vin {
+			continue
+		}
+		if status.Info != nil && status.Info.VehicleCommandProtocolRequired {
+			status.Route = RouteKeyNotPaired
+		} else {
+			status.Route = RouteREST
+		}
+		break
+	}
+	return &status
+}
+
+type fleetStatusKey struct {
+	clientID string
+	vin      string
+}
+
+type fleetStatusEntry struct {
+	status  *VehicleStatus
+	expires time.Time
+}
+
+// FleetStatusCache remembers fleet status results so that callers can decide how to send
+// commands to a vehicle without querying Fleet API each time. Key pairing depends on the
+// application, so results are cached separately for each OAuth client ID.
+//
+// A FleetStatusCache is safe for concurrent use.
+type FleetStatusCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[fleetStatusKey]fleetStatusEntry
+}
+
+// NewFleetStatusCache returns a cache that reuses results for ttl. If ttl is zero,
+// DefaultFleetStatusTTL is used.
+func NewFleetStatusCache(ttl time.Duration) *FleetStatusCache {
+	if ttl == 0 {
+		ttl = DefaultFleetStatusTTL
+	}
+	return &FleetStatusCache{
+		ttl:     ttl,
+		entries: make(map[fleetStatusKey]fleetStatusEntry),
+	}
+}
+
+func clientID(acct *Account) string {
+	if acct.tokenInfo == nil {
+		return ""
+	}
+	return acct.tokenInfo.ClientID
+}
+
+// Lookup returns the status of vins, fetching those that aren't cached in a single batch.
+// Vehicles the server doesn't report on are omitted from the result and aren't cached.
+//
+// Vehicles whose route is RouteKeyNotPaired are included in the result but aren't cached, since
+// the user may pair the key at any time and shouldn't have to wait for the entry to expire.
+func (c *FleetStatusCache) Lookup(ctx context.Context, acct *Account, vins ...string) (map[string]*VehicleStatus, error) {
+	results := make(map[string]*VehicleStatus)
+	var missing []string
+	now := time.Now()
+	id := clientID(acct)
+
+	c.lock.Lock()
+	for _, vin := range vins {
+		key := fleetStatusKey{clientID: id, vin: vin}
+		if entry, ok := c.entries[key]; ok {
+			if now.Before(entry.expires) {
+				results[vin] = entry.status
+				continue
+			}
+			delete(c.entries, key)
+		}
+		missing = append(missing, vin)
+	}
+	c.lock.Unlock()
+
+	if len(missing) == 0 {
+		return results, nil
+	}
+	fleetStatus, err := acct.FleetStatus(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires := time.Now().Add(c.ttl)
+	for _, vin := range missing {
+		status := fleetStatus.Vehicle(vin)
+		if status.Route == RouteUnknown {
+			continue
+		}
+		if status.Route != RouteKeyNotPaired {
+			c.entries[fleetStatusKey{clientID: id, vin: vin}] = fleetStatusEntry{status: status, expires: expires}
+		}
+		results[vin] = status
+	}
+	return results, nil
+}
+
+// Route returns the route to use for commands sent to vin, or RouteUnknown if the server didn't
+// report on the vehicle.
+func (c *FleetStatusCache) Route(ctx context.Context, acct *Account, vin string) (Route, error) {
+	results, err := c.Lookup(ctx, acct, vin)
+	if err != nil {
+		return RouteUnknown, err
+	}
+	if status, ok := results[vin]; ok {
+		return status.Route, nil
+	}
+	return RouteUnknown, nil
+}
+
+// Invalidate removes vin from the cache for all clients, for example after a key is added to the
+// vehicle.
+func (c *FleetStatusCache) Invalidate(vin string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.entries {
+		if key.vin == vin {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	pairedVIN   = "5YJ3E1EA1JF000001"
+	unpairedVIN = "5YJ3E1EA1JF000002"
+	legacyVIN   = "5YJSA1E11GF000003"
+	unknownVIN  = "5YJ3E1EA1JF000004"
+)
+
+type fleetStatusServer struct {
+	*httptest.Server
+	requests [][]string
+}
+
+func newFleetStatusServer(t *testing.T) *fleetStatusServer {
+	s := &fleetStatusServer{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			VINs []string `json:"vins"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		s.requests = append(s.requests, request.VINs)
+		status := FleetStatus{VehicleInfo: make(map[string]*FleetStatusInfo)}
+		for _, vin := range request.VINs {
+			switch vin {
+			case pairedVIN:
+				status.KeyPairedVINs = append(status.KeyPairedVINs, vin)
+				status.VehicleInfo[vin] = &FleetStatusInfo{VehicleCommandProtocolRequired: true}
+			case unpairedVIN:
+				status.UnpairedVINs = append(status.UnpairedVINs, vin)
+				status.VehicleInfo[vin] = &FleetStatusInfo{VehicleCommandProtocolRequired: true}
+			case legacyVIN:
+				status.UnpairedVINs = append(status.UnpairedVINs, vin)
+				status.VehicleInfo[vin] = &FleetStatusInfo{VehicleCommandProtocolRequired: false}
+			}
+		}
+		writeResponse(w, &status, nil)
+	}))
+	return s
+}
+
+func (s *fleetStatusServer) account(t *testing.T, clientID string) *Account {
+	acct, err := New(makeTestJWT(&oauthPayload{ClientID: clientID}), "", WithHTTPClient(s.Client()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	acct.Host = strings.TrimPrefix(s.URL, "https://")
+	return acct
+}
+
+func TestFleetStatusRoutes(t *testing.T) {
+	server := newFleetStatusServer(t)
+	defer server.Close()
+
+	cache := NewFleetStatusCache(0)
+	results, err := cache.Lookup(context.Background(), server.account(t, "client"), pairedVIN, unpairedVIN, legacyVIN, unknownVIN)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]Route{
+		pairedVIN:   RouteSigned,
+		unpairedVIN: RouteKeyNotPaired,
+		legacyVIN:   RouteREST,
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Unexpected results: %v", results)
+	}
+	for vin, route := range expected {
+		if status, ok := results[vin]; !ok || status.Route != route {
+			t.Errorf("Expected %s route for %s but got %+v", route, vin, status)
+		}
+	}
+	if len(server.requests) != 1 || len(server.requests[0]) != 4 {
+		t.Errorf("Expected single batched request but got %v", server.requests)
+	}
+}
+
+func TestFleetStatusCache(t *testing.T) {
+	server := newFleetStatusServer(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	cache := NewFleetStatusCache(time.Hour)
+	acct := server.account(t, "client")
+	if route, err := cache.Route(ctx, acct, pairedVIN); err != nil || route != RouteSigned {
+		t.Fatalf("Unexpected result: %s, %v", route, err)
+	}
+	// Only uncached VINs are fetched.
+	if _, err := cache.Lookup(ctx, acct, pairedVIN, legacyVIN); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(server.requests) != 2 || len(server.requests[1]) != 1 || server.requests[1][0] != legacyVIN {
+		t.Errorf("Unexpected requests: %v", server.requests)
+	}
+	// Unknown VINs aren't cached.
+	if route, err := cache.Route(ctx, acct, unknownVIN); err != nil || route != RouteUnknown {
+		t.Fatalf("Unexpected result: %s, %v", route, err)
+	}
+	cache.Route(ctx, acct, unknownVIN)
+	if len(server.requests) != 4 {
+		t.Errorf("Expected unknown VIN to be refetched: %v", server.requests)
+	}
+	// Results are cached separately for each client.
+	cache.Route(ctx, server.account(t, "other-client"), pairedVIN)
+	if len(server.requests) != 5 {
+		t.Errorf("Expected results to be cached per client: %v", server.requests)
+	}
+	cache.Invalidate(pairedVIN)
+	cache.Route(ctx, acct, pairedVIN)
+	if len(server.requests) != 6 {
+		t.Errorf("Expected invalidated VIN to be refetched: %v", server.requests)
+	}
+	// Vehicles whose key isn't paired are refetched, so that pairing takes effect immediately.
+	for i := 0; i < 2; i++ {
+		if route, err := cache.Route(ctx, acct, unpairedVIN); err != nil || route != RouteKeyNotPaired {
+			t.Fatalf("Unexpected result: %s, %v", route, err)
+		}
+	}
+	if len(server.requests) != 8 {
+		t.Errorf("Expected unpaired VIN to be refetched: %v", server.requests)
+	}
+}
+
+func TestFleetStatusCacheExpiry(t *testing.T) {
+	server := newFleetStatusServer(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	cache := NewFleetStatusCache(time.Millisecond)
+	acct := server.account(t, "client")
+	cache.Route(ctx, acct, pairedVIN)
+	time.Sleep(5 * time.Millisecond)
+	if route, err := cache.Route(ctx, acct, pairedVIN); err != nil || route != RouteSigned {
+		t.Fatalf("Unexpected result: %s, %v", route, err)
+	}
+	if len(server.requests) != 2 {
+		t.Errorf("Expected expired entry to be refetched: %v", server.requests)
+	}
+}
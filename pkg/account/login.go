@@ -0,0 +1,208 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+const (
+	// DefaultAuthorizeURL is the OAuth authorization endpoint used when LoginConfig.AuthorizeURL is
+	// empty.
+	DefaultAuthorizeURL = "https://auth.tesla.com/oauth2/v3/authorize"
+	// DefaultListenAddress is the address of the local OAuth callback listener used when
+	// LoginConfig.ListenAddress is empty. The port is chosen by the operating system, which
+	// authorization servers permit for loopback redirect URIs (RFC 8252, Section 7.3).
+	DefaultListenAddress = "localhost:0"
+
+	callbackPath = "/callback"
+)
+
+// DefaultScopes are requested when LoginConfig.Scopes is empty.
+var DefaultScopes = []string{"openid", "offline_access", "vehicle_device_data", "vehicle_cmds", "vehicle_charging_cmds"}
+
+// ErrLoginDenied indicates the authorization server or user rejected a login request.
+var ErrLoginDenied = errors.New("authorization request denied")
+
+// LoginConfig describes an OAuth authorization-code login.
+type LoginConfig struct {
+	ClientID string
+	// ClientSecret is optional; public clients rely on PKCE instead.
+	ClientSecret string
+	// AuthorizeURL and TokenURL default to DefaultAuthorizeURL and DefaultTokenURL.
+	AuthorizeURL string
+	TokenURL     string
+	// Scopes defaults to DefaultScopes.
+	Scopes []string
+	// ListenAddress is the address of the local callback listener. Defaults to
+	// DefaultListenAddress.
+	ListenAddress string
+	// RedirectURL must match a redirect URI registered for ClientID. Defaults to the callback
+	// listener's URL. Set this if the registered URI differs, for example because of port
+	// forwarding. The callback listener accepts requests for the path of RedirectURL.
+	RedirectURL string
+	// HTTPClient is used to contact TokenURL. Defaults to a client returned by inet.NewHTTPClient.
+	HTTPClient *http.Client
+}
+
+// randomString returns a URL-safe encoding of n random bytes.
+func randomString(n int) (string, error) {
+	buffer := make([]byte, n)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// pkceChallenge returns the S256 code challenge for verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+type callbackResult struct {
+	code string
+	err  error
+}
+
+// Login performs an OAuth authorization-code flow with PKCE. It starts a local callback listener
+// and invokes visit with the URL the user must open in a browser. After the user approves the
+// request, Login exchanges the authorization code for tokens. Login returns when ctx expires if
+// the user doesn't complete the flow.
+func Login(ctx context.Context, config LoginConfig, visit func(authorizeURL string) error) (*Token, error) {
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("OAuth client ID required")
+	}
+	if config.AuthorizeURL == "" {
+		config.AuthorizeURL = DefaultAuthorizeURL
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = DefaultTokenURL
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultScopes
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = DefaultListenAddress
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = inet.NewHTTPClient(nil)
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	// The callback listener serves the path of the redirect URL, since the authorization server
+	// sends the user's browser to it unchanged (port forwarding only affects the host and port).
+	path := callbackPath
+	if config.RedirectURL != "" {
+		redirect, err := url.Parse(config.RedirectURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect URL: %w", err)
+		}
+		if path = redirect.Path; path == "" {
+			path = "/"
+		}
+	}
+
+	listener, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start OAuth callback listener: %w", err)
+	}
+	redirectURL := config.RedirectURL
+	if redirectURL == "" {
+		redirectURL = "http://" + listener.Addr().String() + callbackPath
+	}
+
+	results := make(chan callbackResult, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		var result callbackResult
+		if query.Get("state") != state {
+			// Ignore requests that didn't originate from our authorization request.
+			http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			result.err = fmt.Errorf("%w: %s %s", ErrLoginDenied, e, query.Get("error_description"))
+			fmt.Fprintf(w, "Login failed: %s. You may close this window.\n", html.EscapeString(e))
+		} else if result.code = query.Get("code"); result.code == "" {
+			result.err = fmt.Errorf("authorization server did not provide a code")
+			fmt.Fprintf(w, "Login failed. You may close this window.\n")
+		} else {
+			fmt.Fprintf(w, "Login succeeded. You may close this window.\n")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authorize, err := url.Parse(config.AuthorizeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization URL: %w", err)
+	}
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", config.ClientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+
+	log.Debug("Waiting for OAuth callback on %s", redirectURL)
+	if err := visit(authorize.String()); err != nil {
+		return nil, err
+	}
+
+	var result callbackResult
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {config.ClientID},
+		"code":          {result.code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	token, err := requestToken(ctx, config.HTTPClient, config.TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	return token, nil
+}
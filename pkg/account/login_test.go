@@ -0,0 +1,154 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// authServer is a mock OAuth authorization server that approves (or denies) every request
+// without user interaction.
+type authServer struct {
+	*httptest.Server
+	t         *testing.T
+	deny      bool
+	challenge string
+	redirect  string
+}
+
+func newAuthServer(t *testing.T, deny bool) *authServer {
+	s := &authServer{t: t, deny: deny}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+			t.Errorf("Unexpected authorization request: %s", r.URL)
+		}
+		if query.Get("scope") != "openid offline_access" {
+			t.Errorf("Unexpected scope: %s", query.Get("scope"))
+		}
+		s.challenge = query.Get("code_challenge")
+		s.redirect = query.Get("redirect_uri")
+		callback := url.Values{"state": {query.Get("state")}}
+		if deny {
+			callback.Set("error", "access_denied")
+		} else {
+			callback.Set("code", "test-code")
+		}
+		http.Redirect(w, r, s.redirect+"?"+callback.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != "test-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		if pkceChallenge(r.Form.Get("code_verifier")) != s.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "PKCE verification failed"}`))
+			return
+		}
+		if r.Form.Get("redirect_uri") != s.redirect {
+			t.Errorf("Redirect URI mismatch")
+		}
+		fmt.Fprintf(w, `{"access_token": "access", "refresh_token": "refresh", "expires_in": 60}`)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *authServer) config() LoginConfig {
+	return LoginConfig{
+		ClientID:      testClientID,
+		AuthorizeURL:  s.URL + "/authorize",
+		TokenURL:      s.URL + "/token",
+		Scopes:        []string{"openid", "offline_access"},
+		ListenAddress: "127.0.0.1:0",
+	}
+}
+
+// browse simulates a user opening authorizeURL.
+func browse(authorizeURL string) error {
+	go func() {
+		rsp, err := http.Get(authorizeURL)
+		if err == nil {
+			io.Copy(io.Discard, rsp.Body)
+			rsp.Body.Close()
+		}
+	}()
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	server := newAuthServer(t, false)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token, err := Login(ctx, server.config(), browse)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Errorf("Unexpected token: %+v", token)
+	}
+	if time.Until(token.Expiry) > time.Minute || time.Until(token.Expiry) < 50*time.Second {
+		t.Errorf("Unexpected expiry: %s", token.Expiry)
+	}
+}
+
+func TestLoginRedirectPath(t *testing.T) {
+	server := newAuthServer(t, false)
+	defer server.Close()
+
+	// Find an unused port for the callback listener, so that the redirect URL can include it.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := server.config()
+	config.ListenAddress = address
+	config.RedirectURL = "http://" + address + "/oauth/done"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := Login(ctx, config, browse); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if server.redirect != config.RedirectURL {
+		t.Errorf("Expected redirect URI %s but got %s", config.RedirectURL, server.redirect)
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	server := newAuthServer(t, true)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := Login(ctx, server.config(), browse); !errors.Is(err, ErrLoginDenied) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	server := newAuthServer(t, false)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ignore := func(string) error { return nil }
+	if _, err := Login(ctx, server.config(), ignore); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,324 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+const (
+	// DefaultTokenURL is the OAuth token endpoint used when RefreshConfig.TokenURL is empty.
+	DefaultTokenURL = "https://auth.tesla.com/oauth2/v3/token"
+
+	defaultRefreshBefore = 5 * time.Minute
+	maxTokenResponseSize = 64 * 1024
+)
+
+var (
+	// ErrTokenExpired indicates the access token expired and can't be refreshed.
+	ErrTokenExpired = errors.New("OAuth token expired and no refresh token is available")
+	// ErrNoToken indicates a TokenStore does not contain a token.
+	ErrNoToken = errors.New("no OAuth token available")
+)
+
+// Token holds OAuth credentials.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// Expiry is the time at which AccessToken expires. If zero, the expiry is read from the
+	// access token's exp claim.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// expiry returns the time at which t.AccessToken expires, or the zero time if unknown.
+func (t *Token) expiry() time.Time {
+	if !t.Expiry.IsZero() {
+		return t.Expiry
+	}
+	if payload, err := parseToken(t.AccessToken); err == nil && payload.Expiry != 0 {
+		return time.Unix(payload.Expiry, 0)
+	}
+	return time.Time{}
+}
+
+// A TokenSource provides OAuth access tokens.
+type TokenSource interface {
+	// Token returns a valid access token, refreshing it if necessary.
+	Token(ctx context.Context) (string, error)
+	// Invalidate indicates that the server rejected accessToken. If accessToken is still the
+	// current token, the next call to Token refreshes it.
+	Invalidate(accessToken string)
+}
+
+// A TokenStore persists OAuth tokens, for example in the system keyring.
+type TokenStore interface {
+	// Load returns the stored token, or ErrNoToken.
+	Load() (*Token, error)
+	// Save replaces the stored token.
+	Save(token *Token) error
+}
+
+// RefreshConfig describes how to obtain new access tokens.
+type RefreshConfig struct {
+	// ClientID is the OAuth client ID of the application.
+	ClientID string
+	// ClientSecret is optional; public clients don't have one.
+	ClientSecret string
+	// TokenURL defaults to DefaultTokenURL.
+	TokenURL string
+	// RefreshBefore controls how long before expiration tokens are refreshed. Defaults to five
+	// minutes.
+	RefreshBefore time.Duration
+	// HTTPClient is used to contact TokenURL. Defaults to a client returned by inet.NewHTTPClient.
+	HTTPClient *http.Client
+}
+
+// RefreshingTokenSource is a TokenSource that uses a refresh token to obtain new access tokens
+// before they expire. Rotated refresh tokens are written to a TokenStore.
+type RefreshingTokenSource struct {
+	config RefreshConfig
+	store  TokenStore
+
+	lock        sync.Mutex
+	token       *Token
+	invalidated bool
+}
+
+// NewRefreshingTokenSource returns a TokenSource that loads its initial token from store.
+func NewRefreshingTokenSource(config RefreshConfig, store TokenStore) *RefreshingTokenSource {
+	if config.TokenURL == "" {
+		config.TokenURL = DefaultTokenURL
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = defaultRefreshBefore
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = inet.NewHTTPClient(nil)
+	}
+	return &RefreshingTokenSource{config: config, store: store}
+}
+
+func (s *RefreshingTokenSource) Token(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token == nil {
+		token, err := s.store.Load()
+		if err != nil {
+			return "", err
+		}
+		s.token = token
+	}
+
+	expiry := s.token.expiry()
+	haveAccessToken := s.token.AccessToken != "" && !s.invalidated
+	if haveAccessToken && (expiry.IsZero() || time.Until(expiry) > s.config.RefreshBefore) {
+		return s.token.AccessToken, nil
+	}
+	if s.token.RefreshToken == "" {
+		if s.token.AccessToken == "" {
+			return "", ErrNoToken
+		}
+		if haveAccessToken && time.Now().Before(expiry) {
+			// Use the token until it expires.
+			return s.token.AccessToken, nil
+		}
+		return "", ErrTokenExpired
+	}
+
+	token, err := s.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.invalidated = false
+	if err := s.store.Save(token); err != nil {
+		// The refresh token may have been rotated, in which case the old one no longer works.
+		log.Error("Failed to save refreshed OAuth token: %s", err)
+	}
+	return token.AccessToken, nil
+}
+
+func (s *RefreshingTokenSource) Invalidate(accessToken string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token != nil && s.token.AccessToken == accessToken {
+		s.invalidated = true
+	}
+}
+
+// tokenResponse is the body of a successful OAuth token endpoint response.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+// tokenErrorResponse is the body of an OAuth token endpoint error response.
+type tokenErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (s *RefreshingTokenSource) refresh(ctx context.Context) (*Token, error) {
+	log.Debug("Refreshing OAuth token")
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.config.ClientID},
+		"refresh_token": {s.token.RefreshToken},
+	}
+	if s.config.ClientSecret != "" {
+		form.Set("client_secret", s.config.ClientSecret)
+	}
+	token, err := requestToken(ctx, s.config.HTTPClient, s.config.TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh OAuth token: %w", err)
+	}
+	if token.RefreshToken == "" {
+		// The server didn't rotate the refresh token.
+		token.RefreshToken = s.token.RefreshToken
+	}
+	return token, nil
+}
+
+// requestToken POSTs form to an OAuth token endpoint.
+func requestToken(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (*Token, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxTokenResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var reply tokenErrorResponse
+		if json.Unmarshal(body, &reply) == nil && reply.Error != "" {
+			return nil, &inet.HttpError{Code: response.StatusCode, Message: fmt.Sprintf("%s: %s", reply.Error, reply.Description)}
+		}
+		return nil, &inet.HttpError{Code: response.StatusCode, Message: http.StatusText(response.StatusCode)}
+	}
+
+	var reply tokenResponse
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return nil, fmt.Errorf("invalid token endpoint response: %w", err)
+	}
+	if reply.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint response did not include an access token")
+	}
+	token := Token{AccessToken: reply.AccessToken, RefreshToken: reply.RefreshToken}
+	if reply.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second)
+	}
+	return &token, nil
+}
+
+// tokenTransport authorizes requests using a TokenSource.
+type tokenTransport struct {
+	source TokenSource
+	base   http.RoundTripper
+
+	lock sync.Mutex
+	// latest is the access token most recently obtained from source.
+	latest string
+}
+
+// token obtains an access token from source and records it as the current token.
+func (t *tokenTransport) token(ctx context.Context) (string, error) {
+	token, err := t.source.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.lock.Lock()
+	t.latest = token
+	t.lock.Unlock()
+	return token, nil
+}
+
+// current returns the access token most recently obtained from source.
+func (t *tokenTransport) current() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.latest
+}
+
+func (t *tokenTransport) authorize(req *http.Request, token string) *http.Request {
+	out := req.Clone(req.Context())
+	out.Header.Set("Authorization", "Bearer "+token)
+	return out
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	response, err := t.base.RoundTrip(t.authorize(req, token))
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The request can't be replayed.
+		return response, nil
+	}
+
+	t.source.Invalidate(token)
+	fresh, err := t.token(req.Context())
+	if err != nil || fresh == token {
+		return response, nil
+	}
+	retry := t.authorize(req, fresh)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return response, nil
+		}
+	}
+	response.Body.Close()
+	log.Debug("Retrying request with refreshed OAuth token")
+	return t.base.RoundTrip(retry)
+}
+
+// NewWithTokenSource is like New, but obtains access tokens from source. Requests sent by the
+// Account and by vehicle connections it creates always use the current access token, and are
+// retried once if the server responds with 401 Unauthorized.
+func NewWithTokenSource(ctx context.Context, source TokenSource, userAgent string, options ...Option) (*Account, error) {
+	token, err := source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := New(token, userAgent, options...)
+	if err != nil {
+		return nil, err
+	}
+	client := *acct.client
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	acct.tokens = &tokenTransport{source: source, base: base, latest: token}
+	client.Transport = acct.tokens
+	acct.client = &client
+	return acct, nil
+}
@@ -0,0 +1,227 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+const testClientID = "test-client"
+
+type memoryTokenStore struct {
+	lock  sync.Mutex
+	token *Token
+	saves int
+}
+
+func (m *memoryTokenStore) Load() (*Token, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.token == nil {
+		return nil, ErrNoToken
+	}
+	token := *m.token
+	return &token, nil
+}
+
+func (m *memoryTokenStore) Save(token *Token) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	saved := *token
+	m.token = &saved
+	m.saves++
+	return nil
+}
+
+func testAccessToken(n int, expiry time.Time) string {
+	return makeTestJWT(&oauthPayload{
+		Audiences: []string{"https://fleet-api.prd.na.vn.cloud.tesla.com", fmt.Sprintf("https://test/%d", n)},
+		Expiry:    expiry.Unix(),
+	})
+}
+
+// oauthServer is a stub OAuth token endpoint that rotates refresh tokens.
+type oauthServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	refreshes int
+	access    string
+	refresh   string
+}
+
+func newOAuthServer(t *testing.T, refresh string) *oauthServer {
+	s := &oauthServer{refresh: refresh}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Invalid form: %s", err)
+		}
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("client_id") != testClientID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_request"}`))
+			return
+		}
+		if r.Form.Get("refresh_token") != s.refresh {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "refresh token revoked"}`))
+			return
+		}
+		s.refreshes++
+		s.access = testAccessToken(s.refreshes, time.Now().Add(time.Hour))
+		s.refresh = fmt.Sprintf("refresh-%d", s.refreshes)
+		fmt.Fprintf(w, `{"access_token": "%s", "refresh_token": "%s", "expires_in": 3600, "token_type": "Bearer"}`, s.access, s.refresh)
+	}))
+	return s
+}
+
+func (s *oauthServer) currentAccessToken() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.access
+}
+
+func newTestTokenSource(server *oauthServer, store TokenStore) *RefreshingTokenSource {
+	return NewRefreshingTokenSource(RefreshConfig{
+		ClientID:   testClientID,
+		TokenURL:   server.URL,
+		HTTPClient: server.Client(),
+	}, store)
+}
+
+func TestTokenNotRefreshedWhenFresh(t *testing.T) {
+	server := newOAuthServer(t, "refresh-0")
+	defer server.Close()
+	access := testAccessToken(0, time.Now().Add(time.Hour))
+	store := &memoryTokenStore{token: &Token{AccessToken: access, RefreshToken: "refresh-0"}}
+
+	token, err := newTestTokenSource(server, store).Token(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if token != access || server.refreshes != 0 {
+		t.Errorf("Token refreshed unnecessarily")
+	}
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	server := newOAuthServer(t, "refresh-0")
+	defer server.Close()
+	// Expiry is read from the JWT, and falls within the default refresh window.
+	store := &memoryTokenStore{token: &Token{
+		AccessToken:  testAccessToken(0, time.Now().Add(time.Minute)),
+		RefreshToken: "refresh-0",
+	}}
+
+	source := newTestTokenSource(server, store)
+	token, err := source.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if token != server.currentAccessToken() {
+		t.Errorf("Token wasn't refreshed")
+	}
+	if store.token.RefreshToken != "refresh-1" || store.token.AccessToken != token {
+		t.Errorf("Rotated token wasn't persisted: %+v", store.token)
+	}
+
+	// The rotated refresh token must be used next time.
+	source.Invalidate(token)
+	if _, err := source.Token(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if store.token.RefreshToken != "refresh-2" {
+		t.Errorf("Rotated token wasn't persisted: %+v", store.token)
+	}
+}
+
+func TestTokenRefreshFailure(t *testing.T) {
+	server := newOAuthServer(t, "refresh-0")
+	defer server.Close()
+	store := &memoryTokenStore{token: &Token{AccessToken: testAccessToken(0, time.Now()), RefreshToken: "revoked"}}
+
+	_, err := newTestTokenSource(server, store).Token(context.Background())
+	var httpErr *inet.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest || !strings.Contains(httpErr.Message, "invalid_grant") {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if store.saves != 0 {
+		t.Errorf("Token store updated after failure")
+	}
+}
+
+func TestTokenExpiredWithoutRefreshToken(t *testing.T) {
+	server := newOAuthServer(t, "refresh-0")
+	defer server.Close()
+	store := &memoryTokenStore{token: &Token{AccessToken: testAccessToken(0, time.Now().Add(-time.Minute))}}
+	if _, err := newTestTokenSource(server, store).Token(context.Background()); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	store = &memoryTokenStore{}
+	if _, err := newTestTokenSource(server, store).Token(context.Background()); !errors.Is(err, ErrNoToken) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestAccountRetriesUnauthorized(t *testing.T) {
+	oauth := newOAuthServer(t, "refresh-0")
+	defer oauth.Close()
+
+	var bodies []string
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make([]byte, 100)
+		n, _ := r.Body.Read(body)
+		bodies = append(bodies, string(body[:n]))
+		// Reject any token not issued by the OAuth server.
+		if r.Header.Get("Authorization") != "Bearer "+oauth.currentAccessToken() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"response": {"state": "online"}}`))
+	}))
+	defer api.Close()
+
+	// The stored token hasn't expired, but the server has revoked it.
+	store := &memoryTokenStore{token: &Token{
+		AccessToken:  testAccessToken(0, time.Now().Add(time.Hour)),
+		RefreshToken: "refresh-0",
+	}}
+	acct, err := NewWithTokenSource(context.Background(), newTestTokenSource(oauth, store), "", WithHTTPClient(api.Client()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	acct.Host = strings.TrimPrefix(api.URL, "https://")
+	if audiences := acct.TokenInfo().Audiences; len(audiences) != 2 || audiences[1] != "https://test/0" {
+		t.Errorf("Expected TokenInfo to describe the stored token, but got audiences %v", audiences)
+	}
+
+	if _, err := acct.Connection("5YJ3E1EA1JF000000").SendFleetAPICommand(context.Background(), "api/1/vehicles/5YJ3E1EA1JF000000/command/honk_horn", []byte("{}")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if oauth.refreshes != 1 {
+		t.Errorf("Expected one refresh but got %d", oauth.refreshes)
+	}
+	if len(bodies) != 2 || bodies[1] != "{}" {
+		t.Errorf("Request body not replayed: %q", bodies)
+	}
+
+	// Subsequent requests use the refreshed token.
+	if _, err := acct.Get(context.Background(), "api/1/vehicles"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if oauth.refreshes != 1 || len(bodies) != 3 {
+		t.Errorf("Unexpected retry")
+	}
+	if audiences := acct.TokenInfo().Audiences; len(audiences) != 2 || audiences[1] != "https://test/1" {
+		t.Errorf("Expected TokenInfo to describe the refreshed token, but got audiences %v", audiences)
+	}
+}
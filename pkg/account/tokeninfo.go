@@ -0,0 +1,83 @@
+package account
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// OAuth scopes used by vehicle commands.
+const (
+	ScopeVehicleDeviceData = "vehicle_device_data"
+	ScopeVehicleCommands   = "vehicle_cmds"
+	ScopeChargingCommands  = "vehicle_charging_cmds"
+)
+
+// scopeList decodes the scp claim, which may be a JSON array or a space-separated string.
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var joined string
+	if err := json.Unmarshal(data, &joined); err != nil {
+		return err
+	}
+	*s = strings.Fields(joined)
+	return nil
+}
+
+// TokenInfo describes the claims of an OAuth access token. The token's signature is not verified,
+// so TokenInfo is only suitable for diagnostics and early detection of errors that the server
+// would report anyway.
+type TokenInfo struct {
+	// Expiry is the zero time if the token doesn't specify an expiration time.
+	Expiry time.Time
+	Scopes []string
+	// ClientID identifies the application the token was issued to.
+	ClientID  string
+	Region    string
+	Audiences []string
+}
+
+// ParseTokenInfo extracts claims from an OAuth access token.
+func ParseTokenInfo(oauthToken string) (*TokenInfo, error) {
+	payload, err := parseToken(oauthToken)
+	if err != nil {
+		return nil, err
+	}
+	return payload.info(), nil
+}
+
+func (p *oauthPayload) info() *TokenInfo {
+	info := TokenInfo{
+		Scopes:    p.Scopes,
+		ClientID:  p.ClientID,
+		Region:    p.OUCode,
+		Audiences: p.Audiences,
+	}
+	if p.Expiry != 0 {
+		info.Expiry = time.Unix(p.Expiry, 0)
+	}
+	return &info
+}
+
+// Expired returns true if the token has an expiration time in the past.
+func (t *TokenInfo) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().After(t.Expiry)
+}
+
+// HasAnyScope returns true if the token grants at least one of scopes.
+func (t *TokenInfo) HasAnyScope(scopes ...string) bool {
+	for _, want := range scopes {
+		for _, have := range t.Scopes {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
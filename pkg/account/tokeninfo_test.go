@@ -0,0 +1,59 @@
+package account
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseTokenInfo(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	payload := &oauthPayload{
+		Audiences: []string{"https://fleet-api.prd.eu.vn.cloud.tesla.com"},
+		OUCode:    "EU",
+		Expiry:    expiry.Unix(),
+		Scopes:    []string{"openid", ScopeVehicleDeviceData},
+		ClientID:  "my-client",
+	}
+	acct, err := New(makeTestJWT(payload), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	info := acct.TokenInfo()
+	if !info.Expiry.Equal(expiry) || info.Expired() {
+		t.Errorf("Unexpected expiry %s", info.Expiry)
+	}
+	if info.ClientID != "my-client" || info.Region != "EU" || len(info.Audiences) != 1 {
+		t.Errorf("Unexpected token info: %+v", info)
+	}
+	if !info.HasAnyScope(ScopeVehicleCommands, ScopeVehicleDeviceData) {
+		t.Error("Expected token to have vehicle_device_data scope")
+	}
+	if info.HasAnyScope(ScopeVehicleCommands, ScopeChargingCommands) {
+		t.Error("Token shouldn't have command scopes")
+	}
+}
+
+func TestParseTokenInfoScopeString(t *testing.T) {
+	token := "x." + b64Encode(fmt.Sprintf(`{"scp": "openid %s", "exp": 1}`, ScopeVehicleCommands)) + ".y"
+	info, err := ParseTokenInfo(token)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(info.Scopes) != 2 || !info.HasAnyScope(ScopeVehicleCommands) {
+		t.Errorf("Unexpected scopes: %v", info.Scopes)
+	}
+	if !info.Expired() {
+		t.Error("Expected token to be expired")
+	}
+}
+
+func TestParseTokenInfoNoExpiry(t *testing.T) {
+	info, err := ParseTokenInfo("x." + b64Encode(`{}`) + ".y")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !info.Expiry.IsZero() || info.Expired() {
+		t.Errorf("Unexpected expiry %s", info.Expiry)
+	}
+}
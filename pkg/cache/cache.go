@@ -1,19 +1,62 @@
 package cache
 
 import (
+	"container/list"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/greenmission/vehicle-command/internal/dispatcher"
 )
 
+// formatVersion is the version of the serialization format written by [SessionCache.Export].
+// Version 1 files, which predate the version field, are migrated when imported. Version 2 files
+// didn't record which client key each entry belongs to; see [SessionCache.GetSessions].
+const formatVersion = 3
+
+// ErrUnsupportedVersion indicates that serialized SessionCache was written by a newer version of
+// this package.
+var ErrUnsupportedVersion = errors.New("session cache: unsupported file format version")
+
 type SessionCache struct {
+	// MaxEntries is the maximum number of vehicles for which the cache holds sessions. Zero means
+	// unbounded.
 	MaxEntries int
-	Vehicles   map[string][]dispatcher.CacheEntry `json:"vehicles"`
-	lock       sync.Mutex
+	// TTL is the duration after which sessions that haven't been used are discarded. Zero means
+	// sessions don't expire. Vehicles periodically rotate their session epochs, so very old
+	// sessions are unlikely to be valid.
+	TTL time.Duration
+	// Cipher, if not nil, is used to encrypt and authenticate exported data.
+	Cipher *Cipher
+	// Vehicles holds the sessions that the cache contained when it was imported, indexed by VIN.
+	//
+	// Deprecated: Vehicles is populated for compatibility with earlier versions of this package,
+	// but it isn't updated as sessions change, and changes to it have no effect. Use
+	// [SessionCache.GetSessions].
+	Vehicles map[string][]dispatcher.CacheEntry `json:"vehicles"`
+
+	lock sync.Mutex
+	// lru holds *vehicleEntry values ordered from most to least recently used.
+	lru     list.List
+	entries map[Key]*list.Element
+}
+
+type vehicleEntry struct {
+	VIN string `json:"vin"`
+	// Fingerprint is empty for entries written by the deprecated Update method.
+	Fingerprint string                  `json:"key_fingerprint,omitempty"`
+	LastUsed    time.Time               `json:"last_used"`
+	Sessions    []dispatcher.CacheEntry `json:"sessions"`
+}
+
+func (e *vehicleEntry) key() Key {
+	return Key{VIN: e.VIN, Fingerprint: e.Fingerprint}
 }
 
 // New returns a SessionCache with that holds session state for up to maxEntries vehicles.
@@ -26,88 +69,393 @@ func New(maxEntries int) *SessionCache {
 	return &SessionCache{
 		MaxEntries: maxEntries,
 		Vehicles:   make(map[string][]dispatcher.CacheEntry),
+		entries:    make(map[Key]*list.Element),
+	}
+}
+
+// fileHeader contains the fields common to all serialization formats.
+type fileHeader struct {
+	Version    int    `json:"version"`
+	Encryption string `json:"encryption"`
+}
+
+// fileV1 is the format written before versioning was introduced.
+type fileV1 struct {
+	MaxEntries int
+	Vehicles   map[string][]dispatcher.CacheEntry `json:"vehicles"`
+}
+
+type fileFormat struct {
+	Version    int             `json:"version"`
+	MaxEntries int             `json:"max_entries,omitempty"`
+	TTL        time.Duration   `json:"ttl,omitempty"`
+	Vehicles   []*vehicleEntry `json:"vehicles"`
+}
+
+// migrateV1 converts a version 1 file. Version 1 files didn't record when sessions were last used,
+// so the creation time of each vehicle's most recent session is used instead.
+func migrateV1(data []byte) (*fileFormat, error) {
+	var old fileV1
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+	migrated := fileFormat{Version: formatVersion, MaxEntries: old.MaxEntries}
+	for vin, sessions := range old.Vehicles {
+		entry := vehicleEntry{VIN: vin, Sessions: sessions}
+		for _, session := range sessions {
+			if session.CreatedAt.After(entry.LastUsed) {
+				entry.LastUsed = session.CreatedAt
+			}
+		}
+		migrated.Vehicles = append(migrated.Vehicles, &entry)
+	}
+	return &migrated, nil
+}
+
+// decode parses serialized data, decrypting it with cipher. If cipher is nil, the data must not be
+// encrypted, and if cipher is not nil, the data must be encrypted.
+func decode(data []byte, cipher *Cipher) (*fileFormat, error) {
+	var header fileHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.Version > formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.Version)
+	}
+	if header.Encryption != "" {
+		if cipher == nil {
+			return nil, ErrEncrypted
+		}
+		plaintext, err := cipher.open(data)
+		if err != nil {
+			return nil, err
+		}
+		return decode(plaintext, nil)
+	}
+	if cipher != nil {
+		return nil, ErrNotEncrypted
+	}
+	switch header.Version {
+	case 0:
+		return migrateV1(data)
+	case 2, formatVersion:
+		// Version 3 added the optional key_fingerprint field.
+		var file fileFormat
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		return &file, nil
 	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.Version)
 }
 
 // Import a SessionCache using data in r.
-// The data should previously have been generated using [SessionCache.Export].
+// The data should previously have been generated using [SessionCache.Export]. Data written by
+// older versions of this package is migrated automatically. Returns ErrEncrypted if the data is
+// encrypted; use [ImportEncrypted] instead.
 func Import(r io.Reader) (*SessionCache, error) {
-	var cache SessionCache
-	decoder := json.NewDecoder(r)
-	if err := decoder.Decode(&cache); err != nil {
+	return ImportEncrypted(r, nil)
+}
+
+// ImportEncrypted reads a SessionCache that was exported with its Cipher set to cipher. Returns
+// ErrDecryptionFailed if the data was modified or was encrypted using a different key, and
+// ErrNotEncrypted if the data isn't encrypted. The returned SessionCache uses cipher when it's
+// exported.
+//
+// If cipher is nil, ImportEncrypted behaves like Import.
+func ImportEncrypted(r io.Reader, cipher *Cipher) (*SessionCache, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	file, err := decode(data, cipher)
+	if err != nil {
 		return nil, err
 	}
-	return &cache, nil
+	cache := New(file.MaxEntries)
+	cache.TTL = file.TTL
+	cache.Cipher = cipher
+	cache.load(file.Vehicles)
+	cache.Vehicles = cache.vehicleSessions()
+	return cache, nil
 }
 
 // ImportFromFile reads a SessionCache from disk.
 func ImportFromFile(filename string) (*SessionCache, error) {
+	return ImportEncryptedFromFile(filename, nil)
+}
+
+// ImportEncryptedFromFile reads an encrypted SessionCache from disk. See [ImportEncrypted].
+func ImportEncryptedFromFile(filename string, cipher *Cipher) (*SessionCache, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	return Import(file)
+	return ImportEncrypted(file, cipher)
 }
 
-// Export writes a serialized SessionCache to w.
+// load replaces the contents of c with vehicles. The caller must hold c.lock, unless c isn't
+// shared yet.
+func (c *SessionCache) load(vehicles []*vehicleEntry) {
+	sort.SliceStable(vehicles, func(i, j int) bool {
+		return vehicles[i].LastUsed.After(vehicles[j].LastUsed)
+	})
+	c.lru.Init()
+	c.entries = make(map[Key]*list.Element)
+	for _, entry := range vehicles {
+		if _, ok := c.entries[entry.key()]; ok {
+			continue
+		}
+		c.entries[entry.key()] = c.lru.PushBack(entry)
+	}
+	c.prune(time.Now())
+}
+
+// prune removes expired entries and evicts least recently used entries in excess of MaxEntries.
+// The caller must hold c.lock.
+func (c *SessionCache) prune(now time.Time) {
+	for back := c.lru.Back(); back != nil; back = c.lru.Back() {
+		entry := back.Value.(*vehicleEntry)
+		expired := c.TTL > 0 && now.Sub(entry.LastUsed) > c.TTL
+		full := c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries
+		if !expired && !full {
+			return
+		}
+		c.lru.Remove(back)
+		delete(c.entries, entry.key())
+	}
+}
+
+// Export writes a serialized SessionCache to w. If c.Cipher is set, the data is encrypted.
 func (c *SessionCache) Export(w io.Writer) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	return json.NewEncoder(w).Encode(c)
+	data, err := c.encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
-// ExportToFile writes a SessionCache to disk.
-func (c *SessionCache) ExportToFile(filename string) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+// encode serializes c, encrypting the result if c.Cipher is set. The caller must hold c.lock.
+func (c *SessionCache) encode() ([]byte, error) {
+	data, err := json.Marshal(c.snapshot())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	if c.Cipher != nil {
+		if data, err = c.Cipher.seal(data); err != nil {
+			return nil, err
+		}
+	}
+	return append(data, '\n'), nil
+}
 
-	return c.Export(file)
+// snapshot returns the serializable contents of c. The caller must hold c.lock.
+func (c *SessionCache) snapshot() *fileFormat {
+	c.prune(time.Now())
+	file := fileFormat{
+		Version:    formatVersion,
+		MaxEntries: c.MaxEntries,
+		TTL:        c.TTL,
+		Vehicles:   make([]*vehicleEntry, 0, c.lru.Len()),
+	}
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		file.Vehicles = append(file.Vehicles, element.Value.(*vehicleEntry))
+	}
+	return &file
 }
 
-// Update the SessionCache's entry for a vin with current state.
-// It's recommended that clients use the vehicle.UpdateCachedSessions method instead in order to
-// avoid accessing the internal dispatcher package.
-func (c *SessionCache) Update(vin string, sessions []dispatcher.CacheEntry) error {
+// ExportToFile writes a SessionCache to disk. The file is only readable by its owner.
+//
+// The file is replaced atomically while holding a lock, so concurrent processes that share a cache
+// file never observe a partially written cache. If another process updated the file since c was
+// imported, its more recently used entries are merged into c before writing.
+//
+// ExportToFile won't overwrite a file that it can't read because it was written by a newer version
+// of this package or encrypted with a different Cipher. An unencrypted file is overwritten without
+// being merged if c.Cipher is set, since its contents aren't authenticated.
+func (c *SessionCache) ExportToFile(filename string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	c.Vehicles[vin] = sessions
-	if c.MaxEntries > 0 && len(c.Vehicles) > c.MaxEntries {
-		// TODO: Replace with a proper cache
-		oldestVIN := vin
-		oldestCreationTime := time.Now()
-		for v, sessions := range c.Vehicles {
-			// Each vehicle has multiple sessions associated with it, one for each domain. The age
-			// of cache entry is the age of its most recent session.
-			mostRecent := time.Time{}
-			for _, entry := range sessions {
-				if entry.CreatedAt.After(mostRecent) {
-					mostRecent = entry.CreatedAt
-				}
+	return withFileLock(filename+".lock", func() error {
+		// c isn't modified until the file has been written, so that a failed write doesn't leave
+		// c with entries that were never persisted.
+		var combined []*vehicleEntry
+		merged := c
+		data, err := os.ReadFile(filename)
+		if err == nil {
+			file, err := decode(data, c.Cipher)
+			if errors.Is(err, ErrUnsupportedVersion) || errors.Is(err, ErrEncrypted) || errors.Is(err, ErrDecryptionFailed) {
+				return err
 			}
-			if mostRecent.Before(oldestCreationTime) {
-				oldestVIN = v
-				oldestCreationTime = mostRecent
+			// A corrupt file is overwritten rather than merged.
+			if err == nil {
+				combined = c.combine(file.Vehicles)
+				merged = &SessionCache{MaxEntries: c.MaxEntries, TTL: c.TTL, Cipher: c.Cipher}
+				merged.load(combined)
 			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		encoded, err := merged.encode()
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filename, encoded, 0600); err != nil {
+			return err
+		}
+		if combined != nil {
+			c.load(combined)
 		}
-		delete(c.Vehicles, oldestVIN)
+		return nil
+	})
+}
+
+// combine returns the entries in c and vehicles, keeping whichever copy of each entry was used
+// most recently. The caller must hold c.lock.
+func (c *SessionCache) combine(vehicles []*vehicleEntry) []*vehicleEntry {
+	merged := make(map[Key]*vehicleEntry, c.lru.Len()+len(vehicles))
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*vehicleEntry)
+		merged[entry.key()] = entry
+	}
+	for _, entry := range vehicles {
+		if current, ok := merged[entry.key()]; !ok || entry.LastUsed.After(current.LastUsed) {
+			merged[entry.key()] = entry
+		}
+	}
+	combined := make([]*vehicleEntry, 0, len(merged))
+	for _, entry := range merged {
+		combined = append(combined, entry)
+	}
+	return combined
+}
+
+// UpdateSessions records the current state of the sessions that the client identified by
+// key.Fingerprint has with key.VIN, and marks the entry as the most recently used. Sessions for
+// domains that aren't included in sessions are left unchanged.
+//
+// It's recommended that clients use the vehicle.UpdateCachedSessions method instead in order to
+// avoid accessing the internal dispatcher package.
+func (c *SessionCache) UpdateSessions(key Key, sessions []dispatcher.CacheEntry) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*vehicleEntry)
+		entry.Sessions = replaceSessions(entry.Sessions, sessions)
+		entry.LastUsed = now
+		c.lru.MoveToFront(element)
+	} else {
+		entry := vehicleEntry{VIN: key.VIN, Fingerprint: key.Fingerprint, LastUsed: now, Sessions: sessions}
+		c.entries[key] = c.lru.PushFront(&entry)
 	}
+	c.prune(now)
 	return nil
 }
 
-// GetEntry returns the sessions associated with vin.
-// This method intended for use by the internal dispatcher package; other clients should have no
-// use for it.
+// replaceSessions returns stored with the sessions for each domain in updated replaced.
+func replaceSessions(stored, updated []dispatcher.CacheEntry) []dispatcher.CacheEntry {
+	result := make([]dispatcher.CacheEntry, 0, len(stored)+len(updated))
+	for _, entry := range stored {
+		replaced := false
+		for _, update := range updated {
+			if update.Domain == entry.Domain {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			result = append(result, entry)
+		}
+	}
+	return append(result, updated...)
+}
+
+// GetSessions returns the sessions that the client identified by key.Fingerprint has with
+// key.VIN. Sessions belonging to other client keys are never returned, since they can't be used
+// to authorize commands.
+//
+// Entries that aren't associated with a client key, because they were written by the deprecated
+// Update method or migrated from a file written by an earlier version of this package, are adopted
+// by the first client key that looks up their VIN. This preserves sessions across upgrades, since
+// such files almost always contain sessions for a single client key. An adopted entry is no longer
+// returned by [SessionCache.GetEntry].
+// This method intended for use by the vehicle package; other clients should have no use for it.
+func (c *SessionCache) GetSessions(key Key) ([]dispatcher.CacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.prune(time.Now())
+	element, ok := c.entries[key]
+	if !ok && key.Fingerprint != "" {
+		element, ok = c.adopt(key)
+	}
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*vehicleEntry).Sessions, true
+}
+
+// adopt associates key.VIN's entry that doesn't have a client key with key. The caller must hold
+// c.lock.
+func (c *SessionCache) adopt(key Key) (*list.Element, bool) {
+	legacy := Key{VIN: key.VIN}
+	element, ok := c.entries[legacy]
+	if !ok {
+		return nil, false
+	}
+	delete(c.entries, legacy)
+	element.Value.(*vehicleEntry).Fingerprint = key.Fingerprint
+	c.entries[key] = element
+	return element, true
+}
+
+// Update the SessionCache's entry for a vin with current state.
+//
+// Deprecated: Use [SessionCache.UpdateSessions], which keeps sessions belonging to different
+// client keys separate. Entries written by Update aren't associated with a client key until
+// they're adopted by [SessionCache.GetSessions].
+func (c *SessionCache) Update(vin string, sessions []dispatcher.CacheEntry) error {
+	return c.UpdateSessions(Key{VIN: vin}, sessions)
+}
+
+// GetEntry returns the sessions associated with vin that were stored using the deprecated Update
+// method, or by versions of this package that didn't record client keys.
+//
+// Deprecated: Use [SessionCache.GetSessions].
 func (c *SessionCache) GetEntry(vin string) ([]dispatcher.CacheEntry, bool) {
+	return c.GetSessions(Key{VIN: vin})
+}
+
+// VehicleSessions returns a copy of the sessions held by c, indexed by VIN. If c holds sessions
+// that several client keys have with the same vehicle, only the most recently used are included.
+//
+// Deprecated: This replaces the Vehicles field, which isn't kept up to date. Use
+// [SessionCache.GetSessions].
+func (c *SessionCache) VehicleSessions() map[string][]dispatcher.CacheEntry {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	return c.vehicleSessions()
+}
 
-	session, ok := c.Vehicles[vin]
-	return session, ok
+// vehicleSessions implements VehicleSessions. The caller must hold c.lock, unless c isn't shared
+// yet.
+func (c *SessionCache) vehicleSessions() map[string][]dispatcher.CacheEntry {
+	c.prune(time.Now())
+	vehicles := make(map[string][]dispatcher.CacheEntry, c.lru.Len())
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*vehicleEntry)
+		if _, ok := vehicles[entry.VIN]; !ok {
+			vehicles[entry.VIN] = append([]dispatcher.CacheEntry(nil), entry.Sessions...)
+		}
+	}
+	return vehicles
 }
@@ -2,7 +2,11 @@ package cache
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,7 +27,7 @@ func generateTestCache(t *testing.T, vinCount int) *SessionCache {
 	t.Helper()
 	c := New(0)
 	for i := 0; i < vinCount; i++ {
-		c.Vehicles[strconv.Itoa(i)] = generateTestSessions(i)
+		c.Update(strconv.Itoa(i), generateTestSessions(i))
 	}
 	return c
 }
@@ -33,7 +37,7 @@ func verifyCache(t *testing.T, c *SessionCache, entries []int) {
 	found := make(map[string]bool)
 	for _, i := range entries {
 		vin := strconv.Itoa(i)
-		if sessions, ok := c.Vehicles[vin]; ok {
+		if sessions, ok := c.GetEntry(vin); ok {
 			if len(sessions) != 3 {
 				t.Errorf("cache %d did not contain %d sessions", i, testSessionCount)
 				return
@@ -53,9 +57,9 @@ func verifyCache(t *testing.T, c *SessionCache, entries []int) {
 		}
 		found[vin] = true
 	}
-	for vin := range c.Vehicles {
-		if _, ok := found[vin]; !ok {
-			t.Errorf("session cache contained extraneous entry %s", vin)
+	for key := range c.entries {
+		if _, ok := found[key.VIN]; !ok {
+			t.Errorf("session cache contained extraneous entry %s", key.VIN)
 		}
 	}
 }
@@ -76,8 +80,8 @@ func TestImportExport(t *testing.T) {
 func TestEviction(t *testing.T) {
 	c := generateTestCache(t, 0)
 	c.MaxEntries = 5
-	// Note that generateTestSessions(n) adds an entry with timestamp n, and entries are evicted
-	// based on timestamp, not the order in which they were added to the cache.
+	// Entries are evicted based on when they were last updated, not when their sessions were
+	// created.
 	c.Update("7", generateTestSessions(7))
 	c.Update("4", generateTestSessions(4))
 	c.Update("5", generateTestSessions(5))
@@ -86,14 +90,202 @@ func TestEviction(t *testing.T) {
 	verifyCache(t, c, []int{3, 4, 5, 6, 7})
 
 	// Duplicate key updated in place
-	c.Update("5", generateTestSessions(5))
+	c.Update("7", generateTestSessions(7))
 	verifyCache(t, c, []int{3, 4, 5, 6, 7})
 
-	// Evicts oldest entry
+	// Evicts least recently used entry
 	c.Update("8", generateTestSessions(8))
-	verifyCache(t, c, []int{4, 5, 6, 7, 8})
+	verifyCache(t, c, []int{3, 5, 6, 7, 8})
 
-	// Older entry doesn't evict newer entry
+	// Entry with older sessions evicts entry that hasn't been used recently
 	c.Update("1", generateTestSessions(1))
-	verifyCache(t, c, []int{4, 5, 6, 7, 8})
+	verifyCache(t, c, []int{1, 3, 6, 7, 8})
+
+	// Loading an entry doesn't count as using it
+	c.GetEntry("3")
+	c.Update("2", generateTestSessions(2))
+	verifyCache(t, c, []int{1, 2, 6, 7, 8})
+}
+
+func TestExpiry(t *testing.T) {
+	c := generateTestCache(t, 3)
+	c.TTL = time.Hour
+	element := c.entries[Key{VIN: "1"}]
+	element.Value.(*vehicleEntry).LastUsed = time.Now().Add(-2 * time.Hour)
+	c.lru.MoveToBack(element)
+	if _, ok := c.GetEntry("1"); ok {
+		t.Errorf("Expired entry was returned")
+	}
+	verifyCache(t, c, []int{0, 2})
+}
+
+func TestImportVersion1(t *testing.T) {
+	legacy := `{"MaxEntries":2,"vehicles":{` +
+		`"1":[{"created_at":"2023-01-01T00:00:00Z","domain":1,"data":"AA=="}],` +
+		`"2":[{"created_at":"2023-01-02T00:00:00Z","domain":2,"data":"AQ=="}]}}`
+	c, err := Import(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.MaxEntries != 2 {
+		t.Errorf("MaxEntries not migrated")
+	}
+	sessions, ok := c.GetEntry("2")
+	if !ok || len(sessions) != 1 || sessions[0].Domain != 2 {
+		t.Fatalf("Sessions not migrated: %+v", sessions)
+	}
+	// The vehicle whose sessions are oldest is least recently used.
+	c.Update("3", generateTestSessions(3))
+	if _, ok := c.GetEntry("1"); ok {
+		t.Errorf("Migrated entry evicted in wrong order")
+	}
+}
+
+func TestImportUnsupportedVersion(t *testing.T) {
+	if _, err := Import(strings.NewReader(`{"version":1000}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion but got %v", err)
+	}
+}
+
+func TestExportToFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	c := generateTestCache(t, 5)
+	if err := c.ExportToFile(filename); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// A second process exports a smaller cache containing a more recently used entry.
+	other := New(0)
+	other.Update("9", generateTestSessions(9))
+	if err := other.ExportToFile(filename); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyCache(t, other, []int{0, 1, 2, 3, 4, 9})
+
+	imported, err := ImportFromFile(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyCache(t, imported, []int{0, 1, 2, 3, 4, 9})
+
+	// Overwriting with a shorter cache doesn't leave trailing garbage.
+	if err := os.WriteFile(filename, bytes.Repeat([]byte(" "), 1<<16), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := New(0).ExportToFile(filename); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := ImportFromFile(filename); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSessionsKeyedByFingerprint(t *testing.T) {
+	c := New(0)
+	alice := Key{VIN: "1", Fingerprint: Fingerprint([]byte("alice"))}
+	bob := Key{VIN: "1", Fingerprint: Fingerprint([]byte("bob"))}
+	c.UpdateSessions(alice, generateTestSessions(1))
+	if _, ok := c.GetSessions(bob); ok {
+		t.Errorf("Returned sessions belonging to a different key")
+	}
+	if _, ok := c.GetEntry("1"); ok {
+		t.Errorf("Returned keyed sessions from deprecated GetEntry")
+	}
+	c.UpdateSessions(bob, generateTestSessions(2))
+	if sessions, ok := c.GetSessions(alice); !ok || sessions[0].Domain != 1 {
+		t.Errorf("Sessions for one key were overwritten by another")
+	}
+}
+
+func TestGetSessionsAdoptsMigratedEntries(t *testing.T) {
+	legacy := `{"vehicles":{"1":[{"created_at":"2023-01-01T00:00:00Z","domain":1,"data":"AA=="}]}}`
+	c, err := Import(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	alice := Key{VIN: "1", Fingerprint: Fingerprint([]byte("alice"))}
+	bob := Key{VIN: "1", Fingerprint: Fingerprint([]byte("bob"))}
+	if sessions, ok := c.GetSessions(alice); !ok || len(sessions) != 1 || sessions[0].Domain != 1 {
+		t.Fatalf("Migrated sessions weren't adopted: %+v", sessions)
+	}
+	if _, ok := c.GetSessions(bob); ok {
+		t.Errorf("Migrated sessions were adopted by more than one key")
+	}
+	if _, ok := c.GetEntry("1"); ok {
+		t.Errorf("Adopted sessions returned by deprecated GetEntry")
+	}
+
+	var buffer bytes.Buffer
+	if err := c.Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imported, err := Import(&buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := imported.GetSessions(alice); !ok {
+		t.Errorf("Adopted sessions weren't exported with client key")
+	}
+}
+
+func TestVehicleSessions(t *testing.T) {
+	c := New(0)
+	alice := Key{VIN: "1", Fingerprint: Fingerprint([]byte("alice"))}
+	bob := Key{VIN: "1", Fingerprint: Fingerprint([]byte("bob"))}
+	c.UpdateSessions(alice, generateTestSessions(1))
+	c.UpdateSessions(bob, generateTestSessions(2))
+	c.Update("3", generateTestSessions(3))
+	vehicles := c.VehicleSessions()
+	if len(vehicles) != 2 || len(vehicles["3"]) != testSessionCount {
+		t.Fatalf("Unexpected sessions: %+v", vehicles)
+	}
+	if vehicles["1"][0].Domain != 2 {
+		t.Errorf("Expected most recently used sessions for VIN")
+	}
+
+	// The deprecated Vehicles field is populated on import.
+	var buffer bytes.Buffer
+	if err := c.Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imported, err := Import(&buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(imported.Vehicles) != 2 || imported.Vehicles["1"][0].Domain != 2 || len(imported.Vehicles["3"]) != testSessionCount {
+		t.Errorf("Unexpected imported Vehicles: %+v", imported.Vehicles)
+	}
+}
+
+func TestUpdateSessionsReplacesDomains(t *testing.T) {
+	c := New(0)
+	key := Key{VIN: "1", Fingerprint: Fingerprint([]byte("alice"))}
+	c.UpdateSessions(key, []dispatcher.CacheEntry{{Domain: 2}, {Domain: 3, SessionInfo: []byte{1}}})
+	c.UpdateSessions(key, []dispatcher.CacheEntry{{Domain: 3, SessionInfo: []byte{2}}})
+	sessions, _ := c.GetSessions(key)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions but got %d", len(sessions))
+	}
+	for _, entry := range sessions {
+		if entry.Domain == 3 && entry.SessionInfo[0] != 2 {
+			t.Errorf("Session for domain 3 wasn't replaced")
+		}
+	}
+}
+
+func TestExportKeyedSessions(t *testing.T) {
+	var buffer bytes.Buffer
+	c := New(0)
+	key := Key{VIN: "1", Fingerprint: Fingerprint([]byte("alice"))}
+	c.UpdateSessions(key, generateTestSessions(1))
+	if err := c.Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imported, err := Import(&buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := imported.GetSessions(key); !ok {
+		t.Errorf("Keyed sessions weren't exported")
+	}
 }
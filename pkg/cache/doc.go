@@ -8,13 +8,19 @@
 // not introduce more latency than redoing the handshake. Therefore clients typically benefit by
 // using a cache and do not incur a penalty if the cached information is outdated.
 //
-// A SessionCache is tied to a specific client private key. If the SessionCache is used in a
-// connection with a different private key, authentication will fail and the vehicle will send
-// correct session data as normal.
+// Sessions are tied to the client's private key. A SessionCache stores each client's sessions under
+// the fingerprint of its public key, so the same SessionCache (and cache file) may safely be used
+// with different private keys and different VINs.
 //
-// The same SessionCache may safely be used with different VINs.
+// [SessionCache.ExportToFile] creates files that are only readable by their owner. To detect
+// tampering, or to prevent a copied cache file from being used elsewhere, set [SessionCache.Cipher]
+// to encrypt and authenticate exported data using a secret derived from the client's private key
+// (see [CipherFromPrivateKey]) or stored in a system keyring (see [NewCipher]). Encrypted data is
+// read using [ImportEncrypted].
 //
-// If a SessionCache is exported using its [SessionCache.Export] or [SessionCache.ExportToFile]
-// methods, access controls should be used to prevent third parties from reading or tampering with
-// the data.
+// A SessionCache lives in a single process. Clients that run in several processes, such as
+// horizontally scaled proxies, can share sessions through a [SessionStore] instead. The package
+// provides a [FileStore] and an [EmbeddedStore] for processes on the same host, and a [KVStore]
+// that adapts an external key-value service. Use [vehicle.WithSessionStore] to attach a
+// SessionStore to a Vehicle.
 package cache
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+)
+
+const (
+	cipherAlgorithm = "AES-256-GCM"
+	cipherKeyLabel  = "session cache"
+	// minSecretLength is the minimum length of a secret passed to NewCipher.
+	minSecretLength = 16
+)
+
+var (
+	// ErrEncrypted indicates that serialized SessionCache data is encrypted but no Cipher was
+	// provided.
+	ErrEncrypted = errors.New("session cache: data is encrypted")
+	// ErrNotEncrypted indicates that a Cipher was provided but serialized SessionCache data is
+	// not encrypted. Plaintext data isn't accepted in this case, since it isn't authenticated.
+	ErrNotEncrypted = errors.New("session cache: data is not encrypted")
+	// ErrDecryptionFailed indicates that encrypted SessionCache data was modified or was encrypted
+	// using a different key.
+	ErrDecryptionFailed = errors.New("session cache: decryption failed (data was modified or encrypted with a different key)")
+)
+
+// Cipher encrypts and authenticates serialized SessionCache data. Set [SessionCache.Cipher] to
+// encrypt exported data, and use [ImportEncrypted] to read it back.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher keyed from secret, which must contain at least 16 random bytes. The
+// secret is typically stored in a system keyring.
+func NewCipher(secret []byte) (*Cipher, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("session cache: secret must be at least %d bytes", minSecretLength)
+	}
+	kdf := hmac.New(sha256.New, secret)
+	kdf.Write([]byte(cipherKeyLabel))
+	block, err := aes.NewCipher(kdf.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// CipherFromPrivateKey returns a Cipher keyed from the client's command-authentication key. The
+// secret is derived using skey.Exchange, so this works with keys that don't allow exporting the
+// private scalar.
+//
+// Data encrypted with the resulting Cipher can only be read by clients with the same private key,
+// so a copied cache file can't be used with a different key.
+func CipherFromPrivateKey(skey authentication.ECDHPrivateKey) (*Cipher, error) {
+	session, err := skey.Exchange(skey.PublicBytes())
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(session.NewHMAC(cipherKeyLabel).Sum(nil))
+}
+
+// encryptedFile is the serialization format used when a SessionCache has a Cipher. The ciphertext
+// decrypts to a fileFormat.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	Encryption string `json:"encryption"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// associatedData binds the ciphertext to the envelope's version and algorithm.
+func associatedData(version int, algorithm string) []byte {
+	return []byte(fmt.Sprintf("vehicle-command session cache v%d %s", version, algorithm))
+}
+
+func (c *Cipher) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	file := encryptedFile{
+		Version:    formatVersion,
+		Encryption: cipherAlgorithm,
+		Nonce:      nonce,
+	}
+	file.Ciphertext = c.aead.Seal(nil, nonce, plaintext, associatedData(file.Version, file.Encryption))
+	return json.Marshal(&file)
+}
+
+func (c *Cipher) open(data []byte) ([]byte, error) {
+	var file encryptedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Encryption != cipherAlgorithm {
+		return nil, fmt.Errorf("session cache: unsupported encryption algorithm '%s'", file.Encryption)
+	}
+	if len(file.Nonce) != c.aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := c.aead.Open(nil, file.Nonce, file.Ciphertext, associatedData(file.Version, file.Encryption))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+)
+
+func testCipher(t *testing.T) *Cipher {
+	t.Helper()
+	skey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c, err := CipherFromPrivateKey(skey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return c
+}
+
+func TestEncryptedImportExport(t *testing.T) {
+	var buffer bytes.Buffer
+	cipher := testCipher(t)
+	c := generateTestCache(t, 3)
+	c.Cipher = cipher
+	if err := c.Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	encrypted := buffer.Bytes()
+	if bytes.Contains(encrypted, []byte("created_at")) {
+		t.Errorf("Exported data contains plaintext")
+	}
+
+	if _, err := Import(bytes.NewReader(encrypted)); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted but got %v", err)
+	}
+	if _, err := ImportEncrypted(bytes.NewReader(encrypted), testCipher(t)); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed with wrong key but got %v", err)
+	}
+	imported, err := ImportEncrypted(bytes.NewReader(encrypted), cipher)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyCache(t, imported, []int{0, 1, 2})
+	if imported.Cipher != cipher {
+		t.Errorf("Imported cache doesn't use cipher")
+	}
+}
+
+func TestEncryptedTamperDetected(t *testing.T) {
+	var buffer bytes.Buffer
+	cipher := testCipher(t)
+	c := generateTestCache(t, 1)
+	c.Cipher = cipher
+	if err := c.Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var envelope encryptedFile
+	if err := json.Unmarshal(buffer.Bytes(), &envelope); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	envelope.Ciphertext[0] ^= 1
+	tampered, err := json.Marshal(&envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := ImportEncrypted(bytes.NewReader(tampered), cipher); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed but got %v", err)
+	}
+}
+
+func TestEncryptedRejectsPlaintext(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := generateTestCache(t, 1).Export(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := ImportEncrypted(&buffer, testCipher(t)); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted but got %v", err)
+	}
+}
+
+func TestNewCipherShortSecret(t *testing.T) {
+	if _, err := NewCipher([]byte("short")); err == nil {
+		t.Errorf("Expected error for short secret")
+	}
+}
+
+func TestEncryptedExportToFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	c := generateTestCache(t, 2)
+	c.Cipher = testCipher(t)
+	if err := c.ExportToFile(filename); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && perm != 0666 {
+		// Windows doesn't support Unix permissions and reports 0666.
+		t.Errorf("Cache file has permissions %o", perm)
+	}
+
+	other := generateTestCache(t, 1)
+	other.Cipher = testCipher(t)
+	if err := other.ExportToFile(filename); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed when overwriting another key's cache but got %v", err)
+	}
+
+	imported, err := ImportEncryptedFromFile(filename, c.Cipher)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyCache(t, imported, []int{0, 1})
+}
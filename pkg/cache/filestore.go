@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storedEntry is the serialized form of a SessionStore entry.
+type storedEntry struct {
+	Version Version `json:"version"`
+	Data    []byte  `json:"data"`
+	// Deleted marks a tombstone left by Delete, which preserves the entry's Version so that
+	// Versions aren't reused if the entry is recreated.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// FileStore is a SessionStore that keeps each entry in a separate file within a directory.
+// Processes on the same host may share a FileStore; updates are serialized using file locks.
+//
+// Deleting an entry leaves a small tombstone file in place, so that an entry's Version keeps
+// increasing if it's recreated.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore that keeps entries in dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key Key) string {
+	return filepath.Join(s.dir, key.String()+".json")
+}
+
+func readStoredEntry(path string) (*storedEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry storedEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("session store: corrupt file %s: %w", path, err)
+	}
+	return &entry, nil
+}
+
+// Get implements SessionStore.
+func (s *FileStore) Get(ctx context.Context, key Key) ([]byte, Version, error) {
+	if err := key.validate(); err != nil {
+		return nil, 0, err
+	}
+	entry, err := readStoredEntry(s.path(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.Deleted {
+		return nil, 0, ErrNotFound
+	}
+	return entry.Data, entry.Version, nil
+}
+
+// currentVersion returns the version of the entry at path, or zero if it doesn't exist, and the
+// last version used at path, which includes the versions of deleted entries.
+func currentVersion(path string) (current, last Version, err error) {
+	entry, err := readStoredEntry(path)
+	if errors.Is(err, ErrNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if entry.Deleted {
+		return 0, entry.Version, nil
+	}
+	return entry.Version, entry.Version, nil
+}
+
+// Put implements SessionStore.
+func (s *FileStore) Put(ctx context.Context, key Key, data []byte, version Version) (Version, error) {
+	if err := key.validate(); err != nil {
+		return 0, err
+	}
+	path := s.path(key)
+	var next Version
+	err := withFileLock(path+".lock", func() error {
+		current, last, err := currentVersion(path)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return ErrConflict
+		}
+		next = last + 1
+		encoded, err := json.Marshal(&storedEntry{Version: next, Data: data})
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, encoded, 0600)
+	})
+	return next, err
+}
+
+// Delete implements SessionStore. The entry's lock file is left in place, since removing it could
+// allow two processes to hold the lock at the same time.
+func (s *FileStore) Delete(ctx context.Context, key Key, version Version) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	path := s.path(key)
+	return withFileLock(path+".lock", func() error {
+		current, _, err := currentVersion(path)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			return nil
+		}
+		if version != 0 && current != version {
+			return ErrConflict
+		}
+		encoded, err := json.Marshal(&storedEntry{Version: current + 1, Deleted: true})
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, encoded, 0600)
+	})
+}
+
+// EmbeddedStore is a SessionStore that keeps all entries in a single file, which makes it easy to
+// copy or back up. Processes on the same host may share an EmbeddedStore; updates are serialized
+// using file locks. Each update rewrites the entire file, so a FileStore is more efficient for
+// large numbers of vehicles.
+type EmbeddedStore struct {
+	filename string
+	lock     sync.Mutex
+}
+
+// OpenEmbeddedStore returns an EmbeddedStore backed by filename. The file is created when the
+// first entry is stored.
+func OpenEmbeddedStore(filename string) (*EmbeddedStore, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	return &EmbeddedStore{filename: filename}, nil
+}
+
+type embeddedDB struct {
+	Entries map[string]*storedEntry `json:"entries"`
+	// Revision is the last Version assigned to any entry. Versions are drawn from a single counter,
+	// as in MemoryKV, so an entry that is deleted and recreated never reuses a Version.
+	Revision Version `json:"revision"`
+}
+
+func (s *EmbeddedStore) read() (*embeddedDB, error) {
+	db := embeddedDB{Entries: make(map[string]*storedEntry)}
+	data, err := os.ReadFile(s.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("session store: corrupt file %s: %w", s.filename, err)
+	}
+	if db.Entries == nil {
+		db.Entries = make(map[string]*storedEntry)
+	}
+	// Files written before Revision was introduced.
+	for _, entry := range db.Entries {
+		if db.Revision < entry.Version {
+			db.Revision = entry.Version
+		}
+	}
+	return &db, nil
+}
+
+// update applies fn to the database while holding the store's locks, and writes the result if fn
+// returns nil.
+func (s *EmbeddedStore) update(fn func(db *embeddedDB) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return withFileLock(s.filename+".lock", func() error {
+		db, err := s.read()
+		if err != nil {
+			return err
+		}
+		if err := fn(db); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(db)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(s.filename, encoded, 0600)
+	})
+}
+
+// Get implements SessionStore.
+func (s *EmbeddedStore) Get(ctx context.Context, key Key) ([]byte, Version, error) {
+	if err := key.validate(); err != nil {
+		return nil, 0, err
+	}
+	db, err := s.read()
+	if err != nil {
+		return nil, 0, err
+	}
+	entry, ok := db.Entries[key.String()]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return entry.Data, entry.Version, nil
+}
+
+// Put implements SessionStore.
+func (s *EmbeddedStore) Put(ctx context.Context, key Key, data []byte, version Version) (Version, error) {
+	if err := key.validate(); err != nil {
+		return 0, err
+	}
+	var next Version
+	err := s.update(func(db *embeddedDB) error {
+		var current Version
+		if entry, ok := db.Entries[key.String()]; ok {
+			current = entry.Version
+		}
+		if current != version {
+			return ErrConflict
+		}
+		db.Revision++
+		next = db.Revision
+		db.Entries[key.String()] = &storedEntry{Version: next, Data: data}
+		return nil
+	})
+	return next, err
+}
+
+// Delete implements SessionStore.
+func (s *EmbeddedStore) Delete(ctx context.Context, key Key, version Version) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	return s.update(func(db *embeddedDB) error {
+		entry, ok := db.Entries[key.String()]
+		if !ok {
+			return nil
+		}
+		if version != 0 && entry.Version != version {
+			return ErrConflict
+		}
+		delete(db.Entries, key.String())
+		return nil
+	})
+}
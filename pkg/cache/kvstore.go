@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// KV is the interface that an external key-value service (such as etcd, Consul, or Redis) must
+// provide in order to back a KVStore. Implementations are typically thin wrappers around the
+// service's client library.
+//
+// Each key has a revision that changes whenever the key's value changes. The zero revision refers
+// to a key that doesn't exist. Implementations must return ErrNotFound and ErrConflict (possibly
+// wrapped) in the situations described below.
+type KV interface {
+	// Get returns the value and revision of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, uint64, error)
+
+	// CompareAndSwap sets key to value if its current revision is revision, and returns the new
+	// revision. Returns ErrConflict if the revision doesn't match.
+	CompareAndSwap(ctx context.Context, key string, value []byte, revision uint64) (uint64, error)
+
+	// Delete removes key if its current revision is revision, or unconditionally if revision is
+	// zero. Returns ErrConflict if the revision doesn't match.
+	Delete(ctx context.Context, key string, revision uint64) error
+}
+
+// KVStore adapts a KV to the SessionStore interface, which allows horizontally scaled services to
+// share sessions through an external key-value service.
+type KVStore struct {
+	kv     KV
+	prefix string
+}
+
+// NewKVStore returns a SessionStore that keeps entries in kv. The prefix is prepended to each key,
+// allowing the KV to be shared with other applications.
+func NewKVStore(kv KV, prefix string) *KVStore {
+	return &KVStore{kv: kv, prefix: prefix}
+}
+
+// Get implements SessionStore.
+func (s *KVStore) Get(ctx context.Context, key Key) ([]byte, Version, error) {
+	if err := key.validate(); err != nil {
+		return nil, 0, err
+	}
+	value, revision, err := s.kv.Get(ctx, s.prefix+key.String())
+	return value, Version(revision), err
+}
+
+// Put implements SessionStore.
+func (s *KVStore) Put(ctx context.Context, key Key, data []byte, version Version) (Version, error) {
+	if err := key.validate(); err != nil {
+		return 0, err
+	}
+	revision, err := s.kv.CompareAndSwap(ctx, s.prefix+key.String(), data, uint64(version))
+	return Version(revision), err
+}
+
+// Delete implements SessionStore.
+func (s *KVStore) Delete(ctx context.Context, key Key, version Version) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	return s.kv.Delete(ctx, s.prefix+key.String(), uint64(version))
+}
+
+// MemoryKV is an in-process implementation of KV. It's useful for sharing sessions among Vehicle
+// objects in the same process and as a stand-in for an external service in tests.
+type MemoryKV struct {
+	lock     sync.Mutex
+	values   map[string][]byte
+	revision map[string]uint64
+	counter  uint64
+}
+
+// NewMemoryKV returns an empty MemoryKV.
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{
+		values:   make(map[string][]byte),
+		revision: make(map[string]uint64),
+	}
+}
+
+// Get implements KV.
+func (m *MemoryKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	value, ok := m.values[key]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return append([]byte{}, value...), m.revision[key], nil
+}
+
+// CompareAndSwap implements KV. Revisions are drawn from a single counter, as in etcd, so a key
+// that is deleted and recreated never reuses a revision.
+func (m *MemoryKV) CompareAndSwap(ctx context.Context, key string, value []byte, revision uint64) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.revision[key] != revision {
+		return 0, ErrConflict
+	}
+	m.counter++
+	m.values[key] = append([]byte{}, value...)
+	m.revision[key] = m.counter
+	return m.counter, nil
+}
+
+// Delete implements KV.
+func (m *MemoryKV) Delete(ctx context.Context, key string, revision uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	current, ok := m.revision[key]
+	if !ok {
+		return nil
+	}
+	if revision != 0 && current != revision {
+		return ErrConflict
+	}
+	delete(m.values, key)
+	delete(m.revision, key)
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package cache
+
+import "os"
+
+// File locking isn't supported on this platform, so concurrent writers in different processes
+// aren't excluded.
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/dispatcher"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+)
+
+var (
+	// ErrNotFound indicates a SessionStore doesn't contain an entry for the requested Key.
+	ErrNotFound = errors.New("session store: entry not found")
+	// ErrConflict indicates a SessionStore entry was modified by another client since it was read.
+	ErrConflict = errors.New("session store: entry was modified concurrently")
+	// ErrInvalidKey indicates a Key contains characters that a SessionStore doesn't support.
+	ErrInvalidKey = errors.New("session store: invalid key")
+)
+
+// maxSaveAttempts bounds the number of times SaveSessions retries after a conflict.
+const maxSaveAttempts = 8
+
+// Key identifies the sessions that a client has with a vehicle. Sessions are tied to the client's
+// public key, so different keys used with the same vehicle have separate entries.
+type Key struct {
+	VIN string
+	// Fingerprint identifies the client's public key. See [Fingerprint].
+	Fingerprint string
+}
+
+var keyFieldRegEx = regexp.MustCompile(`^[A-Za-z0-9]{1,64}$`)
+
+func (k Key) validate() error {
+	if !keyFieldRegEx.MatchString(k.VIN) || !keyFieldRegEx.MatchString(k.Fingerprint) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// String returns a representation of k that is safe to use in file names and external key-value
+// stores.
+func (k Key) String() string {
+	return k.VIN + "_" + k.Fingerprint
+}
+
+// Fingerprint returns a short identifier for a client's public key, encoded in uncompressed form.
+func Fingerprint(publicKey []byte) string {
+	digest := sha256.Sum256(publicKey)
+	return hex.EncodeToString(digest[:16])
+}
+
+// Version identifies a revision of a SessionStore entry. The zero Version refers to an entry that
+// doesn't exist.
+type Version uint64
+
+// SessionStore persists session state so that it can be shared by Vehicle objects in different
+// processes or on different hosts. Entries are opaque byte slices; use [LoadSessions] and
+// [SaveSessions] to read and write them.
+//
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Get returns the data stored under key and its current Version. Returns ErrNotFound if there
+	// is no entry.
+	Get(ctx context.Context, key Key) ([]byte, Version, error)
+
+	// Put stores data under key if the entry's current Version is version, and returns the new
+	// Version. Use the zero Version to create an entry that must not already exist. Returns
+	// ErrConflict if the entry's Version doesn't match.
+	Put(ctx context.Context, key Key, data []byte, version Version) (Version, error)
+
+	// Delete removes the entry stored under key if its current Version is version. If version is
+	// zero, the entry is removed unconditionally. Deleting an entry that doesn't exist is not an
+	// error.
+	Delete(ctx context.Context, key Key, version Version) error
+}
+
+// LoadSessions reads the sessions stored under key. Returns ErrNotFound if there is no entry.
+func LoadSessions(ctx context.Context, store SessionStore, key Key) ([]dispatcher.CacheEntry, Version, error) {
+	data, version, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	var sessions []dispatcher.CacheEntry
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, 0, fmt.Errorf("session store: corrupt entry for %s: %w", key.VIN, err)
+	}
+	return sessions, version, nil
+}
+
+// SaveSessions writes sessions to store under key.
+//
+// If another client updates the entry concurrently, SaveSessions merges the two: for each domain,
+// it keeps whichever session has advanced furthest. This prevents a client from overwriting a
+// session with an older anti-replay counter, which would cause the next command sent using that
+// session to be rejected by the vehicle.
+func SaveSessions(ctx context.Context, store SessionStore, key Key, sessions []dispatcher.CacheEntry) error {
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		stored, version, err := LoadSessions(ctx, store, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		data, err := json.Marshal(mergeSessions(stored, sessions))
+		if err != nil {
+			return err
+		}
+		if _, err = store.Put(ctx, key, data, version); !errors.Is(err, ErrConflict) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return ErrConflict
+}
+
+// MergeSessions combines stored and updated sessions. For each domain, it keeps the session from
+// updated unless the session from stored has advanced further.
+func MergeSessions(stored, updated []dispatcher.CacheEntry) []dispatcher.CacheEntry {
+	return mergeSessions(stored, updated)
+}
+
+// ReserveCounters reserves n anti-replay counters for the session in entry, so that clients sharing
+// store never use the same counter twice. It implements [dispatcher.CounterReserver].
+//
+// If store has a newer session for entry's domain, ReserveCounters returns that session instead
+// of entry. The caller may use the counters after the returned session's counter, up to and
+// including the returned limit.
+func ReserveCounters(ctx context.Context, store SessionStore, key Key, entry dispatcher.CacheEntry, n uint32) (dispatcher.CacheEntry, uint32, error) {
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		stored, version, err := LoadSessions(ctx, store, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return entry, 0, err
+		}
+		current := entry
+		for _, s := range stored {
+			if s.Domain == entry.Domain && newerSession(s, current) {
+				current = s
+			}
+		}
+
+		var info signatures.SessionInfo
+		if err := proto.Unmarshal(current.SessionInfo, &info); err != nil {
+			return entry, 0, fmt.Errorf("session store: corrupt session: %w", err)
+		}
+		limit := info.GetCounter() + n
+		if limit < info.GetCounter() {
+			limit = math.MaxUint32
+		}
+		info.Counter = limit
+		reserved := current
+		if reserved.SessionInfo, err = proto.Marshal(&info); err != nil {
+			return entry, 0, err
+		}
+
+		data, err := json.Marshal(mergeSessions(stored, []dispatcher.CacheEntry{reserved}))
+		if err != nil {
+			return entry, 0, err
+		}
+		if _, err = store.Put(ctx, key, data, version); err == nil {
+			return current, limit, nil
+		} else if !errors.Is(err, ErrConflict) {
+			return entry, 0, err
+		}
+		if ctx.Err() != nil {
+			return entry, 0, ctx.Err()
+		}
+	}
+	return entry, 0, ErrConflict
+}
+
+// mergeSessions combines stored and updated sessions, preferring updated sessions unless the
+// stored session for the same domain is further along.
+func mergeSessions(stored, updated []dispatcher.CacheEntry) []dispatcher.CacheEntry {
+	byDomain := make(map[int]dispatcher.CacheEntry)
+	var domains []int
+	for _, entry := range stored {
+		if _, ok := byDomain[entry.Domain]; !ok {
+			domains = append(domains, entry.Domain)
+		}
+		byDomain[entry.Domain] = entry
+	}
+	for _, entry := range updated {
+		previous, ok := byDomain[entry.Domain]
+		if !ok {
+			domains = append(domains, entry.Domain)
+		} else if newerSession(previous, entry) {
+			continue
+		}
+		byDomain[entry.Domain] = entry
+	}
+	merged := make([]dispatcher.CacheEntry, 0, len(domains))
+	for _, domain := range domains {
+		merged = append(merged, byDomain[domain])
+	}
+	return merged
+}
+
+// newerSession returns true if a should be kept instead of b. Within a session epoch, the session
+// with the higher counter wins; otherwise, the more recently saved session wins.
+func newerSession(a, b dispatcher.CacheEntry) bool {
+	var infoA, infoB signatures.SessionInfo
+	if proto.Unmarshal(a.SessionInfo, &infoA) == nil && proto.Unmarshal(b.SessionInfo, &infoB) == nil {
+		if bytes.Equal(infoA.GetEpoch(), infoB.GetEpoch()) {
+			return infoA.GetCounter() > infoB.GetCounter()
+		}
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/dispatcher"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+)
+
+var testKey = Key{VIN: "5YJ30123456789ABC", Fingerprint: Fingerprint([]byte("public key"))}
+
+func testStores(t *testing.T) map[string]SessionStore {
+	t.Helper()
+	fileStore, err := NewFileStore(filepath.Join(t.TempDir(), "sessions"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	embeddedStore, err := OpenEmbeddedStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return map[string]SessionStore{
+		"file":     fileStore,
+		"embedded": embeddedStore,
+		"kv":       NewKVStore(NewMemoryKV(), "sessions/"),
+	}
+}
+
+func testSession(t *testing.T, domain int, epoch byte, counter uint32, createdAt time.Time) dispatcher.CacheEntry {
+	t.Helper()
+	info, err := proto.Marshal(&signatures.SessionInfo{Epoch: []byte{epoch}, Counter: counter})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return dispatcher.CacheEntry{Domain: domain, SessionInfo: info, CreatedAt: createdAt}
+}
+
+func sessionCounter(t *testing.T, entry dispatcher.CacheEntry) uint32 {
+	t.Helper()
+	var info signatures.SessionInfo
+	if err := proto.Unmarshal(entry.SessionInfo, &info); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return info.GetCounter()
+}
+
+func TestSessionStoreVersions(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		if _, _, err := store.Get(ctx, testKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("[%s] Expected ErrNotFound but got %v", name, err)
+		}
+		v1, err := store.Put(ctx, testKey, []byte("one"), 0)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if _, err := store.Put(ctx, testKey, []byte("two"), 0); !errors.Is(err, ErrConflict) {
+			t.Errorf("[%s] Expected ErrConflict when creating existing entry but got %v", name, err)
+		}
+		v2, err := store.Put(ctx, testKey, []byte("two"), v1)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if v2 == v1 {
+			t.Errorf("[%s] Version didn't change after Put", name)
+		}
+		data, version, err := store.Get(ctx, testKey)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if string(data) != "two" || version != v2 {
+			t.Errorf("[%s] Got (%s, %d) but expected (two, %d)", name, data, version, v2)
+		}
+		if err := store.Delete(ctx, testKey, v1); !errors.Is(err, ErrConflict) {
+			t.Errorf("[%s] Expected ErrConflict when deleting stale version but got %v", name, err)
+		}
+		if err := store.Delete(ctx, testKey, v2); err != nil {
+			t.Errorf("[%s] Unexpected error: %s", name, err)
+		}
+		if _, _, err := store.Get(ctx, testKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("[%s] Expected ErrNotFound after Delete but got %v", name, err)
+		}
+		if err := store.Delete(ctx, testKey, 0); err != nil {
+			t.Errorf("[%s] Deleting missing entry failed: %s", name, err)
+		}
+	}
+}
+
+func TestSessionStoreVersionsNotReused(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		v1, err := store.Put(ctx, testKey, []byte("one"), 0)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if err := store.Delete(ctx, testKey, v1); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		v2, err := store.Put(ctx, testKey, []byte("two"), 0)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if v2 <= v1 {
+			t.Errorf("[%s] Recreated entry reused version %d", name, v2)
+		}
+		// A client that read the deleted entry must not be able to overwrite the new one.
+		if _, err := store.Put(ctx, testKey, []byte("stale"), v1); !errors.Is(err, ErrConflict) {
+			t.Errorf("[%s] Expected ErrConflict but got %v", name, err)
+		}
+	}
+}
+
+func TestSessionStoreInvalidKey(t *testing.T) {
+	ctx := context.Background()
+	badKeys := []Key{
+		{VIN: "../etc/passwd", Fingerprint: testKey.Fingerprint},
+		{VIN: testKey.VIN, Fingerprint: ""},
+	}
+	for name, store := range testStores(t) {
+		for _, key := range badKeys {
+			if _, err := store.Put(ctx, key, []byte("data"), 0); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("[%s] Expected ErrInvalidKey for %+v but got %v", name, key, err)
+			}
+		}
+	}
+}
+
+func TestSaveSessionsMerges(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	for name, store := range testStores(t) {
+		first := []dispatcher.CacheEntry{
+			testSession(t, 2, 1, 10, now),
+			testSession(t, 3, 1, 20, now),
+		}
+		if err := SaveSessions(ctx, store, testKey, first); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		// A second client that advanced domain 2 but holds a stale domain 3 session.
+		second := []dispatcher.CacheEntry{
+			testSession(t, 2, 1, 15, now),
+			testSession(t, 3, 1, 5, now),
+		}
+		if err := SaveSessions(ctx, store, testKey, second); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		sessions, _, err := LoadSessions(ctx, store, testKey)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if len(sessions) != 2 {
+			t.Fatalf("[%s] Expected 2 sessions but got %d", name, len(sessions))
+		}
+		for _, entry := range sessions {
+			expected := map[int]uint32{2: 15, 3: 20}[entry.Domain]
+			if counter := sessionCounter(t, entry); counter != expected {
+				t.Errorf("[%s] Domain %d has counter %d, expected %d", name, entry.Domain, counter, expected)
+			}
+		}
+		// A new epoch replaces the old one regardless of counter.
+		third := []dispatcher.CacheEntry{testSession(t, 3, 2, 1, now.Add(time.Second))}
+		if err := SaveSessions(ctx, store, testKey, third); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if sessions, _, err = LoadSessions(ctx, store, testKey); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		for _, entry := range sessions {
+			if entry.Domain == 3 && sessionCounter(t, entry) != 1 {
+				t.Errorf("[%s] Session from new epoch was not saved", name)
+			}
+		}
+	}
+}
+
+func TestSaveSessionsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	const writers = 4
+	for name, store := range testStores(t) {
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(domain int) {
+				defer wg.Done()
+				sessions := []dispatcher.CacheEntry{testSession(t, domain, 1, 1, time.Now())}
+				errs <- SaveSessions(ctx, store, testKey, sessions)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("[%s] Unexpected error: %s", name, err)
+			}
+		}
+		sessions, _, err := LoadSessions(ctx, store, testKey)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if len(sessions) != writers {
+			t.Errorf("[%s] Expected %d sessions after concurrent writes but got %d", name, writers, len(sessions))
+		}
+	}
+}
+
+func TestReserveCountersConcurrent(t *testing.T) {
+	ctx := context.Background()
+	const clients = 4
+	const reservations = 5
+	const blockSize = 10
+	for name, store := range testStores(t) {
+		session := testSession(t, 0, 1, 100, time.Now())
+		if err := SaveSessions(ctx, store, testKey, []dispatcher.CacheEntry{session}); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		var lock sync.Mutex
+		used := make(map[uint32]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Each client starts with the same session, as if they had all loaded it before
+				// sending any commands.
+				for j := 0; j < reservations; j++ {
+					entry, limit, err := ReserveCounters(ctx, store, testKey, session, blockSize)
+					if err != nil {
+						t.Errorf("[%s] Unexpected error: %s", name, err)
+						return
+					}
+					lock.Lock()
+					for counter := sessionCounter(t, entry) + 1; counter <= limit; counter++ {
+						if used[counter] {
+							t.Errorf("[%s] Counter %d reserved twice", name, counter)
+						}
+						used[counter] = true
+					}
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(used) != clients*reservations*blockSize {
+			t.Errorf("[%s] Expected %d reserved counters but got %d", name, clients*reservations*blockSize, len(used))
+		}
+	}
+}
+
+func TestReserveCountersReturnsNewerSession(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	for name, store := range testStores(t) {
+		newer := testSession(t, 0, 2, 5, now)
+		if err := SaveSessions(ctx, store, testKey, []dispatcher.CacheEntry{newer}); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		entry, limit, err := ReserveCounters(ctx, store, testKey, testSession(t, 0, 1, 50, now.Add(-time.Minute)), 10)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", name, err)
+		}
+		if !bytes.Equal(entry.SessionInfo, newer.SessionInfo) || limit != 15 {
+			t.Errorf("[%s] Expected newer stored session with limit 15 but got counter %d and limit %d", name, sessionCounter(t, entry), limit)
+		}
+	}
+}
+
+func TestFileStoresShareFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	a, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	b, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	version, err := a.Put(ctx, testKey, []byte("data"), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, got, err := b.Get(ctx, testKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(data) != "data" || got != version {
+		t.Errorf("Second store read (%s, %d), expected (data, %d)", data, got, version)
+	}
+}
@@ -53,14 +53,18 @@ import (
 	"flag"
 	"fmt"
 	"io/fs"
+	"net/http"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/greenmission/vehicle-command/internal/log"
 	"github.com/greenmission/vehicle-command/pkg/account"
 	"github.com/greenmission/vehicle-command/pkg/cache"
+	"github.com/greenmission/vehicle-command/pkg/connector"
 	"github.com/greenmission/vehicle-command/pkg/connector/ble"
+	"github.com/greenmission/vehicle-command/pkg/connector/recorder"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 	"github.com/greenmission/vehicle-command/pkg/vehicle"
 
@@ -97,18 +101,25 @@ func (d *domainNames) ToDomains() ([]protocol.Domain, error) {
 	return domains, nil
 }
 
+// cacheSaveDelay is the delay before changes to session state are written to the session cache
+// file.
+const cacheSaveDelay = time.Second
+
 // Environment variable names used are used by [Config.ReadFromEnvironment] to set common parameters.
 const (
-	EnvTeslaKeyName      = "TESLA_KEY_NAME"
-	EnvTeslaKeyFile      = "TESLA_KEY_FILE"
-	EnvTeslaTokenName    = "TESLA_TOKEN_NAME"
-	EnvTeslaTokenFile    = "TESLA_TOKEN_FILE"
-	EnvTeslaVIN          = "TESLA_VIN"
-	EnvTeslaCacheFile    = "TESLA_CACHE_FILE"
-	EnvTeslaKeyringType  = "TESLA_KEYRING_TYPE"
-	EnvTeslaKeyringPass  = "TESLA_KEYRING_PASSWORD"
-	EnvTeslaKeyringPath  = "TESLA_KEYRING_PATH"
-	EnvTeslaKeyringDebug = "TESLA_KEYRING_DEBUG"
+	EnvTeslaKeyName         = "TESLA_KEY_NAME"
+	EnvTeslaKeyFile         = "TESLA_KEY_FILE"
+	EnvTeslaTokenName       = "TESLA_TOKEN_NAME"
+	EnvTeslaTokenFile       = "TESLA_TOKEN_FILE"
+	EnvTeslaVIN             = "TESLA_VIN"
+	EnvTeslaCacheFile       = "TESLA_CACHE_FILE"
+	EnvTeslaCacheEncryption = "TESLA_CACHE_ENCRYPTION"
+	EnvTeslaKeyringType     = "TESLA_KEYRING_TYPE"
+	EnvTeslaKeyringPass     = "TESLA_KEYRING_PASSWORD"
+	EnvTeslaKeyringPath     = "TESLA_KEYRING_PATH"
+	EnvTeslaKeyringDebug    = "TESLA_KEYRING_DEBUG"
+	EnvTeslaClientID        = "TESLA_OAUTH_CLIENT_ID"
+	EnvTeslaTokenURL        = "TESLA_OAUTH_TOKEN_URL"
 )
 
 // Flag controls what options should be scanned from the command line and/or environment variables.
@@ -132,6 +143,13 @@ var (
 	ErrKeyNotFound           = keyring.ErrKeyNotFound
 )
 
+// Session cache encryption modes for [Config.CacheEncryption].
+const (
+	CacheEncryptionNone       = ""        // Session cache is stored in plaintext.
+	CacheEncryptionPrivateKey = "key"     // Session cache is encrypted using the private key.
+	CacheEncryptionKeyring    = "keyring" // Session cache is encrypted using a secret in the keyring.
+)
+
 // Config fields determine how a client authenticates to vehicles and/or Tesla's backend.
 type Config struct {
 	Flags            Flag   // Controls which set of environment variables/CLI flags to use.
@@ -141,6 +159,8 @@ type Config struct {
 	TokenFilename    string
 	KeyFilename      string
 	CacheFilename    string
+	CacheEncryption  string // One of the CacheEncryption constants
+	RecordFilename   string // If set, vehicle traffic is recorded to this file (see package recorder)
 	Backend          keyring.Config
 	BackendType      backendType
 	Debug            bool // Enable keyring debug messages
@@ -149,11 +169,21 @@ type Config struct {
 	// connection latency and avoid waking up the infotainment system unnecessarily.
 	DomainNames domainNames
 
+	// HTTPClient, if not nil, is used for all requests to Tesla's servers.
+	HTTPClient *http.Client
+
+	// OAuthClientID and OAuthTokenURL are used to refresh access tokens. Refreshing requires a
+	// client ID and a refresh token saved with [Config.SaveRefreshTokenToKeyring].
+	OAuthClientID string
+	OAuthTokenURL string
+
 	password   *string
 	sessions   *cache.SessionCache
 	acct       *account.Account
 	skey       protocol.ECDHPrivateKey
 	oauthToken string
+
+	oauthTokenFromFile bool
 }
 
 func NewConfig(flags Flag) (*Config, error) {
@@ -175,12 +205,14 @@ func NewConfig(flags Flag) (*Config, error) {
 func (c *Config) RegisterCommandLineFlags() {
 	if c.Flags.isSet(FlagVIN) {
 		flag.StringVar(&c.VIN, "vin", "", "Vehicle Identification Number. Defaults to $TESLA_VIN.")
+		flag.StringVar(&c.RecordFilename, "record", "", "Record messages exchanged with the vehicle to `file` for debugging")
 	}
 	if c.Flags.isSet(FlagPrivateKey) {
 		if !c.Flags.isSet(FlagVIN) {
 			log.Debug("FlagPrivateKey is set but FlagVIN is not. A VIN is required to send vehicle commands.")
 		}
 		flag.StringVar(&c.CacheFilename, "session-cache", "", "Load session info cache from `file`. Defaults to $TESLA_CACHE_FILE.")
+		flag.StringVar(&c.CacheEncryption, "session-cache-encryption", "", "Encrypt session cache using a secret derived from the private `key` or stored in the `keyring`. Defaults to $TESLA_CACHE_ENCRYPTION.")
 		flag.StringVar(&c.KeyringKeyName, "key-name", "", "System keyring `name` for private key. Defaults to $TESLA_KEY_NAME.")
 		flag.StringVar(&c.KeyFilename, "key-file", "", "A `file` containing private key. Defaults to $TESLA_KEY_FILE.")
 		flag.Var(&c.DomainNames, "domain", "Domains to connect to (can be repeated; omit for all)")
@@ -188,6 +220,8 @@ func (c *Config) RegisterCommandLineFlags() {
 	if c.Flags.isSet(FlagOAuth) {
 		flag.StringVar(&c.KeyringTokenName, "token-name", "", "System keyring `name` for OAuth token. Defaults to $TESLA_TOKEN_NAME.")
 		flag.StringVar(&c.TokenFilename, "token-file", "", "`File` containing OAuth token. Defaults to $TESLA_TOKEN_FILE.")
+		flag.StringVar(&c.OAuthClientID, "oauth-client-id", "", "OAuth client `ID` used to refresh tokens. Defaults to $TESLA_OAUTH_CLIENT_ID.")
+		flag.StringVar(&c.OAuthTokenURL, "oauth-token-url", "", "OAuth token endpoint `URL`. Defaults to $TESLA_OAUTH_TOKEN_URL or "+account.DefaultTokenURL+".")
 	}
 	if c.Flags.isSet(FlagOAuth) || c.Flags.isSet(FlagPrivateKey) {
 		var names []string
@@ -235,6 +269,10 @@ func (c *Config) ReadFromEnvironment() {
 			c.CacheFilename = os.Getenv(EnvTeslaCacheFile)
 			log.Debug("Set session cache file to '%s'", c.CacheFilename)
 		}
+		if c.CacheEncryption == "" {
+			c.CacheEncryption = os.Getenv(EnvTeslaCacheEncryption)
+			log.Debug("Set session cache encryption to '%s'", c.CacheEncryption)
+		}
 		if c.KeyringKeyName == "" && c.KeyFilename == "" {
 			c.KeyringKeyName = os.Getenv(EnvTeslaKeyName)
 			log.Debug("Set key name to '%s'", c.KeyringKeyName)
@@ -251,6 +289,14 @@ func (c *Config) ReadFromEnvironment() {
 			c.TokenFilename = os.Getenv(EnvTeslaTokenFile)
 			log.Debug("Set OAuth token file to '%s'", c.TokenFilename)
 		}
+		if c.OAuthClientID == "" {
+			c.OAuthClientID = os.Getenv(EnvTeslaClientID)
+			log.Debug("Set OAuth client ID to '%s'", c.OAuthClientID)
+		}
+		if c.OAuthTokenURL == "" {
+			c.OAuthTokenURL = os.Getenv(EnvTeslaTokenURL)
+			log.Debug("Set OAuth token URL to '%s'", c.OAuthTokenURL)
+		}
 	}
 	if c.Flags.isSet(FlagOAuth) || c.Flags.isSet(FlagPrivateKey) {
 		if c.BackendType.String() == string(keyring.InvalidBackend) {
@@ -289,6 +335,16 @@ func (c *Config) UpdateCachedSessions(v *vehicle.Vehicle) {
 	}
 }
 
+// vehicleOptions returns the options used for vehicles created by c. If c.CacheFilename is set,
+// session state is written to the file shortly after it changes, so that counter progress isn't
+// lost if the process exits before calling UpdateCachedSessions.
+func (c *Config) vehicleOptions() []vehicle.Option {
+	if c.CacheFilename == "" {
+		return nil
+	}
+	return []vehicle.Option{vehicle.WithAutoPersist(cacheSaveDelay, c.UpdateCachedSessions)}
+}
+
 // PrivateKey loads a private key from the location specified in c.
 //
 // If c does not specify a private key location, both skey and err will be nil. The private key is
@@ -310,7 +366,7 @@ func (c *Config) PrivateKey() (skey protocol.ECDHPrivateKey, err error) {
 	if skey == nil && c.KeyringKeyName != "" {
 		skey, err = c.LoadKeyFromKeyring()
 	}
-	if err := c.loadCache(); err != nil {
+	if err := c.loadCache(skey); err != nil {
 		return nil, err
 	}
 	c.skey = skey
@@ -341,7 +397,7 @@ func (c *Config) Connect(ctx context.Context) (acct *account.Account, car *vehic
 		log.Debug("Client public key: %02x", skey.PublicBytes())
 	}
 
-	if c.Flags.isSet(FlagOAuth) && (c.KeyringTokenName != "" || c.TokenFilename != "") {
+	if c.usesOAuth() {
 		log.Debug("Required OAuth parameters supplied by CLI and/or environment. Connecting over the Internet...")
 		acct, car, err = c.ConnectRemote(ctx, skey)
 	} else if c.Flags.isSet(FlagBLE) && c.Flags.isSet(FlagVIN) {
@@ -378,23 +434,50 @@ func (c *Config) Connect(ctx context.Context) (acct *account.Account, car *vehic
 	return
 }
 
-func (c *Config) loadCache() error {
+func (c *Config) loadCache(skey protocol.ECDHPrivateKey) error {
 	if c.CacheFilename == "" {
 		return nil
 	}
+	cipher, err := c.cacheCipher(skey)
+	if err != nil {
+		return fmt.Errorf("failed to load session cache: %s", err)
+	}
 	log.Debug("Loading cache from %s...", c.CacheFilename)
-	var err error
-	c.sessions, err = cache.ImportFromFile(c.CacheFilename)
+	c.sessions, err = cache.ImportEncryptedFromFile(c.CacheFilename, cipher)
+	if errors.Is(err, cache.ErrNotEncrypted) {
+		log.Warning("Discarding unencrypted session cache %s", c.CacheFilename)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to load session cache: %s", err)
+	}
 	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("failed to load session cache: %s", err)
-		}
 		// Create a new cache if one couldn't be loaded from the file
 		c.sessions = cache.New(0)
+		c.sessions.Cipher = cipher
 	}
 	return nil
 }
 
+// cacheCipher returns the cache.Cipher selected by c.CacheEncryption, or nil if the session cache
+// isn't encrypted.
+func (c *Config) cacheCipher(skey protocol.ECDHPrivateKey) (*cache.Cipher, error) {
+	switch c.CacheEncryption {
+	case CacheEncryptionNone:
+		return nil, nil
+	case CacheEncryptionPrivateKey:
+		if skey == nil {
+			return nil, fmt.Errorf("session cache encryption requires a private key")
+		}
+		return cache.CipherFromPrivateKey(skey)
+	case CacheEncryptionKeyring:
+		secret, err := c.loadCacheSecret()
+		if err != nil {
+			return nil, err
+		}
+		return cache.NewCipher(secret)
+	}
+	return nil, fmt.Errorf("unknown session cache encryption mode '%s'", c.CacheEncryption)
+}
+
 func (c *Config) token() (string, error) {
 	if c.oauthToken != "" {
 		return c.oauthToken, nil
@@ -404,6 +487,7 @@ func (c *Config) token() (string, error) {
 		token, err := os.ReadFile(c.TokenFilename)
 		if err == nil {
 			c.oauthToken = string(token)
+			c.oauthTokenFromFile = true
 			return c.oauthToken, nil
 		}
 		if !errors.Is(err, os.ErrNotExist) {
@@ -416,12 +500,68 @@ func (c *Config) token() (string, error) {
 }
 
 // Account logs into and returns the configured Tesla account.
+//
+// If the OAuth token was loaded from the keyring, c.OAuthClientID is set, and a refresh token is
+// available, then the Account refreshes its access token as needed and saves rotated tokens to
+// the keyring.
 func (c *Config) Account() (*account.Account, error) {
 	token, err := c.token()
 	if err != nil {
 		return nil, err
 	}
-	return account.New(token, "")
+	if source := c.tokenSource(); source != nil {
+		return account.NewWithTokenSource(context.Background(), source, "", account.WithHTTPClient(c.HTTPClient))
+	}
+	return account.New(token, "", account.WithHTTPClient(c.HTTPClient))
+}
+
+// usesOAuth returns true if Connect will reach the vehicle through the Fleet API.
+func (c *Config) usesOAuth() bool {
+	return c.Flags.isSet(FlagOAuth) && (c.KeyringTokenName != "" || c.TokenFilename != "")
+}
+
+// CheckToken returns an error if Connect would use an OAuth token that has expired and can't be
+// refreshed, or that grants none of scopes. The check is skipped if Connect won't use the Fleet
+// API, if scopes is empty, or if the token doesn't list its scopes.
+//
+// The token is not verified, so a nil return value doesn't guarantee the server will accept it.
+// The purpose of this method is to report common errors before attempting to connect.
+func (c *Config) CheckToken(scopes ...string) error {
+	if !c.usesOAuth() {
+		return nil
+	}
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	info, err := account.ParseTokenInfo(token)
+	if err != nil {
+		return err
+	}
+	if info.Expired() && c.tokenSource() == nil {
+		return fmt.Errorf("OAuth token expired at %s; obtain a new token (e.g., with tesla-auth-token login)", info.Expiry.Format(time.RFC3339))
+	}
+	if len(scopes) > 0 && len(info.Scopes) > 0 && !info.HasAnyScope(scopes...) {
+		return fmt.Errorf("OAuth token lacks required scope %s (token grants: %s)", strings.Join(scopes, " or "), strings.Join(info.Scopes, " "))
+	}
+	return nil
+}
+
+// tokenSource returns a TokenSource that refreshes the keyring token, or nil if refreshing isn't
+// possible.
+func (c *Config) tokenSource() account.TokenSource {
+	if c.oauthTokenFromFile || c.KeyringTokenName == "" || c.OAuthClientID == "" {
+		return nil
+	}
+	if _, err := c.LoadRefreshTokenFromKeyring(); err != nil {
+		log.Debug("OAuth token won't be refreshed: %s", err)
+		return nil
+	}
+	return account.NewRefreshingTokenSource(account.RefreshConfig{
+		ClientID:   c.OAuthClientID,
+		TokenURL:   c.OAuthTokenURL,
+		HTTPClient: c.HTTPClient,
+	}, &keyringTokenStore{config: c})
 }
 
 // SavePrivateKey writes skey to the system keyring or file, depending on what options are
@@ -449,23 +589,85 @@ func (c *Config) ConnectRemote(ctx context.Context, skey protocol.ECDHPrivateKey
 	acct = c.acct
 
 	if c.Flags.isSet(FlagVIN) && c.VIN != "" {
-		car, err = acct.GetVehicle(ctx, c.VIN, skey, c.sessions)
+		if skey != nil && !c.hasCachedSessions(skey) {
+			if err = c.checkFleetStatus(ctx, acct); err != nil {
+				return nil, nil, err
+			}
+		}
+		var conn connector.Connector
+		if conn, err = c.record(acct.Connection(c.VIN)); err != nil {
+			return nil, nil, err
+		}
+		car, err = vehicle.NewVehicle(conn, skey, c.sessions, c.vehicleOptions()...)
 
 		if err != nil {
+			conn.Close()
 			return nil, nil, fmt.Errorf("failed to initialize vehicle connection: %s", err)
 		}
 	}
 	return
 }
 
+// hasCachedSessions returns true if c's session cache has sessions with c.VIN for skey. A cached
+// session shows that skey is paired with a vehicle that accepts signed commands, so there's no
+// need to spend a round trip checking fleet status.
+func (c *Config) hasCachedSessions(skey protocol.ECDHPrivateKey) bool {
+	if c.sessions == nil {
+		return false
+	}
+	_, ok := c.sessions.GetSessions(cache.Key{VIN: c.VIN, Fingerprint: cache.Fingerprint(skey.PublicBytes())})
+	return ok
+}
+
+// checkFleetStatus returns an error if fleet status shows that signed commands can't be sent to
+// c.VIN. Failures to fetch fleet status are ignored, since the vehicle may still accept commands.
+//
+// Vehicles that require REST commands can't be routed here: commands are implemented by
+// vehicle.Vehicle methods that build signed protocol messages, and most have no REST
+// counterpart that could be constructed from the same arguments.
+func (c *Config) checkFleetStatus(ctx context.Context, acct *account.Account) error {
+	status, err := acct.FleetStatus(ctx, []string{c.VIN})
+	if err != nil {
+		log.Debug("Couldn't fetch fleet status: %s", err)
+		return nil
+	}
+	route := status.Vehicle(c.VIN).Route
+	log.Debug("Fleet status of %s: %s", c.VIN, route)
+	switch route {
+	case account.RouteKeyNotPaired:
+		return fmt.Errorf("%w; add it to the vehicle with add-key-request over BLE", protocol.ErrKeyNotPaired)
+	case account.RouteREST:
+		return fmt.Errorf("%w directly or through tesla-http-proxy; only signed commands can be sent from here", protocol.ErrProtocolNotSupported)
+	}
+	return nil
+}
+
+// record wraps conn in a recorder.Recorder if c.RecordFilename is set.
+func (c *Config) record(conn connector.Connector) (connector.Connector, error) {
+	if c.RecordFilename == "" {
+		return conn, nil
+	}
+	log.Debug("Recording vehicle traffic to %s", c.RecordFilename)
+	wrapped, err := recorder.Create(conn, c.RecordFilename)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create recording: %s", err)
+	}
+	return wrapped, nil
+}
+
 // ConnectLocal connects to a vehicle over BLE.
 func (c *Config) ConnectLocal(ctx context.Context, skey protocol.ECDHPrivateKey) (car *vehicle.Vehicle, err error) {
-	conn, err := ble.NewConnection(ctx, c.VIN)
+	bleConn, err := ble.NewConnection(ctx, c.VIN)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.record(bleConn)
 	if err != nil {
 		return nil, err
 	}
 
-	car, err = vehicle.NewVehicle(conn, skey, c.sessions)
+	car, err = vehicle.NewVehicle(conn, skey, c.sessions, c.vehicleOptions()...)
 	if err != nil {
 		return nil, err
 	}
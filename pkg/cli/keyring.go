@@ -1,11 +1,14 @@
 package cli
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 
 	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/pkg/account"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 
 	"github.com/99designs/keyring"
@@ -13,10 +16,13 @@ import (
 )
 
 const (
-	keyringServiceName  = "com.tesla.auth"
-	keyringKeyService   = "vehicleCommandKey"
-	keyringTokenService = "oauthtoken"
-	keyringDirectory    = "~/.tesla_keys"
+	keyringServiceName         = "com.tesla.auth"
+	keyringKeyService          = "vehicleCommandKey"
+	keyringTokenService        = "oauthtoken"
+	keyringRefreshTokenService = "oauthrefreshtoken"
+	keyringCacheSecretService  = "sessionCacheSecret"
+	cacheSecretLength          = 32
+	keyringDirectory           = "~/.tesla_keys"
 )
 
 type backendType struct {
@@ -115,6 +121,62 @@ func (c *Config) SaveTokenToKeyring(token string) error {
 	return nil
 }
 
+// LoadRefreshTokenFromKeyring loads the OAuth refresh token saved under the same name as the
+// access token. Returns ErrKeyNotFound if there isn't one.
+func (c *Config) LoadRefreshTokenFromKeyring() (string, error) {
+	kr, err := c.openKeyring()
+	if err != nil {
+		return "", err
+	}
+
+	item, err := kr.Get(keyringRefreshTokenService + "." + c.KeyringTokenName)
+	if err != nil {
+		return "", err
+	}
+	return string(item.Data), nil
+}
+
+// SaveRefreshTokenToKeyring writes an OAuth refresh token to the system keyring. When a refresh
+// token is available, [Config.Account] automatically renews the access token.
+func (c *Config) SaveRefreshTokenToKeyring(token string) error {
+	kr, err := c.openKeyring()
+	if err != nil {
+		return err
+	}
+
+	if err := kr.Set(keyring.Item{
+		Key:  keyringRefreshTokenService + "." + c.KeyringTokenName,
+		Data: []byte(token),
+	}); err != nil {
+		return fmt.Errorf("failed to enroll refresh token in keyring: %s", err)
+	}
+	return nil
+}
+
+// keyringTokenStore implements account.TokenStore using the system keyring.
+type keyringTokenStore struct {
+	config *Config
+}
+
+func (k *keyringTokenStore) Load() (*account.Token, error) {
+	access, err := k.config.LoadTokenFromKeyring()
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := k.config.LoadRefreshTokenFromKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return &account.Token{AccessToken: access, RefreshToken: refresh}, nil
+}
+
+func (k *keyringTokenStore) Save(token *account.Token) error {
+	if err := k.config.SaveTokenToKeyring(token.AccessToken); err != nil {
+		return err
+	}
+	return k.config.SaveRefreshTokenToKeyring(token.RefreshToken)
+}
+
 // LoadKeyFromKeyring reads a private key from the system keyring.
 //
 // The provided name is an arbitrary string that identifies the key.
@@ -173,3 +235,29 @@ func (c *Config) DeletePrivateKey() error {
 	}
 	return kr.Remove(c.fullKeyName())
 }
+
+// loadCacheSecret reads the secret used to encrypt the session cache from the system keyring,
+// generating and saving a new secret if there isn't one. Secrets are stored under the private key's
+// name, so each key uses a different secret.
+func (c *Config) loadCacheSecret() ([]byte, error) {
+	kr, err := c.openKeyring()
+	if err != nil {
+		return nil, err
+	}
+	name := keyringCacheSecretService + "." + c.KeyringKeyName
+	item, err := kr.Get(name)
+	if err == nil {
+		return item.Data, nil
+	}
+	if !errors.Is(err, keyring.ErrKeyNotFound) {
+		return nil, fmt.Errorf("could not load session cache secret: %s", err)
+	}
+	secret := make([]byte, cacheSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := kr.Set(keyring.Item{Key: name, Data: secret}); err != nil {
+		return nil, fmt.Errorf("failed to enroll session cache secret in keyring: %s", err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,221 @@
+package ble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-ble/ble"
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+)
+
+var (
+	ErrAdapterClosed    = errors.New("ble: adapter closed")
+	ErrAlreadyConnected = errors.New("ble: adapter is already connected to vehicle")
+)
+
+// Adapter represents a local BLE controller. An Adapter can maintain
+// Connections to several vehicles at once. Each Connection receives only the
+// notifications sent by its own vehicle.
+type Adapter struct {
+	device ble.Device
+
+	// dialLock serializes scanning and connection establishment, which most
+	// controllers cannot perform concurrently. It is not held while
+	// Connections exchange data.
+	dialLock sync.Mutex
+
+	lock sync.Mutex
+	// conns maps VINs to Connections. A nil value reserves the VIN while a
+	// Connection is being established.
+	conns  map[string]*Connection
+	closed bool
+}
+
+// NewAdapter opens the host's default BLE controller.
+func NewAdapter() (*Adapter, error) {
+	log.Debug("Creating new BLE device")
+	device, err := newDevice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a BLE device: %s", err)
+	}
+	return NewAdapterWithDevice(device), nil
+}
+
+// NewAdapterWithDevice returns an Adapter that uses device, which allows
+// callers to select a specific controller.
+func NewAdapterWithDevice(device ble.Device) *Adapter {
+	return &Adapter{
+		device: device,
+		conns:  make(map[string]*Connection),
+	}
+}
+
+// Connect establishes a BLE connection to the vehicle with the provided VIN.
+// The ctx only bounds the initial connection attempt.
+func (a *Adapter) Connect(ctx context.Context, vin string, options Options) (*Connection, error) {
+	conn := Connection{
+		vin:       vin,
+		localName: VehicleLocalName(vin),
+		options:   options,
+		adapter:   a,
+	}
+	bufferSize := options.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = connector.BufferSize
+	}
+	conn.inbox = make(chan []byte, bufferSize)
+	conn.decoder.MaxLength = options.MaxMessageSize
+	if conn.decoder.MaxLength <= 0 {
+		conn.decoder.MaxLength = defaultMaxMessageSize
+	}
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil, ErrAdapterClosed
+	}
+	if _, ok := a.conns[vin]; ok {
+		a.lock.Unlock()
+		return nil, fmt.Errorf("%w %s", ErrAlreadyConnected, vin)
+	}
+	a.conns[vin] = nil
+	a.lock.Unlock()
+
+	conn.setState(StateConnecting)
+	err := conn.connect(ctx)
+
+	a.lock.Lock()
+	if err == nil && a.closed {
+		conn.client.ClearSubscriptions()
+		conn.client.CancelConnection()
+		err = ErrAdapterClosed
+	}
+	if err != nil {
+		if a.conns[vin] == nil {
+			delete(a.conns, vin)
+		}
+		a.lock.Unlock()
+		conn.setState(StateDisconnected)
+		return nil, err
+	}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	a.conns[vin] = &conn
+	a.lock.Unlock()
+
+	conn.setState(StateConnected)
+	log.Info("Connected to vehicle BLE")
+	go conn.monitor()
+	return &conn, nil
+}
+
+// Connections returns the open Connections owned by a.
+func (a *Adapter) Connections() []*Connection {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	conns := make([]*Connection, 0, len(a.conns))
+	for _, conn := range a.conns {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// Scan listens for vehicle beacons until ctx expires. See the package-level
+// Scan function for details.
+func (a *Adapter) Scan(ctx context.Context, vins []string) ([]Beacon, error) {
+	a.dialLock.Lock()
+	defer a.dialLock.Unlock()
+	if a.isClosed() {
+		return nil, ErrAdapterClosed
+	}
+
+	beacons := newBeaconSet(vins)
+	err := a.device.Scan(ctx, true, beacons.add)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return nil, fmt.Errorf("ble: scan failed: %s", err)
+	}
+	return beacons.list(), nil
+}
+
+// Close closes all of a's Connections and releases the BLE controller.
+func (a *Adapter) Close() error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	conns := a.conns
+	a.conns = make(map[string]*Connection)
+	a.lock.Unlock()
+
+	for _, conn := range conns {
+		// Connections that are still being established are closed by
+		// Connect.
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	a.dialLock.Lock()
+	defer a.dialLock.Unlock()
+	return a.device.Stop()
+}
+
+func (a *Adapter) isClosed() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.closed
+}
+
+func (a *Adapter) remove(conn *Connection) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.conns[conn.vin] == conn {
+		delete(a.conns, conn.vin)
+	}
+}
+
+// dial connects to the first connectable beacon advertising localName.
+func (a *Adapter) dial(ctx context.Context, localName string) (ble.Client, error) {
+	a.dialLock.Lock()
+	defer a.dialLock.Unlock()
+	if a.isClosed() {
+		return nil, ErrAdapterClosed
+	}
+
+	log.Debug("Searching for BLE beacon %s...", localName)
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make(chan ble.Addr, 1)
+	err := a.device.Scan(scanCtx, false, func(adv ble.Advertisement) {
+		if !adv.Connectable() || adv.LocalName() != localName {
+			return
+		}
+		select {
+		case found <- adv.Addr():
+			cancel()
+		default:
+		}
+	})
+
+	var addr ble.Addr
+	select {
+	case addr = <-found:
+	default:
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("can't scan: %w", err)
+	}
+
+	log.Debug("Connecting to BLE beacon...")
+	client, err := a.device.Dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't dial: %w", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,94 @@
+package ble
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+type testDevice struct {
+	ble.Device
+	advertisements []ble.Advertisement
+	stopped        bool
+	// dials provides the result of each call to Dial.
+	dials chan dialResult
+}
+
+func (d *testDevice) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	for _, adv := range d.advertisements {
+		h(adv)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (d *testDevice) Stop() error {
+	d.stopped = true
+	return nil
+}
+
+func TestAdapterScan(t *testing.T) {
+	const vin = "5YJ3E1EA1JF000000"
+	device := &testDevice{
+		advertisements: []ble.Advertisement{
+			&testAdvertisement{name: VehicleLocalName(vin), address: "aa:aa", rssi: -60, connectable: true},
+			&testAdvertisement{name: "Headphones", address: "bb:bb", rssi: -30, connectable: true},
+		},
+	}
+	adapter := NewAdapterWithDevice(device)
+	defer adapter.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	beacons, err := adapter.Scan(ctx, []string{vin})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(beacons) != 1 || beacons[0].VIN != vin {
+		t.Errorf("Unexpected beacons: %+v", beacons)
+	}
+}
+
+func TestAdapterConnectNotFound(t *testing.T) {
+	const vin = "5YJ3E1EA1JF000000"
+	adapter := NewAdapterWithDevice(&testDevice{
+		advertisements: []ble.Advertisement{
+			// Beacons that aren't connectable are ignored.
+			&testAdvertisement{name: VehicleLocalName(vin), address: "aa:aa", connectable: false},
+		},
+	})
+	defer adapter.Close()
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := adapter.Connect(ctx, vin, Options{})
+		cancel()
+		// A failed attempt must not leave the VIN reserved.
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if conns := adapter.Connections(); len(conns) != 0 {
+		t.Errorf("Expected no connections but found %d", len(conns))
+	}
+}
+
+func TestAdapterClose(t *testing.T) {
+	device := &testDevice{}
+	adapter := NewAdapterWithDevice(device)
+	if err := adapter.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !device.stopped {
+		t.Errorf("Device wasn't stopped")
+	}
+	if _, err := adapter.Connect(context.Background(), "5YJ3E1EA1JF000000", Options{}); !errors.Is(err, ErrAdapterClosed) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := adapter.Scan(context.Background(), nil); !errors.Is(err, ErrAdapterClosed) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
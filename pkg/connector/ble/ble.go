@@ -4,20 +4,29 @@ package ble
 
 import (
 	"context"
-	"crypto/sha1"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/go-ble/ble"
+	"github.com/greenmission/vehicle-command/internal/framing"
 	"github.com/greenmission/vehicle-command/internal/log"
 	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
 )
 
-const maxBLEMessageSize = 1024
+// defaultMaxMessageSize is the default maximum length of a message received
+// from the vehicle.
+const defaultMaxMessageSize = 1024
 
 var (
 	rxTimeout = time.Second
+
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 30 * time.Second
+
+	// reconnectTimeout bounds each individual reconnection attempt.
+	reconnectTimeout = 30 * time.Second
 )
 
 var (
@@ -26,20 +35,102 @@ var (
 	fromVehicleUUID    = ble.MustParse("00000213-b2d1-43f0-9b88-960cebf8b91e")
 )
 
+// ErrReconnecting is returned by Connection.Send when the BLE link has been
+// lost and the Connection is attempting to re-establish it. The error is
+// temporary, so callers such as vehicle.Vehicle will retry until the link is
+// restored or their context expires.
+var ErrReconnecting = protocol.NewError("ble: link lost, reconnecting to vehicle", false, true)
+
 var (
-	device ble.Device
-	mu     sync.Mutex
+	defaultAdapter *Adapter
+	mu             sync.Mutex
+)
+
+// State describes the status of a Connection's BLE link.
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
 )
 
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Options control how a Connection reacts to link loss. The zero value
+// disables automatic reconnection.
+type Options struct {
+	// Reconnect causes the Connection to re-establish the BLE link after it
+	// drops. The Connection (and therefore any vehicle.Vehicle and session
+	// built on it) remains usable across reconnections. Otherwise, the
+	// Connection closes its Receive channel when the link drops, and the
+	// vehicle can be connected to again without closing the Connection.
+	Reconnect bool
+	// MinBackoff and MaxBackoff bound the delay between reconnection
+	// attempts. The delay doubles after each failed attempt. Default to 1
+	// second and 30 seconds, respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxMessageSize is the largest message the Connection accepts from the
+	// vehicle. Defaults to 1024 bytes.
+	MaxMessageSize int
+	// BufferSize is the number of messages from the vehicle that can be
+	// queued before further messages are dropped. Defaults to
+	// connector.BufferSize.
+	BufferSize int
+	// WriteWithoutResponse sends data to the vehicle using write commands,
+	// which are not acknowledged at the ATT layer, if the vehicle supports
+	// them. This increases throughput. By default, each write waits for a
+	// response.
+	WriteWithoutResponse bool
+	// OnStateChange, if not nil, is invoked with the new State each time the
+	// link state changes. It may be called from a background goroutine and must
+	// not block.
+	OnStateChange func(State)
+}
+
 type Connection struct {
-	vin         string
-	inbox       chan []byte
-	txChar      *ble.Characteristic
-	rxChar      *ble.Characteristic
-	inputBuffer []byte
-	client      ble.Client
-	lastRx      time.Time
-	lock        sync.Mutex
+	vin       string
+	localName string
+	options   Options
+	adapter   *Adapter
+	inbox     chan []byte
+	txChar    *ble.Characteristic
+	rxChar    *ble.Characteristic
+	decoder   framing.Decoder
+	client    ble.Client
+	lastRx    time.Time
+	state     State
+	lock      sync.Mutex
+
+	// The following fields are set by connect and guarded by lock.
+	mtu        int
+	writeSize  int
+	noResponse bool
+
+	// inboxLock prevents notification handlers from writing to inbox after
+	// it's closed.
+	inboxLock   sync.Mutex
+	inboxClosed bool
+
+	// stats has its own lock so that notification handlers never wait on a
+	// write in progress.
+	stats     Stats
+	statsLock sync.Mutex
+
+	// ctx is cancelled when the Connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (c *Connection) PreferredAuthMethod() connector.AuthMethod {
@@ -50,43 +141,111 @@ func (c *Connection) RetryInterval() time.Duration {
 	return time.Second
 }
 
+// Receive returns a channel of messages from the vehicle. The channel is
+// closed if the link is lost and Options.Reconnect is false.
 func (c *Connection) Receive() <-chan []byte {
 	return c.inbox
 }
 
-func (c *Connection) flush() bool {
-	if len(c.inputBuffer) >= 2 {
-		msgLength := 256*int(c.inputBuffer[0]) + int(c.inputBuffer[1])
-		if msgLength > maxBLEMessageSize {
-			c.inputBuffer = []byte{}
-			return false
+// closeInbox closes c's inbox, unless it's already closed.
+func (c *Connection) closeInbox() {
+	c.inboxLock.Lock()
+	defer c.inboxLock.Unlock()
+	if !c.inboxClosed {
+		c.inboxClosed = true
+		close(c.inbox)
+	}
+}
+
+// Disconnected returns a channel that is closed when the current BLE link
+// drops, at which point the Connection changes to StateDisconnected. If
+// Options.Reconnect is true, each new link has its own channel.
+func (c *Connection) Disconnected() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client.Disconnected()
+}
+
+// State returns the current state of the BLE link.
+func (c *Connection) State() State {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+func (c *Connection) setState(state State) {
+	c.lock.Lock()
+	changed := c.state != state
+	c.state = state
+	c.lock.Unlock()
+	if changed {
+		log.Debug("BLE link to %s is %s", c.vin, state)
+		if c.options.OnStateChange != nil {
+			c.options.OnStateChange(state)
 		}
-		if len(c.inputBuffer) >= 2+msgLength {
-			buffer := c.inputBuffer[2 : 2+msgLength]
-			log.Debug("RX: %02x", buffer)
-			c.inputBuffer = c.inputBuffer[2+msgLength:]
-			select {
-			case c.inbox <- buffer:
-			default:
-				return false
-			}
-			return true
+	}
+}
+
+func (c *Connection) flush() bool {
+	buffer, err := c.decoder.Next()
+	if err != nil || buffer == nil {
+		return false
+	}
+	log.Debug("RX: %02x", buffer)
+	c.inboxLock.Lock()
+	delivered := !c.inboxClosed
+	if delivered {
+		select {
+		case c.inbox <- buffer:
+		default:
+			delivered = false
 		}
 	}
-	return false
+	c.inboxLock.Unlock()
+	if !delivered {
+		return false
+	}
+	c.statsLock.Lock()
+	c.stats.MessagesReceived++
+	c.stats.BytesReceived += framing.HeaderLength + len(buffer)
+	c.statsLock.Unlock()
+	return true
 }
 
 func (c *Connection) Close() {
-	c.client.ClearSubscriptions()
-	c.client.CancelConnection()
+	c.cancel()
+	c.adapter.remove(c)
+	c.lock.Lock()
+	client := c.client
+	c.lock.Unlock()
+	client.ClearSubscriptions()
+	client.CancelConnection()
+	c.setState(StateDisconnected)
+	stats := c.Stats()
+	log.Debug("BLE stats: %+v (%.0f B/s)", stats, stats.TxThroughput())
+}
+
+// Stats returns traffic statistics for the Connection.
+func (c *Connection) Stats() Stats {
+	c.lock.Lock()
+	mtu, size, noResponse := c.mtu, c.writeSize, c.noResponse
+	c.lock.Unlock()
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	stats := c.stats
+	stats.MTU = mtu
+	stats.WriteSize = size
+	stats.WithResponse = !noResponse
+	return stats
 }
 
 func (c *Connection) rx(p []byte) {
 	if time.Since(c.lastRx) > rxTimeout {
-		c.inputBuffer = []byte{}
+		c.decoder.Reset()
 	}
 	c.lastRx = time.Now()
-	c.inputBuffer = append(c.inputBuffer, p...)
+	c.decoder.Write(p)
 	for c.flush() {
 	}
 }
@@ -95,20 +254,32 @@ func (c *Connection) Send(ctx context.Context, buffer []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	var out []byte
-	log.Debug("TX: %02x", buffer)
-	out = append(out, uint8(len(buffer)>>8), uint8(len(buffer)))
-	out = append(out, buffer...)
-	blockLength := 20
-	for len(out) > 0 {
-		if blockLength > len(out) {
-			blockLength = len(out)
+	if c.state != StateConnected {
+		if c.options.Reconnect && c.ctx.Err() == nil {
+			return ErrReconnecting
 		}
-		if err := c.client.WriteCharacteristic(c.txChar, out[:blockLength], false); err != nil {
+		return protocol.ErrNotConnected
+	}
+
+	log.Debug("TX: %02x", buffer)
+	out, err := framing.Encode(buffer)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	pieces := chunks(out, c.writeSize)
+	for _, piece := range pieces {
+		if err := c.client.WriteCharacteristic(c.txChar, piece, c.noResponse); err != nil {
 			return err
 		}
-		out = out[blockLength:]
 	}
+
+	c.statsLock.Lock()
+	c.stats.MessagesSent++
+	c.stats.BytesSent += len(out)
+	c.stats.Writes += len(pieces)
+	c.stats.WriteDuration += time.Since(start)
+	c.statsLock.Unlock()
 	return nil
 }
 
@@ -116,77 +287,187 @@ func (c *Connection) VIN() string {
 	return c.vin
 }
 
+// NewConnection connects to the vehicle over BLE using the default Adapter.
+// The Connection does not attempt to reconnect if the link is lost; use
+// NewConnectionWithOptions for that.
 func NewConnection(ctx context.Context, vin string) (*Connection, error) {
-	var err error
-	// We don't want concurrent calls to NewConnection that would defeat
-	// the point of reusing the existing BLE device. Note that this is not
-	// an issue on MacOS, but multiple calls to newDevice() on Linux leads to failures.
+	return NewConnectionWithOptions(ctx, vin, Options{})
+}
+
+// NewConnectionWithOptions connects to the vehicle over BLE using the default
+// Adapter. The ctx only bounds the initial connection attempt.
+func NewConnectionWithOptions(ctx context.Context, vin string, options Options) (*Connection, error) {
+	adapter, err := getDefaultAdapter()
+	if err != nil {
+		return nil, err
+	}
+	return adapter.Connect(ctx, vin, options)
+}
+
+// getDefaultAdapter returns the Adapter shared by NewConnection and Scan,
+// creating it if necessary. The default Adapter is never closed; multiple
+// calls to newDevice() on Linux lead to failures.
+func getDefaultAdapter() (*Adapter, error) {
 	mu.Lock()
 	defer mu.Unlock()
-
-	if device != nil {
-		log.Debug("Reusing existing BLE device")
-	} else {
-		log.Debug("Creating new BLE device")
-		device, err = newDevice()
-		if err != nil {
-			return nil, fmt.Errorf("failed to find a BLE device: %s", err)
-		}
-		ble.SetDefaultDevice(device)
+	if defaultAdapter != nil {
+		return defaultAdapter, nil
 	}
+	adapter, err := NewAdapter()
+	if err != nil {
+		return nil, err
+	}
+	defaultAdapter = adapter
+	return defaultAdapter, nil
+}
 
-	vinBytes := []byte(vin)
-	digest := sha1.Sum(vinBytes)
+// connect establishes the BLE link and subscribes to vehicle notifications.
+// On success, it replaces the Connection's client and characteristics.
+func (c *Connection) connect(ctx context.Context) error {
+	client, err := c.adapter.dial(ctx, c.localName)
+	if err != nil {
+		return fmt.Errorf("failed to find BLE beacon for %s (%s): %w", c.vin, c.localName, err)
+	}
 
-	localName := fmt.Sprintf("S%02xC", digest[:8])
-	log.Debug("Searching for BLE beacon %s...", localName)
-	filter := func(adv ble.Advertisement) bool {
-		if !adv.Connectable() || adv.LocalName() != localName {
-			return false
-		}
-		return true
+	txChar, rxChar, err := c.discover(client)
+	if err != nil {
+		client.CancelConnection()
+		return err
 	}
 
-	log.Debug("Connecting to BLE beacon...")
-	client, err := ble.Connect(ctx, filter)
+	mtu, err := client.ExchangeMTU(maxMTU)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find BLE beacon for %s (%s): %s", vin, localName, err)
+		log.Warning("BLE MTU exchange failed, using default: %s", err)
+		mtu = defaultMTU
+	}
+	noResponse := c.options.WriteWithoutResponse && txChar.Property&ble.CharWriteNR != 0
+	if c.options.WriteWithoutResponse && !noResponse {
+		log.Debug("Vehicle requires BLE write requests")
 	}
+	log.Debug("BLE MTU is %d", mtu)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ctx != nil && c.ctx.Err() != nil {
+		// Close() was called while we were reconnecting.
+		client.ClearSubscriptions()
+		client.CancelConnection()
+		return c.ctx.Err()
+	}
+	c.client = client
+	c.txChar = txChar
+	c.rxChar = rxChar
+	c.mtu = mtu
+	c.writeSize = writeSize(mtu)
+	c.noResponse = noResponse
+	return nil
+}
 
+func (c *Connection) discover(client ble.Client) (txChar, rxChar *ble.Characteristic, err error) {
 	services, err := client.DiscoverServices([]ble.UUID{vehicleServiceUUID})
 	if err != nil {
-		return nil, fmt.Errorf("ble: failed to enumerate device services: %s", err)
+		return nil, nil, fmt.Errorf("ble: failed to enumerate device services: %s", err)
 	}
 	if len(services) == 0 {
-		return nil, fmt.Errorf("ble: failed to discover service")
+		return nil, nil, fmt.Errorf("ble: failed to discover service")
 	}
 
 	characteristics, err := client.DiscoverCharacteristics([]ble.UUID{toVehicleUUID, fromVehicleUUID}, services[0])
 	if err != nil {
-		return nil, fmt.Errorf("ble: failed to discover service characteristics: %s", err)
+		return nil, nil, fmt.Errorf("ble: failed to discover service characteristics: %s", err)
 	}
 
-	conn := Connection{
-		vin:    vin,
-		client: client,
-		inbox:  make(chan []byte, 5),
-	}
 	for _, characteristic := range characteristics {
 		if characteristic.UUID.Equal(toVehicleUUID) {
-			conn.txChar = characteristic
+			txChar = characteristic
 		} else if characteristic.UUID.Equal(fromVehicleUUID) {
-			conn.rxChar = characteristic
+			rxChar = characteristic
 		}
 		if _, err := client.DiscoverDescriptors(nil, characteristic); err != nil {
-			return nil, fmt.Errorf("ble: couldn't fetch descriptors: %s", err)
+			return nil, nil, fmt.Errorf("ble: couldn't fetch descriptors: %s", err)
 		}
 	}
-	if conn.txChar == nil || conn.rxChar == nil {
-		return nil, fmt.Errorf("ble: failed to find required characteristics")
+	if txChar == nil || rxChar == nil {
+		return nil, nil, fmt.Errorf("ble: failed to find required characteristics")
+	}
+	// Any partial message from a previous link is unrecoverable. The old
+	// client no longer delivers notifications, so the decoder is not in use.
+	c.decoder.Reset()
+	if err := client.Subscribe(rxChar, true, c.rx); err != nil {
+		return nil, nil, fmt.Errorf("ble: failed to subscribe to RX: %s", err)
+	}
+	return txChar, rxChar, nil
+}
+
+// monitor watches for link loss and, if enabled, reconnects. If the link is
+// lost and reconnection is disabled, c is removed from its Adapter, so that
+// the vehicle can be connected to again, and c's inbox is closed.
+func (c *Connection) monitor() {
+	for {
+		c.lock.Lock()
+		client := c.client
+		c.lock.Unlock()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-client.Disconnected():
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		log.Warning("Lost BLE connection to %s", c.vin)
+		c.setState(StateDisconnected)
+		if !c.options.Reconnect {
+			c.adapter.remove(c)
+			c.closeInbox()
+			return
+		}
+		if !c.reconnect() {
+			return
+		}
 	}
-	if err := client.Subscribe(conn.rxChar, true, conn.rx); err != nil {
-		return nil, fmt.Errorf("ble: failed to subscribe to RX: %s", err)
+}
+
+// reconnect retries connect with exponential backoff until it succeeds or the
+// Connection is closed. Returns true on success.
+func (c *Connection) reconnect() bool {
+	backoff := c.options.MinBackoff
+	if backoff <= 0 {
+		backoff = defaultMinBackoff
+	}
+	maxBackoff := c.options.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		c.setState(StateConnecting)
+		ctx, cancel := context.WithTimeout(c.ctx, reconnectTimeout)
+		err := c.connect(ctx)
+		cancel()
+		if err == nil {
+			c.setState(StateConnected)
+			log.Info("Reconnected to vehicle BLE")
+			return true
+		}
+		c.setState(StateDisconnected)
+		if c.ctx.Err() != nil {
+			return false
+		}
+		log.Warning("BLE reconnection attempt failed: %s", err)
+		backoff = nextBackoff(backoff, maxBackoff)
+	}
+}
+
+func nextBackoff(backoff, maxBackoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
 	}
-	log.Info("Connected to vehicle BLE")
-	return &conn, nil
+	return backoff
 }
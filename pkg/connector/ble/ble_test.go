@@ -0,0 +1,278 @@
+package ble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+
+	"github.com/greenmission/vehicle-command/internal/framing"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+)
+
+const testVIN = "5YJ3E1EA1JF000000"
+
+var errDialFailed = errors.New("dial failed")
+
+type dialResult struct {
+	client ble.Client
+	err    error
+}
+
+func (d *testDevice) Dial(ctx context.Context, addr ble.Addr) (ble.Client, error) {
+	select {
+	case result := <-d.dials:
+		return result.client, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// testClient simulates the vehicle end of a BLE link.
+type testClient struct {
+	ble.Client
+	disconnected chan struct{}
+	once         sync.Once
+
+	lock    sync.Mutex
+	written []byte
+	handler ble.NotificationHandler
+}
+
+func newTestClient() *testClient {
+	return &testClient{disconnected: make(chan struct{})}
+}
+
+func (c *testClient) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
+	return []*ble.Service{{UUID: vehicleServiceUUID}}, nil
+}
+
+func (c *testClient) DiscoverCharacteristics(filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
+	return []*ble.Characteristic{
+		{UUID: toVehicleUUID, Property: ble.CharWrite},
+		{UUID: fromVehicleUUID, Property: ble.CharIndicate},
+	}, nil
+}
+
+func (c *testClient) DiscoverDescriptors(filter []ble.UUID, char *ble.Characteristic) ([]*ble.Descriptor, error) {
+	return nil, nil
+}
+
+func (c *testClient) ExchangeMTU(rxMTU int) (int, error) {
+	return rxMTU, nil
+}
+
+func (c *testClient) Subscribe(char *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.handler = h
+	return nil
+}
+
+func (c *testClient) ClearSubscriptions() error {
+	return nil
+}
+
+func (c *testClient) WriteCharacteristic(char *ble.Characteristic, value []byte, noRsp bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.written = append(c.written, value...)
+	return nil
+}
+
+func (c *testClient) CancelConnection() error {
+	c.once.Do(func() { close(c.disconnected) })
+	return nil
+}
+
+func (c *testClient) Disconnected() <-chan struct{} {
+	return c.disconnected
+}
+
+// notify simulates the vehicle sending message.
+func (c *testClient) notify(t *testing.T, message []byte) {
+	t.Helper()
+	encoded, err := framing.Encode(message)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.lock.Lock()
+	handler := c.handler
+	c.lock.Unlock()
+	handler(encoded)
+}
+
+func newTestAdapter() (*Adapter, *testDevice) {
+	device := &testDevice{
+		advertisements: []ble.Advertisement{
+			&testAdvertisement{name: VehicleLocalName(testVIN), address: "aa:aa", connectable: true},
+		},
+		dials: make(chan dialResult, 1),
+	}
+	return NewAdapterWithDevice(device), device
+}
+
+// expectStates waits for OnStateChange to report each of expected, in order.
+func expectStates(t *testing.T, states <-chan State, expected ...State) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("Expected state %s but got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for state %s", want)
+		}
+	}
+}
+
+func TestConnectionReconnects(t *testing.T) {
+	adapter, device := newTestAdapter()
+	defer adapter.Close()
+
+	states := make(chan State, 16)
+	options := Options{
+		Reconnect:     true,
+		MinBackoff:    time.Millisecond,
+		MaxBackoff:    2 * time.Millisecond,
+		OnStateChange: func(state State) { states <- state },
+	}
+	first := newTestClient()
+	device.dials <- dialResult{client: first}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := adapter.Connect(ctx, testVIN, options)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectStates(t, states, StateConnecting, StateConnected)
+
+	// The vehicle drops the link. Send fails while the Connection is reconnecting.
+	disconnected := conn.Disconnected()
+	first.CancelConnection()
+	expectStates(t, states, StateDisconnected, StateConnecting)
+	select {
+	case <-disconnected:
+	default:
+		t.Errorf("Disconnected channel wasn't closed when the link dropped")
+	}
+	if err := conn.Send(ctx, []byte("hello")); !errors.Is(err, ErrReconnecting) {
+		t.Errorf("Expected ErrReconnecting but got %v", err)
+	}
+
+	// The first attempt fails, so the Connection backs off and tries again.
+	device.dials <- dialResult{err: errDialFailed}
+	expectStates(t, states, StateDisconnected, StateConnecting)
+	second := newTestClient()
+	device.dials <- dialResult{client: second}
+	expectStates(t, states, StateConnected)
+	if conn.Disconnected() == disconnected {
+		t.Errorf("New link reuses the old Disconnected channel")
+	}
+
+	// The same Connection now uses the new link in both directions.
+	if err := conn.Send(ctx, []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected, _ := framing.Encode([]byte("hello"))
+	if !bytes.Equal(second.written, expected) || len(first.written) != 0 {
+		t.Errorf("Message wasn't written to new link")
+	}
+	second.notify(t, []byte("world"))
+	select {
+	case message := <-conn.Receive():
+		if !bytes.Equal(message, []byte("world")) {
+			t.Errorf("Unexpected message: %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for message")
+	}
+
+	conn.Close()
+	expectStates(t, states, StateDisconnected)
+	if err := conn.Send(ctx, []byte("hello")); !errors.Is(err, protocol.ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected after Close but got %v", err)
+	}
+}
+
+func TestConnectionWithoutReconnect(t *testing.T) {
+	adapter, device := newTestAdapter()
+	defer adapter.Close()
+
+	states := make(chan State, 16)
+	client := newTestClient()
+	device.dials <- dialResult{client: client}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := adapter.Connect(ctx, testVIN, Options{OnStateChange: func(state State) { states <- state }})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	expectStates(t, states, StateConnecting, StateConnected)
+
+	client.CancelConnection()
+	expectStates(t, states, StateDisconnected)
+	if err := conn.Send(ctx, []byte("hello")); !errors.Is(err, protocol.ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected but got %v", err)
+	}
+	select {
+	case state := <-states:
+		t.Errorf("Unexpected state change to %s", state)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestLostConnectionClosesInbox(t *testing.T) {
+	adapter, device := newTestAdapter()
+	defer adapter.Close()
+
+	states := make(chan State, 16)
+	client := newTestClient()
+	device.dials <- dialResult{client: client}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := adapter.Connect(ctx, testVIN, Options{OnStateChange: func(state State) { states <- state }})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectStates(t, states, StateConnecting, StateConnected)
+
+	client.CancelConnection()
+	select {
+	case _, ok := <-conn.Receive():
+		if ok {
+			t.Errorf("Unexpected message after link loss")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Inbox wasn't closed after link loss")
+	}
+	if len(adapter.Connections()) != 0 {
+		t.Errorf("Lost Connection is still registered with the Adapter")
+	}
+	// Notifications that arrive after the link is lost are discarded.
+	client.notify(t, []byte("late"))
+
+	// The vehicle can be connected to again without closing the lost Connection first.
+	device.dials <- dialResult{client: newTestClient()}
+	again, err := adapter.Connect(ctx, testVIN, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	again.Close()
+	conn.Close()
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := time.Second
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff = nextBackoff(backoff, 5*time.Second); backoff != expected {
+			t.Errorf("Expected backoff %s but got %s", expected, backoff)
+		}
+	}
+}
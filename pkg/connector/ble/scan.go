@@ -0,0 +1,108 @@
+package ble
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/go-ble/ble"
+)
+
+var vehicleLocalNameRegEx = regexp.MustCompile(`^S[0-9a-f]{16}C$`)
+
+// Beacon describes a BLE advertisement broadcast by a vehicle.
+type Beacon struct {
+	LocalName   string
+	Address     string
+	RSSI        int
+	Connectable bool
+	// VIN is the candidate VIN that matches LocalName, or empty if the
+	// beacon did not match any of the VINs passed to Scan.
+	VIN string
+}
+
+// VehicleLocalName returns the BLE local name advertised by the vehicle with
+// the provided VIN.
+func VehicleLocalName(vin string) string {
+	digest := sha1.Sum([]byte(vin))
+	return fmt.Sprintf("S%02xC", digest[:8])
+}
+
+// IsVehicleLocalName returns true if name has the format of a vehicle's BLE
+// local name.
+func IsVehicleLocalName(name string) bool {
+	return vehicleLocalNameRegEx.MatchString(name)
+}
+
+// Scan uses the default Adapter to listen for vehicle beacons until ctx
+// expires. It returns the beacons
+// it found, ordered by decreasing signal strength. Since the VIN cannot be
+// recovered from a beacon, Scan matches beacons against the candidate vins.
+//
+// Expiration of ctx is the expected way to end a scan and is not reported as
+// an error.
+func Scan(ctx context.Context, vins []string) ([]Beacon, error) {
+	adapter, err := getDefaultAdapter()
+	if err != nil {
+		return nil, err
+	}
+	return adapter.Scan(ctx, vins)
+}
+
+// beaconSet collects advertisements, keeping the most recent one from each
+// address.
+type beaconSet struct {
+	vins    map[string]string
+	beacons map[string]*Beacon
+	lock    sync.Mutex
+}
+
+func newBeaconSet(vins []string) *beaconSet {
+	s := beaconSet{
+		vins:    make(map[string]string),
+		beacons: make(map[string]*Beacon),
+	}
+	for _, vin := range vins {
+		s.vins[VehicleLocalName(vin)] = vin
+	}
+	return &s
+}
+
+func (s *beaconSet) add(adv ble.Advertisement) {
+	name := adv.LocalName()
+	if !IsVehicleLocalName(name) {
+		return
+	}
+	address := adv.Addr().String()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	beacon, ok := s.beacons[address]
+	if !ok {
+		beacon = &Beacon{Address: address}
+		s.beacons[address] = beacon
+	}
+	beacon.LocalName = name
+	beacon.RSSI = adv.RSSI()
+	beacon.Connectable = adv.Connectable()
+	beacon.VIN = s.vins[name]
+}
+
+func (s *beaconSet) list() []Beacon {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	beacons := make([]Beacon, 0, len(s.beacons))
+	for _, beacon := range s.beacons {
+		beacons = append(beacons, *beacon)
+	}
+	sort.Slice(beacons, func(i, j int) bool {
+		if beacons[i].RSSI != beacons[j].RSSI {
+			return beacons[i].RSSI > beacons[j].RSSI
+		}
+		return beacons[i].Address < beacons[j].Address
+	})
+	return beacons
+}
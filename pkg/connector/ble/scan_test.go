@@ -0,0 +1,53 @@
+package ble
+
+import (
+	"testing"
+
+	"github.com/go-ble/ble"
+)
+
+type testAdvertisement struct {
+	ble.Advertisement
+	name        string
+	address     string
+	rssi        int
+	connectable bool
+}
+
+func (a *testAdvertisement) LocalName() string { return a.name }
+func (a *testAdvertisement) Addr() ble.Addr    { return ble.NewAddr(a.address) }
+func (a *testAdvertisement) RSSI() int         { return a.rssi }
+func (a *testAdvertisement) Connectable() bool { return a.connectable }
+
+func TestVehicleLocalName(t *testing.T) {
+	name := VehicleLocalName("5YJ3E1EA1JF000000")
+	if !IsVehicleLocalName(name) {
+		t.Errorf("Local name %s not recognized", name)
+	}
+	for _, name := range []string{"", "SC", "S0123456789abcdefD", "S0123456789ABCDEFC", "S0123456789abcdeC"} {
+		if IsVehicleLocalName(name) {
+			t.Errorf("Unexpected match for %s", name)
+		}
+	}
+}
+
+func TestBeaconSet(t *testing.T) {
+	const vin = "5YJ3E1EA1JF000000"
+	beacons := newBeaconSet([]string{vin, "5YJ3E1EA1JF000001"})
+	beacons.add(&testAdvertisement{name: VehicleLocalName(vin), address: "aa:aa", rssi: -80, connectable: false})
+	beacons.add(&testAdvertisement{name: VehicleLocalName("LRW3E1EA1JF000000"), address: "bb:bb", rssi: -70, connectable: true})
+	beacons.add(&testAdvertisement{name: "Not a car", address: "cc:cc", rssi: -10, connectable: true})
+	// Later advertisements from the same address replace earlier ones.
+	beacons.add(&testAdvertisement{name: VehicleLocalName(vin), address: "aa:aa", rssi: -50, connectable: true})
+
+	found := beacons.list()
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 beacons but found %d", len(found))
+	}
+	if found[0].Address != "aa:aa" || found[0].VIN != vin || found[0].RSSI != -50 || !found[0].Connectable {
+		t.Errorf("Unexpected beacon: %+v", found[0])
+	}
+	if found[1].Address != "bb:bb" || found[1].VIN != "" || found[1].RSSI != -70 {
+		t.Errorf("Unexpected beacon: %+v", found[1])
+	}
+}
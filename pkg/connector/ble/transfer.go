@@ -0,0 +1,75 @@
+package ble
+
+import (
+	"time"
+)
+
+const (
+	// attWriteHeaderLength is the number of bytes of each ATT packet consumed
+	// by the opcode and attribute handle of a write request.
+	attWriteHeaderLength = 3
+	// defaultMTU is the ATT MTU that all BLE devices must support.
+	defaultMTU = 23
+	// maxMTU is the ATT MTU requested when connecting to a vehicle.
+	maxMTU = 517
+	// maxAttributeLength is the largest value that can be written to a
+	// characteristic in a single request.
+	maxAttributeLength = 512
+)
+
+// writeSize returns the maximum number of bytes that can be written to a
+// characteristic in a single request given the negotiated ATT MTU.
+func writeSize(mtu int) int {
+	if mtu < defaultMTU {
+		mtu = defaultMTU
+	}
+	size := mtu - attWriteHeaderLength
+	if size > maxAttributeLength {
+		size = maxAttributeLength
+	}
+	return size
+}
+
+// chunks splits frame into consecutive slices of at most size bytes.
+func chunks(frame []byte, size int) [][]byte {
+	var out [][]byte
+	for len(frame) > size {
+		out = append(out, frame[:size])
+		frame = frame[size:]
+	}
+	if len(frame) > 0 {
+		out = append(out, frame)
+	}
+	return out
+}
+
+// Stats describes the traffic carried by a Connection.
+type Stats struct {
+	// MTU is the ATT MTU negotiated with the vehicle.
+	MTU int
+	// WriteSize is the number of bytes sent in each characteristic write.
+	WriteSize int
+	// WithResponse is true if writes wait for an acknowledgement from the
+	// vehicle.
+	WithResponse bool
+
+	MessagesSent     int
+	MessagesReceived int
+	// BytesSent and BytesReceived include framing overhead.
+	BytesSent     int
+	BytesReceived int
+	// Writes is the number of characteristic writes used to send
+	// MessagesSent.
+	Writes int
+	// WriteDuration is the total time spent sending messages.
+	WriteDuration time.Duration
+}
+
+// TxThroughput returns the average rate, in bytes per second, at which
+// messages were written to the vehicle.
+func (s *Stats) TxThroughput() float64 {
+	if s.WriteDuration <= 0 {
+		return 0
+	}
+	return float64(s.BytesSent) / s.WriteDuration.Seconds()
+}
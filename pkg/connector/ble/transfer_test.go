@@ -0,0 +1,65 @@
+package ble
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriteSize(t *testing.T) {
+	tests := []struct {
+		mtu  int
+		size int
+	}{
+		{0, 20},
+		{defaultMTU, 20},
+		{185, 182},
+		{247, 244},
+		{maxMTU, maxAttributeLength},
+		{1 << 16, maxAttributeLength},
+	}
+	for _, test := range tests {
+		if size := writeSize(test.mtu); size != test.size {
+			t.Errorf("writeSize(%d) = %d but expected %d", test.mtu, size, test.size)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	frame := make([]byte, 45)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	for _, size := range []int{1, 20, 44, 45, 46, 512} {
+		pieces := chunks(frame, size)
+		expected := (len(frame) + size - 1) / size
+		if len(pieces) != expected {
+			t.Errorf("Expected %d chunks of size %d but got %d", expected, size, len(pieces))
+		}
+		var joined []byte
+		for _, piece := range pieces {
+			if len(piece) > size || len(piece) == 0 {
+				t.Errorf("Chunk has invalid length %d (max %d)", len(piece), size)
+			}
+			joined = append(joined, piece...)
+		}
+		if !bytes.Equal(joined, frame) {
+			t.Errorf("Chunks of size %d don't reassemble to original frame", size)
+		}
+	}
+	if pieces := chunks(nil, 20); len(pieces) != 0 {
+		t.Errorf("Expected no chunks for empty frame")
+	}
+}
+
+func TestTxThroughput(t *testing.T) {
+	var stats Stats
+	if stats.TxThroughput() != 0 {
+		t.Errorf("Expected zero throughput before any writes")
+	}
+	stats.BytesSent = 1000
+	stats.WriteDuration = 500 * time.Millisecond
+	if rate := stats.TxThroughput(); rate != 2000 {
+		t.Errorf("Unexpected throughput: %f", rate)
+	}
+}
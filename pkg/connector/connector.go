@@ -19,7 +19,7 @@ const (
 	AuthMethodHMAC
 )
 
-// BufferSize is the number of inbound messages that can be queued.
+// BufferSize is the default number of inbound messages that can be queued.
 const BufferSize = 5
 
 // MaxResponseLength caps the maximum byte-length of responses that connectors must support.
@@ -0,0 +1,24 @@
+package connector
+
+import (
+	"context"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries a correlation ID. Connectors and the dispatcher
+// include the ID in log messages, and HTTP-based connectors forward it to the server, which makes
+// it possible to match up log entries for a single client request across components.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the correlation ID attached to ctx using WithRequestID, or an empty string if
+// there isn't one.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
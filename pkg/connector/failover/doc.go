@@ -0,0 +1,23 @@
+/*
+Package failover implements a Connector that sends messages to a vehicle over a local transport,
+typically BLE, when the vehicle is in range, and over a remote transport, typically Fleet API,
+otherwise.
+
+Sessions with the vehicle are end-to-end: the epoch, clock and anti-replay counter of a session do
+not depend on the transport that carries a command. A single [vehicle.Vehicle] therefore keeps its
+sessions when a [Connection] switches transports.
+
+The two transports typically prefer different authentication methods. Fleet API requires
+HMAC-authenticated commands so that Tesla's servers can verify them, while BLE uses AES-GCM. A
+Connection reports the preference of the transport it is currently using. If the local transport
+fails after a command has been encrypted for it, Send returns [ErrTransportChanged]. The message is
+not retransmitted; instead, [vehicle.Vehicle] methods authorize the command again using the remote
+transport's authentication method. [vehicle.Vehicle.Send] uses the AuthMethod chosen by its
+caller for every attempt, so callers should pass the Connection's current PreferredAuthMethod.
+
+The local transport is considered unavailable after any Send error that guarantees the message
+was not delivered, when it closes its Receive channel, or, for Connectors that report link loss
+such as [ble.Connection], when its link drops. While using the remote transport, the Connection
+periodically attempts to re-establish the local transport.
+*/
+package failover
@@ -0,0 +1,290 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+var (
+	defaultProbeInterval = 30 * time.Second
+	defaultDialTimeout   = 10 * time.Second
+)
+
+// ErrTransportChanged indicates a message was authenticated for a transport that is no longer
+// available. The message was not sent. It's the same error as protocol.ErrTransportChanged, which
+// the dispatcher returns without retransmitting the message.
+var ErrTransportChanged = protocol.ErrTransportChanged
+
+var (
+	// errLocalClosed indicates the local connection closed its inbox, for example because the
+	// vehicle went out of range.
+	errLocalClosed = errors.New("connection closed")
+	// errLinkLost indicates the local connection reported that its link dropped.
+	errLinkLost = errors.New("link lost")
+)
+
+// linkMonitor is implemented by local Connectors that can report link loss while keeping their
+// inbox open, such as a ble.Connection that reconnects automatically.
+type linkMonitor interface {
+	// Disconnected returns a channel that is closed when the current link drops.
+	Disconnected() <-chan struct{}
+}
+
+// DialFunc establishes a local connection to the vehicle with the provided VIN.
+type DialFunc func(ctx context.Context, vin string) (connector.Connector, error)
+
+// Config controls when a Connection switches transports. The zero value is valid.
+type Config struct {
+	// ProbeInterval is how often to attempt to establish a local connection while using the
+	// remote transport. Defaults to 30 seconds.
+	ProbeInterval time.Duration
+	// DialTimeout bounds each local connection attempt. Defaults to 10 seconds.
+	DialTimeout time.Duration
+	// OnSwitch, if not nil, is invoked with the new value of UsingLocal each time the Connection
+	// switches transports. It may be called from a background goroutine and must not block.
+	OnSwitch func(local bool)
+}
+
+// Connection is a connector.Connector that prefers a local transport and falls back to a remote
+// one.
+type Connection struct {
+	vin    string
+	remote connector.Connector
+	dial   DialFunc
+	config Config
+	inbox  chan []byte
+
+	lock sync.Mutex
+	// local is nil while the local transport is unavailable.
+	local     connector.Connector
+	localDone chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// fleetAPIConnection preserves the Fleet API methods of the remote Connector.
+type fleetAPIConnection struct {
+	*Connection
+	fleetAPI connector.FleetAPIConnector
+}
+
+func (f *fleetAPIConnection) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
+	return f.fleetAPI.SendFleetAPICommand(ctx, endpoint, command)
+}
+
+func (f *fleetAPIConnection) Wakeup(ctx context.Context) error {
+	return f.fleetAPI.Wakeup(ctx)
+}
+
+// New returns a Connector that uses the local connection created by dial when possible, and remote
+// otherwise. New makes one attempt to dial the local connection, bounded by ctx and
+// config.DialTimeout, before returning. The config may be nil.
+//
+// If remote implements connector.FleetAPIConnector, so does the returned Connector. Note that
+// vehicle.Vehicle treats such Connectors as Fleet API connections even while the local transport
+// is in use; for example, it does not permit add-key requests.
+func New(ctx context.Context, remote connector.Connector, dial DialFunc, config *Config) connector.Connector {
+	c := &Connection{
+		vin:    remote.VIN(),
+		remote: remote,
+		dial:   dial,
+		inbox:  make(chan []byte, connector.BufferSize),
+	}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.ProbeInterval <= 0 {
+		c.config.ProbeInterval = defaultProbeInterval
+	}
+	if c.config.DialTimeout <= 0 {
+		c.config.DialTimeout = defaultDialTimeout
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.forward(remote, c.ctx.Done())
+	c.dialLocal(ctx)
+	go c.probe()
+
+	if fleetAPI, ok := remote.(connector.FleetAPIConnector); ok {
+		return &fleetAPIConnection{Connection: c, fleetAPI: fleetAPI}
+	}
+	return c
+}
+
+// UsingLocal returns true if messages are currently sent using the local transport.
+func (c *Connection) UsingLocal() bool {
+	return c.activeLocal() != nil
+}
+
+func (c *Connection) activeLocal() connector.Connector {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.local
+}
+
+func (c *Connection) active() connector.Connector {
+	if local := c.activeLocal(); local != nil {
+		return local
+	}
+	return c.remote
+}
+
+func (c *Connection) notify(local bool) {
+	if local {
+		log.Info("Switched to local connection to %s", c.vin)
+	} else {
+		log.Info("Switched to remote connection to %s", c.vin)
+	}
+	if c.config.OnSwitch != nil {
+		c.config.OnSwitch(local)
+	}
+}
+
+// forward copies messages from conn to c's inbox until done is closed. If conn closes its inbox,
+// forward stops, and switches to the remote transport if conn was the local one. If the local
+// conn implements linkMonitor, forward also switches as soon as its link drops.
+func (c *Connection) forward(conn connector.Connector, done <-chan struct{}) {
+	var lost <-chan struct{}
+	if monitor, ok := conn.(linkMonitor); ok && conn != c.remote {
+		lost = monitor.Disconnected()
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-lost:
+			c.dropLocal(conn, errLinkLost)
+			return
+		case message, ok := <-conn.Receive():
+			if !ok {
+				if conn != c.remote {
+					c.dropLocal(conn, errLocalClosed)
+				}
+				return
+			}
+			select {
+			case c.inbox <- message:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (c *Connection) dialLocal(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.DialTimeout)
+	defer cancel()
+	local, err := c.dial(ctx, c.vin)
+	if err != nil {
+		log.Debug("Local connection to %s unavailable: %s", c.vin, err)
+		return
+	}
+
+	c.lock.Lock()
+	if c.ctx.Err() != nil || c.local != nil {
+		c.lock.Unlock()
+		local.Close()
+		return
+	}
+	c.local = local
+	c.localDone = make(chan struct{})
+	go c.forward(local, c.localDone)
+	c.lock.Unlock()
+	c.notify(true)
+}
+
+// dropLocal stops using local, which failed with err.
+func (c *Connection) dropLocal(local connector.Connector, err error) {
+	c.lock.Lock()
+	if c.local != local {
+		c.lock.Unlock()
+		return
+	}
+	c.local = nil
+	close(c.localDone)
+	c.lock.Unlock()
+
+	log.Warning("Local connection to %s failed: %s", c.vin, err)
+	local.Close()
+	c.notify(false)
+}
+
+// probe periodically attempts to re-establish the local connection.
+func (c *Connection) probe() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.config.ProbeInterval):
+		}
+		if c.activeLocal() == nil {
+			c.dialLocal(c.ctx)
+		}
+	}
+}
+
+// requiresLocal returns true if buffer contains a message encrypted for the local transport.
+func requiresLocal(buffer []byte) bool {
+	var message universal.RoutableMessage
+	if err := proto.Unmarshal(buffer, &message); err != nil {
+		return false
+	}
+	_, ok := message.GetSignatureData().GetSigType().(*signatures.SignatureData_AES_GCM_PersonalizedData)
+	return ok
+}
+
+func (c *Connection) Send(ctx context.Context, buffer []byte) error {
+	if local := c.activeLocal(); local != nil {
+		err := local.Send(ctx, buffer)
+		if err == nil || protocol.MayHaveSucceeded(err) {
+			return err
+		}
+		c.dropLocal(local, err)
+	}
+	if requiresLocal(buffer) {
+		return ErrTransportChanged
+	}
+	return c.remote.Send(ctx, buffer)
+}
+
+func (c *Connection) Receive() <-chan []byte {
+	return c.inbox
+}
+
+func (c *Connection) VIN() string {
+	return c.vin
+}
+
+func (c *Connection) PreferredAuthMethod() connector.AuthMethod {
+	return c.active().PreferredAuthMethod()
+}
+
+func (c *Connection) RetryInterval() time.Duration {
+	return c.active().RetryInterval()
+}
+
+func (c *Connection) Close() {
+	c.cancel()
+	c.lock.Lock()
+	local := c.local
+	c.local = nil
+	if local != nil {
+		close(c.localDone)
+	}
+	c.lock.Unlock()
+	if local != nil {
+		local.Close()
+	}
+	c.remote.Close()
+}
@@ -0,0 +1,301 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/connectortest"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+func dialer(local *connectortest.Connector) DialFunc {
+	return func(ctx context.Context, vin string) (connector.Connector, error) {
+		return local, nil
+	}
+}
+
+func encodeMessage(t *testing.T, sigData *signatures.SignatureData) []byte {
+	t.Helper()
+	encoded, err := proto.Marshal(&universal.RoutableMessage{SubSigData: &universal.RoutableMessage_SignatureData{SignatureData: sigData}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func gcmMessage(t *testing.T) []byte {
+	return encodeMessage(t, &signatures.SignatureData{
+		SigType: &signatures.SignatureData_AES_GCM_PersonalizedData{
+			AES_GCM_PersonalizedData: &signatures.AES_GCM_Personalized_Signature_Data{Counter: 1},
+		},
+	})
+}
+
+func hmacMessage(t *testing.T) []byte {
+	return encodeMessage(t, &signatures.SignatureData{
+		SigType: &signatures.SignatureData_HMAC_PersonalizedData{
+			HMAC_PersonalizedData: &signatures.HMAC_Personalized_Signature_Data{Counter: 1},
+		},
+	})
+}
+
+func TestPrefersLocal(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	conn := New(context.Background(), remote, dialer(local), nil)
+	defer conn.Close()
+
+	if conn.PreferredAuthMethod() != connector.AuthMethodGCM {
+		t.Errorf("Expected local auth method")
+	}
+	if err := conn.Send(context.Background(), gcmMessage(t)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(local.Sent()) != 1 || len(remote.Sent()) != 0 {
+		t.Errorf("Message not sent over local transport")
+	}
+}
+
+func TestFallbackToRemote(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	var switches []bool
+	conn := New(context.Background(), remote, dialer(local), &Config{
+		ProbeInterval: time.Hour,
+		OnSwitch:      func(l bool) { switches = append(switches, l) },
+	})
+	defer conn.Close()
+
+	local.SetSendError(protocol.ErrNotConnected)
+	if err := conn.Send(context.Background(), hmacMessage(t)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(remote.Sent()) != 1 {
+		t.Errorf("Message not sent over remote transport")
+	}
+	if !local.Closed() {
+		t.Errorf("Failed local transport wasn't closed")
+	}
+	if conn.PreferredAuthMethod() != connector.AuthMethodHMAC {
+		t.Errorf("Expected remote auth method")
+	}
+	if len(switches) != 2 || !switches[0] || switches[1] {
+		t.Errorf("Unexpected switches: %v", switches)
+	}
+}
+
+func TestEncryptedMessageNotSentRemotely(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	conn := New(context.Background(), remote, dialer(local), &Config{ProbeInterval: time.Hour})
+	defer conn.Close()
+
+	local.SetSendError(protocol.ErrNotConnected)
+	err := conn.Send(context.Background(), gcmMessage(t))
+	if !errors.Is(err, ErrTransportChanged) {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !protocol.ShouldRetry(err) {
+		t.Errorf("Expected temporary error")
+	}
+	if len(remote.Sent()) != 0 {
+		t.Errorf("Encrypted message sent over remote transport")
+	}
+}
+
+func TestAmbiguousLocalErrorNotRetried(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	conn := New(context.Background(), remote, dialer(local), &Config{ProbeInterval: time.Hour})
+	defer conn.Close()
+
+	errTimeout := protocol.NewError("test: write timed out", true, true)
+	local.SetSendError(errTimeout)
+	if err := conn.Send(context.Background(), hmacMessage(t)); !errors.Is(err, errTimeout) {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(remote.Sent()) != 0 {
+		t.Errorf("Message that may have been delivered was sent again")
+	}
+	if !conn.(*Connection).UsingLocal() {
+		t.Errorf("Ambiguous error shouldn't cause failover")
+	}
+}
+
+func TestSwitchBackToLocal(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	var lock sync.Mutex
+	available := false
+	dial := func(ctx context.Context, vin string) (connector.Connector, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !available {
+			return nil, protocol.ErrNotConnected
+		}
+		return local, nil
+	}
+	switched := make(chan bool, 1)
+	conn := New(context.Background(), remote, dial, &Config{
+		ProbeInterval: time.Millisecond,
+		OnSwitch:      func(l bool) { switched <- l },
+	}).(*Connection)
+	defer conn.Close()
+
+	if conn.UsingLocal() {
+		t.Fatalf("Local transport used before it was available")
+	}
+	lock.Lock()
+	available = true
+	lock.Unlock()
+
+	select {
+	case l := <-switched:
+		if !l {
+			t.Errorf("Switched to wrong transport")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Didn't switch to local transport")
+	}
+	if err := conn.Send(context.Background(), gcmMessage(t)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(local.Sent()) != 1 {
+		t.Errorf("Message not sent over local transport")
+	}
+}
+
+func TestReceiveFromBothTransports(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	conn := New(context.Background(), remote, dialer(local), nil)
+	defer conn.Close()
+
+	local.Deliver([]byte("local"))
+	remote.Deliver([]byte("remote"))
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-conn.Receive():
+			received[string(message)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for message")
+		}
+	}
+	if !received["local"] || !received["remote"] {
+		t.Errorf("Unexpected messages: %v", received)
+	}
+}
+
+func TestLocalInboxClosed(t *testing.T) {
+	local := connectortest.New(connector.AuthMethodGCM, nil)
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	switched := make(chan bool, 1)
+	conn := New(context.Background(), remote, dialer(local), &Config{
+		ProbeInterval: time.Hour,
+		OnSwitch:      func(l bool) { switched <- l },
+	}).(*Connection)
+	defer conn.Close()
+	<-switched
+
+	local.CloseInbox()
+	select {
+	case l := <-switched:
+		if l {
+			t.Errorf("Switched to wrong transport")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Didn't switch to remote transport")
+	}
+	if !local.Closed() {
+		t.Errorf("Local connection wasn't closed")
+	}
+
+	remote.Deliver([]byte("remote"))
+	select {
+	case message := <-conn.Receive():
+		if string(message) != "remote" {
+			t.Errorf("Unexpected message: %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+	if err := conn.Send(context.Background(), hmacMessage(t)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(remote.Sent()) != 1 || len(local.Sent()) != 0 {
+		t.Errorf("Message not sent over remote transport")
+	}
+}
+
+// monitoredConnector reports link loss without closing its inbox, like a ble.Connection that
+// reconnects automatically.
+type monitoredConnector struct {
+	*connectortest.Connector
+	disconnected chan struct{}
+}
+
+func (m *monitoredConnector) Disconnected() <-chan struct{} {
+	return m.disconnected
+}
+
+func TestLocalLinkLost(t *testing.T) {
+	local := &monitoredConnector{
+		Connector:    connectortest.New(connector.AuthMethodGCM, nil),
+		disconnected: make(chan struct{}),
+	}
+	remote := connectortest.New(connector.AuthMethodHMAC, nil)
+	dial := func(ctx context.Context, vin string) (connector.Connector, error) {
+		return local, nil
+	}
+	switched := make(chan bool, 1)
+	conn := New(context.Background(), remote, dial, &Config{
+		ProbeInterval: time.Hour,
+		OnSwitch:      func(l bool) { switched <- l },
+	}).(*Connection)
+	defer conn.Close()
+	<-switched
+
+	close(local.disconnected)
+	select {
+	case l := <-switched:
+		if l {
+			t.Errorf("Switched to wrong transport")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Didn't switch to remote transport")
+	}
+	if !local.Closed() {
+		t.Errorf("Local connection wasn't closed")
+	}
+	if conn.PreferredAuthMethod() != connector.AuthMethodHMAC {
+		t.Errorf("Expected remote auth method")
+	}
+}
+
+func TestFleetAPIPreserved(t *testing.T) {
+	remote := connectortest.NewFleetAPI(connector.AuthMethodHMAC, nil)
+	dial := func(ctx context.Context, vin string) (connector.Connector, error) {
+		return nil, protocol.ErrNotConnected
+	}
+	conn := New(context.Background(), remote, dial, nil)
+	defer conn.Close()
+	fleetAPI, ok := conn.(connector.FleetAPIConnector)
+	if !ok {
+		t.Fatalf("Fleet API methods not preserved")
+	}
+	if err := fleetAPI.Wakeup(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if remote.Wakeups() != 1 {
+		t.Errorf("Wakeup not forwarded")
+	}
+}
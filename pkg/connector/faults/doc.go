@@ -0,0 +1,15 @@
+/*
+Package faults wraps a Connector in order to inject transport faults for resilience testing.
+
+An [Injector] applies faults according to a seeded pseudo-random schedule, so a failing test can
+be reproduced by reusing its seed. Individual faults can also be queued using [Injector.Inject].
+
+Faults that occur before a message is delivered (ErrBusy, vehicle-not-awake errors, HTTP errors
+that guarantee the request was rejected, and dropped requests) are returned by Send without
+forwarding the message to the wrapped Connector. HTTP errors that leave the outcome ambiguous, such
+as 500 Internal Server Error, are returned after the message has been delivered. Response faults
+(delays, drops, duplicates, reordering and truncation) are applied to datagrams received from the
+wrapped Connector. If the wrapped Connector implements connector.FleetAPIConnector, Fleet API
+REST calls are forwarded without faults.
+*/
+package faults
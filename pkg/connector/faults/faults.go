@@ -0,0 +1,336 @@
+package faults
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+)
+
+// Fault enumerates the types of faults an Injector can apply.
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	// FaultDropRequest discards an outbound message but reports success.
+	FaultDropRequest
+	// FaultBusy returns protocol.ErrBusy without delivering the message.
+	FaultBusy
+	// FaultNotAwake returns inet.ErrVehicleNotAwake without delivering the message.
+	FaultNotAwake
+	// FaultHTTPError returns an inet.HttpError with a code from Config.HTTPErrorCodes.
+	FaultHTTPError
+	// FaultDropResponse discards an inbound message.
+	FaultDropResponse
+	// FaultDuplicateResponse delivers an inbound message twice.
+	FaultDuplicateResponse
+	// FaultReorderResponse holds an inbound message until after the next one is delivered.
+	FaultReorderResponse
+	// FaultTruncateResponse delivers a random prefix of an inbound message.
+	FaultTruncateResponse
+)
+
+var faultNames = map[Fault]string{
+	FaultNone:              "none",
+	FaultDropRequest:       "drop-request",
+	FaultBusy:              "busy",
+	FaultNotAwake:          "not-awake",
+	FaultHTTPError:         "http-error",
+	FaultDropResponse:      "drop-response",
+	FaultDuplicateResponse: "duplicate-response",
+	FaultReorderResponse:   "reorder-response",
+	FaultTruncateResponse:  "truncate-response",
+}
+
+func (f Fault) String() string {
+	return faultNames[f]
+}
+
+func (f Fault) affectsRequest() bool {
+	return f >= FaultDropRequest && f <= FaultHTTPError
+}
+
+// Config controls the probability of each fault. Probabilities are evaluated independently in the
+// order the fields are listed, and the first fault selected is applied.
+type Config struct {
+	// Seed initializes the pseudo-random schedule.
+	Seed int64
+
+	// MaxLatency is the upper bound of a uniformly distributed delay added to each Send and to each
+	// inbound message.
+	MaxLatency time.Duration
+
+	DropRequest float64
+	Busy        float64
+	NotAwake    float64
+	HTTPError   float64
+	// HTTPErrorCodes are chosen from uniformly when injecting FaultHTTPError. Defaults to 429, 500,
+	// and 503.
+	HTTPErrorCodes []int
+
+	DropResponse      float64
+	DuplicateResponse float64
+	ReorderResponse   float64
+	TruncateResponse  float64
+}
+
+// Connector is a connector.Connector that injects faults. It's returned by New.
+type Connector interface {
+	connector.Connector
+	// Inject queues faults to be applied ahead of the pseudo-random schedule.
+	Inject(faults ...Fault)
+	// Injected returns the number of times fault has been applied.
+	Injected(fault Fault) int
+}
+
+// Injector implements connector.Connector by wrapping another Connector and injecting faults.
+type Injector struct {
+	conn   connector.Connector
+	config Config
+	inbox  chan []byte
+
+	lock     sync.Mutex
+	rng      *rand.Rand
+	queued   []Fault
+	injected map[Fault]int
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// fleetAPIInjector preserves the Fleet API methods of the Connector wrapped by an Injector. Faults
+// aren't injected into Fleet API REST calls.
+type fleetAPIInjector struct {
+	*Injector
+	fleetAPI connector.FleetAPIConnector
+}
+
+func (f *fleetAPIInjector) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
+	return f.fleetAPI.SendFleetAPICommand(ctx, endpoint, command)
+}
+
+func (f *fleetAPIInjector) Wakeup(ctx context.Context) error {
+	return f.fleetAPI.Wakeup(ctx)
+}
+
+// New wraps conn in an Injector.
+//
+// If conn implements connector.FleetAPIConnector, so does the returned Connector.
+func New(conn connector.Connector, config Config) Connector {
+	if len(config.HTTPErrorCodes) == 0 {
+		config.HTTPErrorCodes = []int{429, 500, 503}
+	}
+	i := Injector{
+		conn:     conn,
+		config:   config,
+		inbox:    make(chan []byte, connector.BufferSize),
+		rng:      rand.New(rand.NewSource(config.Seed)),
+		injected: make(map[Fault]int),
+		done:     make(chan struct{}),
+	}
+	go i.listen()
+	if fleetAPI, ok := conn.(connector.FleetAPIConnector); ok {
+		return &fleetAPIInjector{Injector: &i, fleetAPI: fleetAPI}
+	}
+	return &i
+}
+
+// Inject queues faults to be applied ahead of the pseudo-random schedule. Request faults are
+// consumed by Send, and response faults are consumed by inbound messages.
+func (i *Injector) Inject(faults ...Fault) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.queued = append(i.queued, faults...)
+}
+
+// Injected returns the number of times fault has been applied.
+func (i *Injector) Injected(fault Fault) int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.injected[fault]
+}
+
+// next selects the next request fault (if request is true) or response fault.
+func (i *Injector) next(request bool) (Fault, time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var delay time.Duration
+	if i.config.MaxLatency > 0 {
+		delay = time.Duration(i.rng.Int63n(int64(i.config.MaxLatency)))
+	}
+	for index, fault := range i.queued {
+		if fault.affectsRequest() == request {
+			i.queued = append(i.queued[:index], i.queued[index+1:]...)
+			i.injected[fault]++
+			return fault, delay
+		}
+	}
+
+	var candidates []Fault
+	var probabilities []float64
+	if request {
+		candidates = []Fault{FaultDropRequest, FaultBusy, FaultNotAwake, FaultHTTPError}
+		probabilities = []float64{i.config.DropRequest, i.config.Busy, i.config.NotAwake, i.config.HTTPError}
+	} else {
+		candidates = []Fault{FaultDropResponse, FaultDuplicateResponse, FaultReorderResponse, FaultTruncateResponse}
+		probabilities = []float64{i.config.DropResponse, i.config.DuplicateResponse, i.config.ReorderResponse, i.config.TruncateResponse}
+	}
+	// Always draw the same number of values so that the schedule for one fault type doesn't
+	// depend on the probabilities configured for the others.
+	selected := FaultNone
+	for index, p := range probabilities {
+		if i.rng.Float64() < p && selected == FaultNone {
+			selected = candidates[index]
+		}
+	}
+	if selected != FaultNone {
+		i.injected[selected]++
+	}
+	return selected, delay
+}
+
+func (i *Injector) httpError() *inet.HttpError {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return &inet.HttpError{Code: i.config.HTTPErrorCodes[i.rng.Intn(len(i.config.HTTPErrorCodes))]}
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return &protocol.CommandError{Err: ctx.Err(), PossibleSuccess: false, PossibleTemporary: true}
+	}
+}
+
+func (i *Injector) Send(ctx context.Context, buffer []byte) error {
+	fault, delay := i.next(true)
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	if fault != FaultNone {
+		log.Debug("Injecting %s fault", fault)
+	}
+	switch fault {
+	case FaultDropRequest:
+		return nil
+	case FaultBusy:
+		return protocol.ErrBusy
+	case FaultNotAwake:
+		return inet.ErrVehicleNotAwake
+	case FaultHTTPError:
+		httpErr := i.httpError()
+		if !httpErr.MayHaveSucceeded() {
+			return httpErr
+		}
+		if err := i.conn.Send(ctx, buffer); err != nil {
+			return err
+		}
+		return httpErr
+	}
+	return i.conn.Send(ctx, buffer)
+}
+
+func (i *Injector) deliver(message []byte) bool {
+	select {
+	case i.inbox <- message:
+		return true
+	case <-i.done:
+		return false
+	}
+}
+
+func (i *Injector) listen() {
+	defer close(i.inbox)
+	var held []byte
+	for {
+		var message []byte
+		var ok bool
+		select {
+		case message, ok = <-i.conn.Receive():
+			if !ok {
+				if held != nil {
+					i.deliver(held)
+				}
+				return
+			}
+		case <-i.done:
+			return
+		}
+
+		fault, delay := i.next(false)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-i.done:
+				return
+			}
+		}
+		if fault != FaultNone {
+			log.Debug("Injecting %s fault", fault)
+		}
+		switch fault {
+		case FaultDropResponse:
+			continue
+		case FaultDuplicateResponse:
+			duplicate := make([]byte, len(message))
+			copy(duplicate, message)
+			if !i.deliver(duplicate) {
+				return
+			}
+		case FaultReorderResponse:
+			if held == nil {
+				held = message
+				continue
+			}
+		case FaultTruncateResponse:
+			if len(message) > 0 {
+				i.lock.Lock()
+				message = message[:i.rng.Intn(len(message))]
+				i.lock.Unlock()
+			}
+		}
+		if !i.deliver(message) {
+			return
+		}
+		if held != nil {
+			if !i.deliver(held) {
+				return
+			}
+			held = nil
+		}
+	}
+}
+
+func (i *Injector) Receive() <-chan []byte {
+	return i.inbox
+}
+
+func (i *Injector) VIN() string {
+	return i.conn.VIN()
+}
+
+func (i *Injector) Close() {
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.conn.Close()
+	})
+}
+
+func (i *Injector) PreferredAuthMethod() connector.AuthMethod {
+	return i.conn.PreferredAuthMethod()
+}
+
+func (i *Injector) RetryInterval() time.Duration {
+	return i.conn.RetryInterval()
+}
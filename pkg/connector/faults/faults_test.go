@@ -0,0 +1,201 @@
+package faults
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/internal/connectortest"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+	"github.com/greenmission/vehicle-command/pkg/vehicle"
+
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+// newSimulator returns a Connector that passes messages to sim.
+func newSimulator(sim *connectortest.Vehicle) *connectortest.Connector {
+	return connectortest.New(connector.AuthMethodHMAC, sim.Handle)
+}
+
+func faultyConfig(seed int64) Config {
+	return Config{
+		Seed:              seed,
+		MaxLatency:        time.Millisecond,
+		DropRequest:       0.05,
+		Busy:              0.1,
+		NotAwake:          0.05,
+		HTTPError:         0.1,
+		DropResponse:      0.05,
+		DuplicateResponse: 0.1,
+		ReorderResponse:   0.1,
+		TruncateResponse:  0.05,
+	}
+}
+
+// checkCommandsExecutedOnce sends commands to sim through car, and verifies that none are
+// executed more than once and that every command that succeeds was executed. If reset is not nil,
+// it's invoked before each command.
+func checkCommandsExecutedOnce(t *testing.T, seed int64, sim *connectortest.Vehicle, car *vehicle.Vehicle, auth connector.AuthMethod, reset func(n int)) {
+	t.Helper()
+	const commandCount = 20
+	for n := 0; n < commandCount; n++ {
+		if reset != nil {
+			reset(n)
+		}
+		payload := []byte(fmt.Sprintf("command %d", n))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		reply, err := car.Send(ctx, protocol.DomainInfotainment, payload, auth)
+		cancel()
+
+		executions := sim.Executions(payload)
+		if executions > 1 {
+			t.Errorf("Seed %d: %s executed %d times", seed, payload, executions)
+		}
+		if err == nil {
+			if executions != 1 {
+				t.Errorf("Seed %d: %s succeeded but executed %d times", seed, payload, executions)
+			}
+			if !bytes.Equal(reply, payload) {
+				t.Errorf("Seed %d: %s received reply %s", seed, payload, reply)
+			}
+		}
+	}
+}
+
+func TestCommandsNeverExecutedTwice(t *testing.T) {
+	for seed := int64(1); seed <= 8; seed++ {
+		sim := connectortest.NewVehicle()
+		car, err := vehicle.NewVehicle(New(newSimulator(sim), faultyConfig(seed)), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := car.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		checkCommandsExecutedOnce(t, seed, sim, car, connector.AuthMethodNone, nil)
+		car.Disconnect()
+	}
+}
+
+func TestAuthenticatedCommandsNeverExecutedTwice(t *testing.T) {
+	domains := []universal.Domain{protocol.DomainInfotainment}
+	for seed := int64(1); seed <= 8; seed++ {
+		sim, err := connectortest.NewAuthenticatedVehicle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := authentication.NewECDHPrivateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		car, err := vehicle.NewVehicle(New(newSimulator(sim), faultyConfig(seed)), key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := car.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// Handshake responses can be lost, so retry the handshake with a timeout as a client would.
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			err = car.StartSession(ctx, domains)
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt == 20 {
+				t.Fatalf("Seed %d: Unexpected error starting session: %s", seed, err)
+			}
+		}
+		// Periodically starting a new epoch forces the Vehicle to resynchronize its session using
+		// the session info attached to the error response, and then retry the command.
+		checkCommandsExecutedOnce(t, seed, sim, car, connector.AuthMethodHMAC, func(n int) {
+			if n%7 == 6 {
+				sim.ResetSessions()
+			}
+		})
+		car.Disconnect()
+	}
+}
+
+func TestInjectQueuedFaults(t *testing.T) {
+	injector := New(newSimulator(connectortest.NewVehicle()), Config{})
+	defer injector.Close()
+
+	ctx := context.Background()
+	injector.Inject(FaultBusy, FaultDuplicateResponse)
+	if err := injector.Send(ctx, []byte{}); !errors.Is(err, protocol.ErrBusy) {
+		t.Errorf("Expected ErrBusy but got %v", err)
+	}
+	if err := injector.Send(ctx, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		select {
+		case <-injector.Receive():
+		case <-time.After(time.Second):
+			t.Fatalf("Expected duplicated response")
+		}
+	}
+	if injector.Injected(FaultBusy) != 1 || injector.Injected(FaultDuplicateResponse) != 1 {
+		t.Errorf("Unexpected fault counts")
+	}
+}
+
+func TestSeedIsDeterministic(t *testing.T) {
+	config := Config{Seed: 42, Busy: 0.5, NotAwake: 0.5}
+	a := New(connectortest.New(connector.AuthMethodHMAC, nil), config).(*Injector)
+	b := New(connectortest.New(connector.AuthMethodHMAC, nil), config).(*Injector)
+	defer a.Close()
+	defer b.Close()
+	for n := 0; n < 50; n++ {
+		faultA, _ := a.next(true)
+		faultB, _ := b.next(true)
+		if faultA != faultB {
+			t.Fatalf("Schedules diverged at step %d: %s != %s", n, faultA, faultB)
+		}
+	}
+}
+
+func TestFleetAPIPreserved(t *testing.T) {
+	sim := connectortest.NewFleetAPI(connector.AuthMethodHMAC, nil)
+	injector := New(sim, Config{Busy: 1})
+	defer injector.Close()
+
+	fleetAPI, ok := injector.(connector.FleetAPIConnector)
+	if !ok {
+		t.Fatalf("Connector doesn't implement FleetAPIConnector")
+	}
+	// The Vehicle wakes the car using Fleet API rather than a signed command.
+	car, err := vehicle.NewVehicle(injector, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := car.Wakeup(ctx); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	reply, err := fleetAPI.SendFleetAPICommand(ctx, "command/honk_horn", nil)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if string(reply) != "command/honk_horn" || len(sim.Endpoints()) != 1 || sim.Wakeups() != 1 {
+		t.Errorf("Fleet API calls weren't forwarded")
+	}
+	// Faults are still injected into signed commands.
+	if err := fleetAPI.Send(ctx, []byte{}); !errors.Is(err, protocol.ErrBusy) {
+		t.Errorf("Expected ErrBusy but got %v", err)
+	}
+
+	plain := New(connectortest.New(connector.AuthMethodHMAC, nil), Config{})
+	defer plain.Close()
+	if _, ok := plain.(connector.FleetAPIConnector); ok {
+		t.Errorf("Connector implements FleetAPIConnector when the wrapped Connector doesn't")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -38,6 +39,10 @@ func readWithContext(ctx context.Context, r io.Reader, p []byte) ([]byte, error)
 	}
 }
 
+// RequestIDHeader is the HTTP header used to pass correlation IDs (see
+// [connector.WithRequestID]) to and from Fleet API.
+const RequestIDHeader = "X-Request-ID"
+
 var ErrVehicleNotAwake = protocol.NewError("vehicle unavailable: vehicle is offline or asleep", false, false)
 
 /*
@@ -51,9 +56,85 @@ The regular expression below extracts domains from HTTP bodies:
 */
 var baseDomainRE = regexp.MustCompile(`use base URL: https://([-a-z0-9.]*)`)
 
+// RateLimit describes the rate limit headers (RateLimit-* or X-RateLimit-*) of an HTTP response.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	// Reset is the time remaining until the limit resets.
+	Reset time.Duration
+}
+
 type HttpError struct {
 	Code    int
 	Message string
+	// RetryAfter is the delay requested by the server's Retry-After header, or zero.
+	RetryAfter time.Duration
+	// RateLimit is nil if the server didn't send rate limit headers.
+	RateLimit *RateLimit
+}
+
+// NewHttpError returns an HttpError for a response with the provided status code and headers.
+func NewHttpError(code int, message string, header http.Header) *HttpError {
+	now := time.Now()
+	return &HttpError{
+		Code:       code,
+		Message:    message,
+		RetryAfter: parseRetryAfter(header.Get("Retry-After"), now),
+		RateLimit:  parseRateLimit(header, now),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP
+// date. Returns zero if the header is missing or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// resetEpochThreshold distinguishes rate limit reset values given as Unix timestamps from those
+// given as a number of seconds.
+const resetEpochThreshold = 1000000000
+
+func parseRateLimit(header http.Header, now time.Time) *RateLimit {
+	get := func(name string) (int64, bool) {
+		for _, prefix := range []string{"RateLimit-", "X-RateLimit-"} {
+			if value := header.Get(prefix + name); value != "" {
+				n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				return n, err == nil
+			}
+		}
+		return 0, false
+	}
+	limit, hasLimit := get("Limit")
+	remaining, hasRemaining := get("Remaining")
+	reset, hasReset := get("Reset")
+	if !hasLimit && !hasRemaining && !hasReset {
+		return nil
+	}
+	rateLimit := RateLimit{Limit: int(limit), Remaining: int(remaining)}
+	if !hasRemaining {
+		rateLimit.Remaining = -1
+	}
+	if reset >= resetEpochThreshold {
+		if when := time.Unix(reset, 0); when.After(now) {
+			rateLimit.Reset = when.Sub(now)
+		}
+	} else if reset > 0 {
+		rateLimit.Reset = time.Duration(reset) * time.Second
+	}
+	return &rateLimit
 }
 
 func (e *HttpError) Error() string {
@@ -70,6 +151,19 @@ func (e *HttpError) MayHaveSucceeded() bool {
 	return e.Code != http.StatusServiceUnavailable
 }
 
+// RetryDelay returns the minimum delay the server requested before the client retries. If the
+// server didn't send Retry-After but reports an exhausted rate limit, the time until the limit
+// resets is used.
+func (e *HttpError) RetryDelay() time.Duration {
+	if e.RetryAfter > 0 {
+		return e.RetryAfter
+	}
+	if e.Code == http.StatusTooManyRequests && e.RateLimit != nil && e.RateLimit.Remaining == 0 {
+		return e.RateLimit.Reset
+	}
+	return 0
+}
+
 func (e *HttpError) Temporary() bool {
 	return e.Code == http.StatusServiceUnavailable ||
 		e.Code == http.StatusGatewayTimeout ||
@@ -78,6 +172,14 @@ func (e *HttpError) Temporary() bool {
 		e.Code == http.StatusTooManyRequests
 }
 
+// requestTag formats a correlation ID as a log message prefix.
+func requestTag(requestID string) string {
+	if requestID == "" {
+		return ""
+	}
+	return "[" + requestID + "] "
+}
+
 func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, authHeader string, url string, command interface{}) ([]byte, error) {
 	var body []byte
 	var ok bool
@@ -88,7 +190,8 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 			return nil, err
 		}
 	}
-	log.Debug("Sending request to %s: %s", url, body)
+	requestID := connector.RequestID(ctx)
+	log.Debug("%sSending request to %s: %s", requestTag(requestID), url, body)
 	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, &protocol.CommandError{Err: err, PossibleSuccess: false, PossibleTemporary: true}
@@ -98,6 +201,9 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 	request.Header.Set("Content-type", "application/json")
 	request.Header.Set("Authorization", authHeader)
 	request.Header.Set("Accept", "*/*")
+	if requestID != "" {
+		request.Header.Set(RequestIDHeader, requestID)
+	}
 
 	result, err := client.Do(request)
 	if err != nil {
@@ -115,7 +221,7 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 		return nil, protocol.NewError("response exceeds maximum length", true, true)
 	}
 
-	log.Debug("Server returned %d: %s: %s", result.StatusCode, http.StatusText(result.StatusCode), body)
+	log.Debug("%sServer returned %d: %s: %s", requestTag(requestID), result.StatusCode, http.StatusText(result.StatusCode), body)
 	switch result.StatusCode {
 	case http.StatusOK:
 		return body, nil
@@ -128,7 +234,7 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 			return nil, ErrVehicleNotAwake
 		}
 	}
-	return nil, &HttpError{Code: result.StatusCode, Message: string(body)}
+	return nil, NewHttpError(result.StatusCode, string(body), result.Header)
 }
 
 func ValidTeslaDomainSuffix(domain string) bool {
@@ -139,13 +245,13 @@ func ValidTeslaDomainSuffix(domain string) bool {
 // response body is not necessarily nil if the error is set.
 func (c *Connection) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
 	url := fmt.Sprintf("https://%s/%s", c.serverURL, endpoint)
-	rsp, err := SendFleetAPICommand(ctx, &c.client, c.UserAgent, c.authHeader, url, command)
+	rsp, err := SendFleetAPICommand(ctx, c.client, c.UserAgent, c.authHeader, url, command)
 	if err != nil {
 		var httpErr *HttpError
 		if errors.As(err, &httpErr) && httpErr.Code == http.StatusMisdirectedRequest {
 			matches := baseDomainRE.FindStringSubmatch(httpErr.Message)
 			if len(matches) == 2 && ValidTeslaDomainSuffix(matches[1]) {
-				log.Debug("Received HTTP Status 421. Updating server URL.")
+				log.Debug("%sReceived HTTP Status 421. Updating server URL.", requestTag(connector.RequestID(ctx)))
 				c.serverURL = matches[1]
 			}
 		}
@@ -153,11 +259,25 @@ func (c *Connection) SendFleetAPICommand(ctx context.Context, endpoint string, c
 	return rsp, err
 }
 
+// DefaultTimeout bounds the duration of each HTTP request sent by clients returned by
+// NewHTTPClient, including reading the response body.
+const DefaultTimeout = 30 * time.Second
+
+// NewHTTPClient returns an http.Client with sensible default timeouts. If transport is nil, the
+// client uses http.DefaultTransport, which honors the HTTPS_PROXY and NO_PROXY environment
+// variables.
+func NewHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Timeout:   DefaultTimeout,
+	}
+}
+
 // Connection implements the connector.Connector interface by POSTing commands to a server.
 type Connection struct {
 	UserAgent  string
 	vin        string
-	client     http.Client
+	client     *http.Client
 	serverURL  string
 	inbox      chan []byte
 	authHeader string
@@ -166,16 +286,41 @@ type Connection struct {
 	lastPoke time.Time
 }
 
-// NewConnection creates a Connection.
-func NewConnection(vin string, authHeader, serverURL, userAgent string) *Connection {
+// Option configures optional Connection behavior.
+type Option func(*Connection)
+
+// WithBufferSize sets the number of responses from the server that can be queued before further
+// responses are dropped. Defaults to connector.BufferSize.
+func WithBufferSize(size int) Option {
+	return func(c *Connection) {
+		if size > 0 {
+			c.inbox = make(chan []byte, size)
+		}
+	}
+}
+
+// NewConnection creates a Connection that uses a client returned by NewHTTPClient.
+func NewConnection(vin string, authHeader, serverURL, userAgent string, options ...Option) *Connection {
+	return NewConnectionWithClient(vin, authHeader, serverURL, userAgent, nil, options...)
+}
+
+// NewConnectionWithClient creates a Connection that sends requests using client. If client is nil,
+// the Connection uses a client returned by NewHTTPClient.
+func NewConnectionWithClient(vin string, authHeader, serverURL, userAgent string, client *http.Client, options ...Option) *Connection {
+	if client == nil {
+		client = NewHTTPClient(nil)
+	}
 	conn := Connection{
 		UserAgent:  userAgent,
 		vin:        vin,
-		client:     http.Client{},
+		client:     client,
 		serverURL:  serverURL,
 		authHeader: authHeader,
 		inbox:      make(chan []byte, connector.BufferSize),
 	}
+	for _, option := range options {
+		option(&conn)
+	}
 	return &conn
 }
 
@@ -202,6 +347,9 @@ func (c *Connection) VIN() string {
 	return c.vin
 }
 
+// wakeupPollInterval is the delay between wake requests, unless the server asks for a longer one.
+const wakeupPollInterval = 10 * time.Second
+
 func (c *Connection) Wakeup(ctx context.Context) error {
 	type wakeResponse struct {
 		State string `json:"state"`
@@ -227,10 +375,14 @@ func (c *Connection) Wakeup(ctx context.Context) error {
 			return err
 		}
 
+		delay := wakeupPollInterval
+		if requested := protocol.RetryDelay(err); requested > delay {
+			delay = requested
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(10 * time.Second):
+		case <-time.After(delay):
 			continue
 		}
 	}
@@ -253,7 +405,7 @@ func (c *Connection) Send(ctx context.Context, buffer []byte) error {
 
 	var rsp jsonResponse
 	if err := json.Unmarshal(body, &rsp); err != nil {
-		log.Debug("Invalid server response (%d bytes): %s", len(body), body)
+		log.Debug("%sInvalid server response (%d bytes): %s", requestTag(connector.RequestID(ctx)), len(body), body)
 		return &protocol.CommandError{Err: fmt.Errorf("unable to parse server response: %w", err), PossibleSuccess: true, PossibleTemporary: false}
 	}
 	select {
@@ -0,0 +1,98 @@
+package inet
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 00:00:00 GMT": 0,
+	}
+	for value, expected := range tests {
+		if delay := parseRetryAfter(value, now); delay != expected {
+			t.Errorf("parseRetryAfter(%q) = %s, expected %s", value, delay, expected)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	if parseRateLimit(http.Header{}, now) != nil {
+		t.Errorf("Expected nil RateLimit when headers are missing")
+	}
+
+	header := http.Header{}
+	header.Set("RateLimit-Limit", "60")
+	header.Set("RateLimit-Remaining", "0")
+	header.Set("RateLimit-Reset", "15")
+	limit := parseRateLimit(header, now)
+	if limit == nil || limit.Limit != 60 || limit.Remaining != 0 || limit.Reset != 15*time.Second {
+		t.Errorf("Unexpected RateLimit: %+v", limit)
+	}
+
+	header = http.Header{}
+	header.Set("X-RateLimit-Limit", "100")
+	header.Set("X-RateLimit-Reset", "1700000042")
+	limit = parseRateLimit(header, now)
+	if limit == nil || limit.Limit != 100 || limit.Remaining != -1 || limit.Reset != 42*time.Second {
+		t.Errorf("Unexpected RateLimit: %+v", limit)
+	}
+}
+
+func TestHttpErrorRetryDelay(t *testing.T) {
+	err := &HttpError{Code: http.StatusTooManyRequests, RateLimit: &RateLimit{Remaining: 0, Reset: time.Minute}}
+	if delay := err.RetryDelay(); delay != time.Minute {
+		t.Errorf("Expected delay until rate limit reset but got %s", delay)
+	}
+	err.RetryAfter = 5 * time.Second
+	if delay := err.RetryDelay(); delay != 5*time.Second {
+		t.Errorf("Expected Retry-After delay but got %s", delay)
+	}
+}
+
+func TestSendFleetAPICommandThrottled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": "rate limited"}`))
+	}))
+	defer server.Close()
+
+	_, err := SendFleetAPICommand(context.Background(), server.Client(), "", "", server.URL, nil)
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected HttpError but got %v", err)
+	}
+	if httpErr.Code != http.StatusTooManyRequests || httpErr.RateLimit == nil || httpErr.RateLimit.Remaining != 0 {
+		t.Errorf("Unexpected error: %+v", httpErr)
+	}
+	if !protocol.ShouldRetry(err) || protocol.RetryDelay(err) != 7*time.Second {
+		t.Errorf("Expected retriable error with 7s delay: %+v", httpErr)
+	}
+}
+
+func TestWithBufferSize(t *testing.T) {
+	conn := NewConnection("vin", "", "https://localhost", "")
+	if cap(conn.inbox) != connector.BufferSize {
+		t.Errorf("Expected default buffer size %d but got %d", connector.BufferSize, cap(conn.inbox))
+	}
+	conn = NewConnection("vin", "", "https://localhost", "", WithBufferSize(20))
+	if cap(conn.inbox) != 20 {
+		t.Errorf("Expected buffer size 20 but got %d", cap(conn.inbox))
+	}
+}
@@ -0,0 +1,26 @@
+/*
+Package recorder captures the datagrams exchanged with a vehicle and plays them back.
+
+A recording is a JSONL file. The first line describes the connection (VIN, preferred
+authentication method, and retry interval), and each subsequent line records a datagram sent to
+(direction "tx") or received from (direction "rx") the vehicle, along with a timestamp. Failed
+transmissions are followed by a "tx_error" record containing the error.
+
+Wrap a Connector with [New] or [Create] to record a session:
+
+	conn, err := recorder.Create(bleConnection, "trace.jsonl")
+	car, err := vehicle.NewVehicle(conn, privateKey, nil)
+
+A [Replayer] implements the Connector interface by feeding a recording back to a
+vehicle.Vehicle. Each time the client sends a datagram, the Replayer checks that it has the same
+destination, signature type and, if it's unauthenticated, payload as the next recorded
+transmission, and then delivers the responses that were received before the following
+transmission. The dispatcher picks fresh routing addresses and UUIDs for every request, so the
+Replayer rewrites recorded responses to match the live requests.
+
+Recordings contain the vehicle's responses, including session state, and should be handled with
+the same care as a session cache. Session handshakes cannot be replayed, since vehicle session
+info is authenticated against the random UUID of the request that triggered it; replay sessions
+that require authentication should load their sessions from a cache instead.
+*/
+package recorder
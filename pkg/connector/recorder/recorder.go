@@ -0,0 +1,219 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+)
+
+// Direction indicates whether a Record describes the start of a connection or a datagram sent to
+// or received from the vehicle.
+type Direction string
+
+const (
+	DirectionStart     Direction = "start"
+	DirectionSend      Direction = "tx"
+	DirectionReceive   Direction = "rx"
+	DirectionSendError Direction = "tx_error"
+)
+
+// Record is a single line of a recording.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	Data      []byte    `json:"data,omitempty"`
+
+	// Set on DirectionStart records.
+	VIN           string               `json:"vin,omitempty"`
+	AuthMethod    connector.AuthMethod `json:"auth_method,omitempty"`
+	RetryInterval time.Duration        `json:"retry_interval,omitempty"`
+
+	// Set on DirectionSend records, and on the DirectionSendError record that reports the
+	// result of a failed transmission.
+	Sequence uint64 `json:"seq,omitempty"`
+
+	// Set on DirectionSendError records. Older recordings set these fields on the DirectionSend
+	// record instead.
+	Error            string `json:"error,omitempty"`
+	MayHaveSucceeded bool   `json:"may_have_succeeded,omitempty"`
+	Temporary        bool   `json:"temporary,omitempty"`
+}
+
+// Recorder wraps a connector.Connector and records all datagrams that pass through it.
+type Recorder struct {
+	conn  connector.Connector
+	inbox chan []byte
+
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+	closer    io.Closer
+	sequence  uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// fleetAPIRecorder preserves the Fleet API methods of the Connector wrapped by a Recorder. Fleet API
+// REST calls are not recorded.
+type fleetAPIRecorder struct {
+	*Recorder
+	fleetAPI connector.FleetAPIConnector
+}
+
+func (f *fleetAPIRecorder) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
+	return f.fleetAPI.SendFleetAPICommand(ctx, endpoint, command)
+}
+
+func (f *fleetAPIRecorder) Wakeup(ctx context.Context) error {
+	return f.fleetAPI.Wakeup(ctx)
+}
+
+// New returns a Connector that records traffic passing through conn to w.
+//
+// If conn implements connector.FleetAPIConnector, so does the returned Connector.
+func New(conn connector.Connector, w io.Writer) (connector.Connector, error) {
+	r := &Recorder{
+		conn:    conn,
+		inbox:   make(chan []byte, connector.BufferSize),
+		encoder: json.NewEncoder(w),
+		done:    make(chan struct{}),
+	}
+	if err := r.write(&Record{
+		Time:          time.Now(),
+		Direction:     DirectionStart,
+		VIN:           conn.VIN(),
+		AuthMethod:    conn.PreferredAuthMethod(),
+		RetryInterval: conn.RetryInterval(),
+	}); err != nil {
+		return nil, err
+	}
+	go r.listen()
+	if fleetAPI, ok := conn.(connector.FleetAPIConnector); ok {
+		return &fleetAPIRecorder{Recorder: r, fleetAPI: fleetAPI}, nil
+	}
+	return r, nil
+}
+
+// Create is like New, but writes the recording to filename. The file is closed when the
+// Connector is closed.
+func Create(conn connector.Connector, filename string) (connector.Connector, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := New(conn, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	switch r := wrapped.(type) {
+	case *Recorder:
+		r.closer = file
+	case *fleetAPIRecorder:
+		r.closer = file
+	}
+	return wrapped, nil
+}
+
+func (r *Recorder) write(record *Record) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.encoder.Encode(record)
+}
+
+// writeSend records a transmission and returns its sequence number.
+func (r *Recorder) writeSend(buffer []byte) (uint64, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	r.sequence++
+	return r.sequence, r.encoder.Encode(&Record{
+		Time:      time.Now(),
+		Direction: DirectionSend,
+		Data:      buffer,
+		Sequence:  r.sequence,
+	})
+}
+
+func (r *Recorder) listen() {
+	defer close(r.inbox)
+	for {
+		select {
+		case message, ok := <-r.conn.Receive():
+			if !ok {
+				return
+			}
+			if err := r.write(&Record{Time: time.Now(), Direction: DirectionReceive, Data: message}); err != nil {
+				log.Warning("Failed to record received message: %s", err)
+			}
+			select {
+			case r.inbox <- message:
+			case <-r.done:
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Recorder) Receive() <-chan []byte {
+	return r.inbox
+}
+
+// Send records buffer and forwards it to the wrapped Connector. The transmission is recorded before
+// it's forwarded, since some Connectors deliver responses before Send returns. If the Connector
+// returns an error, it's recorded separately.
+func (r *Recorder) Send(ctx context.Context, buffer []byte) error {
+	sequence, recordErr := r.writeSend(buffer)
+	if recordErr != nil {
+		log.Warning("Failed to record sent message: %s", recordErr)
+	}
+	err := r.conn.Send(ctx, buffer)
+	if err != nil {
+		record := Record{
+			Time:             time.Now(),
+			Direction:        DirectionSendError,
+			Sequence:         sequence,
+			Error:            err.Error(),
+			MayHaveSucceeded: protocol.MayHaveSucceeded(err),
+			Temporary:        protocol.Temporary(err),
+		}
+		if recordErr := r.write(&record); recordErr != nil {
+			log.Warning("Failed to record transmission error: %s", recordErr)
+		}
+	}
+	return err
+}
+
+func (r *Recorder) VIN() string {
+	return r.conn.VIN()
+}
+
+// Close closes the wrapped Connector and, if the Recorder was created using Create, the recording
+// file.
+func (r *Recorder) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.conn.Close()
+		if r.closer != nil {
+			r.writeLock.Lock()
+			r.closer.Close()
+			r.writeLock.Unlock()
+		}
+	})
+}
+
+func (r *Recorder) PreferredAuthMethod() connector.AuthMethod {
+	return r.conn.PreferredAuthMethod()
+}
+
+func (r *Recorder) RetryInterval() time.Duration {
+	return r.conn.RetryInterval()
+}
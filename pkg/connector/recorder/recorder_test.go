@@ -0,0 +1,224 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/connectortest"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+	"github.com/greenmission/vehicle-command/pkg/vehicle"
+
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+var errTransient = protocol.NewError("test: transient failure", false, true)
+
+// newEchoConnector returns a Connector that replies to each message with a copy of its payload.
+func newEchoConnector() *connectortest.Connector {
+	return connectortest.New(connector.AuthMethodGCM, connectortest.Echo)
+}
+
+func sendPayloads(t *testing.T, conn connector.Connector, payloads [][]byte) {
+	t.Helper()
+	car, err := vehicle.NewVehicle(conn, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := car.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer car.Disconnect()
+	for _, payload := range payloads {
+		reply, err := car.Send(ctx, protocol.DomainInfotainment, payload, connector.AuthMethodNone)
+		if err != nil {
+			t.Fatalf("Error sending %s: %s", payload, err)
+		}
+		if !bytes.Equal(reply, payload) {
+			t.Errorf("Expected reply %s but got %s", payload, reply)
+		}
+	}
+}
+
+// checkRecordingOrder verifies that each response is recorded after the transmission that
+// triggered it, and that each transmission error follows its transmission.
+func checkRecordingOrder(t *testing.T, recording []byte) {
+	t.Helper()
+	sent := make(map[uint64]bool)
+	var errorRecords, received int
+	for _, line := range bytes.Split(bytes.TrimSpace(recording), []byte("\n")) {
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		switch record.Direction {
+		case DirectionSend:
+			sent[record.Sequence] = true
+		case DirectionReceive:
+			// The echo connector sends one response per transmission.
+			if received++; received > len(sent) {
+				t.Errorf("Response recorded before its transmission")
+			}
+		case DirectionSendError:
+			errorRecords++
+			if !sent[record.Sequence] {
+				t.Errorf("Error recorded before transmission %d", record.Sequence)
+			}
+		}
+	}
+	if errorRecords != 1 {
+		t.Errorf("Expected one transmission error but found %d", errorRecords)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	payloads := [][]byte{[]byte("first"), []byte("second")}
+
+	var recording bytes.Buffer
+	echo := newEchoConnector()
+	echo.FailNext(errTransient)
+	conn, err := New(echo, &recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendPayloads(t, conn, payloads)
+	checkRecordingOrder(t, recording.Bytes())
+
+	replayer, err := NewReplayer(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayer.VIN() != connectortest.VIN || replayer.PreferredAuthMethod() != connector.AuthMethodGCM {
+		t.Errorf("Replayer didn't restore connection metadata")
+	}
+	// The replay uses different random UUIDs and addresses than the recording, and includes the
+	// transient error that was recorded.
+	sendPayloads(t, replayer, payloads)
+	if !replayer.Done() {
+		t.Errorf("Replay didn't consume the entire recording")
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	var recording bytes.Buffer
+	conn, err := New(newEchoConnector(), &recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendPayloads(t, conn, [][]byte{[]byte("hello")})
+
+	replayer, err := NewReplayer(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := vehicle.NewVehicle(replayer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := car.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer car.Disconnect()
+	if _, err := car.Send(ctx, protocol.DomainVCSEC, []byte("hello"), connector.AuthMethodNone); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("Expected ErrReplayMismatch but got %v", err)
+	}
+	if _, err := car.Send(ctx, protocol.DomainInfotainment, []byte("hello"), connector.AuthMethodNone); !errors.Is(err, ErrEndOfRecording) {
+		t.Errorf("Expected ErrEndOfRecording but got %v", err)
+	}
+}
+
+func encodeMessage(t *testing.T, payload []byte, sigData *signatures.SignatureData) []byte {
+	t.Helper()
+	message := universal.RoutableMessage{
+		ToDestination: &universal.Destination{
+			SubDestination: &universal.Destination_Domain{Domain: protocol.DomainInfotainment},
+		},
+		Payload: &universal.RoutableMessage_ProtobufMessageAsBytes{ProtobufMessageAsBytes: payload},
+	}
+	if sigData != nil {
+		message.SubSigData = &universal.RoutableMessage_SignatureData{SignatureData: sigData}
+	}
+	encoded, err := proto.Marshal(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestReplayComparesMessages(t *testing.T) {
+	hmacData := &signatures.SignatureData{
+		SigType: &signatures.SignatureData_HMAC_PersonalizedData{
+			HMAC_PersonalizedData: &signatures.HMAC_Personalized_Signature_Data{Counter: 1},
+		},
+	}
+	gcmData := &signatures.SignatureData{
+		SigType: &signatures.SignatureData_AES_GCM_PersonalizedData{
+			AES_GCM_PersonalizedData: &signatures.AES_GCM_Personalized_Signature_Data{Counter: 1},
+		},
+	}
+	unsigned := encodeMessage(t, []byte("hello"), nil)
+	signed := encodeMessage(t, []byte("command"), hmacData)
+
+	var recording bytes.Buffer
+	conn, err := New(newEchoConnector(), &recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, message := range [][]byte{unsigned, signed} {
+		if err := conn.Send(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		expected error
+	}{
+		{"same messages", [][]byte{unsigned, signed}, nil},
+		{"different unauthenticated payload", [][]byte{encodeMessage(t, []byte("goodbye"), nil)}, ErrReplayMismatch},
+		// Authenticated payloads differ between runs.
+		{"different authenticated payload", [][]byte{unsigned, encodeMessage(t, []byte("other"), hmacData)}, nil},
+		{"different signature type", [][]byte{unsigned, encodeMessage(t, []byte("command"), gcmData)}, ErrReplayMismatch},
+		{"missing signature", [][]byte{unsigned, encodeMessage(t, []byte("command"), nil)}, ErrReplayMismatch},
+	}
+	for _, test := range tests {
+		replayer, err := NewReplayer(bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, message := range test.messages {
+			err := replayer.Send(ctx, message)
+			if i == len(test.messages)-1 {
+				if !errors.Is(err, test.expected) {
+					t.Errorf("%s: expected %v but got %v", test.name, test.expected, err)
+				}
+			} else if err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.name, err)
+			}
+		}
+		replayer.Close()
+	}
+}
+
+func TestInvalidRecording(t *testing.T) {
+	if _, err := NewReplayer(bytes.NewReader([]byte("{\"direction\": \"tx\"}\n"))); !errors.Is(err, ErrInvalidRecording) {
+		t.Errorf("Expected ErrInvalidRecording but got %v", err)
+	}
+	if _, err := NewReplayer(bytes.NewReader([]byte("not json\n"))); !errors.Is(err, ErrInvalidRecording) {
+		t.Errorf("Expected ErrInvalidRecording but got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+
+	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+var (
+	// ErrEndOfRecording indicates the client sent more datagrams than were recorded.
+	ErrEndOfRecording = protocol.NewError("replay: end of recording", false, false)
+	// ErrReplayMismatch indicates the client sent a datagram that doesn't match the recording.
+	ErrReplayMismatch = protocol.NewError("replay: message does not match recording", false, false)
+	// ErrInvalidRecording indicates a recording could not be parsed.
+	ErrInvalidRecording = errors.New("replay: invalid recording")
+)
+
+// Replayer implements connector.Connector by playing back a recording.
+type Replayer struct {
+	vin           string
+	authMethod    connector.AuthMethod
+	retryInterval time.Duration
+
+	lock      sync.Mutex
+	records   []Record
+	inbox     chan []byte
+	closed    bool
+	addresses map[string][]byte // Recorded routing address -> live routing address
+	uuids     map[string][]byte // Recorded message UUID -> live message UUID
+}
+
+// NewReplayer reads a recording from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*connector.MaxResponseLength)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidRecording, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[0].Direction != DirectionStart {
+		return nil, fmt.Errorf("%w: missing start record", ErrInvalidRecording)
+	}
+	return &Replayer{
+		vin:           records[0].VIN,
+		authMethod:    records[0].AuthMethod,
+		retryInterval: records[0].RetryInterval,
+		records:       records[1:],
+		// The inbox is large enough to hold every recorded response, so playback never blocks.
+		inbox:     make(chan []byte, len(records)),
+		addresses: make(map[string][]byte),
+		uuids:     make(map[string][]byte),
+	}, nil
+}
+
+// LoadReplayer reads a recording from filename.
+func LoadReplayer(filename string) (*Replayer, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return NewReplayer(file)
+}
+
+// Done returns true if every recorded datagram has been played back.
+func (r *Replayer) Done() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.records) == 0
+}
+
+func (r *Replayer) Receive() <-chan []byte {
+	return r.inbox
+}
+
+func (r *Replayer) VIN() string {
+	return r.vin
+}
+
+func (r *Replayer) PreferredAuthMethod() connector.AuthMethod {
+	return r.authMethod
+}
+
+func (r *Replayer) RetryInterval() time.Duration {
+	return r.retryInterval
+}
+
+func (r *Replayer) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.inbox)
+	}
+}
+
+// Send checks buffer against the next recorded transmission. If it matches, Send returns the
+// recorded result and delivers any responses that were received before the following transmission.
+//
+// Messages match if they have the same destination domain and signature type and, for
+// unauthenticated messages, the same payload. The payloads of authenticated messages aren't
+// compared, since they're encrypted or bound to anti-replay counters that differ between runs.
+func (r *Replayer) Send(ctx context.Context, buffer []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return protocol.ErrNotConnected
+	}
+
+	// Responses received before the first transmission were unsolicited.
+	r.deliverResponses()
+	if len(r.records) == 0 {
+		return ErrEndOfRecording
+	}
+	record := r.records[0]
+	r.records = r.records[1:]
+
+	var live, recorded universal.RoutableMessage
+	if err := proto.Unmarshal(buffer, &live); err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(record.Data, &recorded); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRecording, err)
+	}
+	if reason := mismatch(&live, &recorded); reason != "" {
+		log.Warning("[%02x] Replay %s", live.GetUuid(), reason)
+		return ErrReplayMismatch
+	}
+	r.addresses[string(recorded.GetFromDestination().GetRoutingAddress())] = live.GetFromDestination().GetRoutingAddress()
+	r.uuids[string(recorded.GetUuid())] = live.GetUuid()
+
+	if record.Sequence != 0 {
+		if result, ok := r.takeSendError(record.Sequence); ok {
+			record = result
+		}
+	}
+	if record.Error != "" {
+		return &protocol.CommandError{
+			Err:               errors.New(record.Error),
+			PossibleSuccess:   record.MayHaveSucceeded,
+			PossibleTemporary: record.Temporary,
+		}
+	}
+	r.deliverResponses()
+	return nil
+}
+
+// mismatch describes how live differs from the recorded transmission, or returns an empty string
+// if it matches.
+func mismatch(live, recorded *universal.RoutableMessage) string {
+	liveDomain, recordedDomain := live.GetToDestination().GetDomain(), recorded.GetToDestination().GetDomain()
+	if liveDomain != recordedDomain {
+		return fmt.Sprintf("expected message to %s but got message to %s", recordedDomain, liveDomain)
+	}
+	liveSig, recordedSig := live.GetSignatureData().GetSigType(), recorded.GetSignatureData().GetSigType()
+	if reflect.TypeOf(liveSig) != reflect.TypeOf(recordedSig) {
+		return fmt.Sprintf("expected signature %T but got %T", recordedSig, liveSig)
+	}
+	if recordedSig == nil && !bytes.Equal(live.GetProtobufMessageAsBytes(), recorded.GetProtobufMessageAsBytes()) {
+		return fmt.Sprintf("expected payload %02x but got %02x", recorded.GetProtobufMessageAsBytes(), live.GetProtobufMessageAsBytes())
+	}
+	return ""
+}
+
+// takeSendError removes and returns the DirectionSendError record for the transmission with the
+// given sequence number, if there is one. Responses to other transmissions may have been recorded
+// before the error, so the search isn't limited to the next record. The caller must hold r.lock.
+func (r *Replayer) takeSendError(sequence uint64) (Record, bool) {
+	for i, record := range r.records {
+		if record.Direction == DirectionSendError && record.Sequence == sequence {
+			r.records = append(r.records[:i], r.records[i+1:]...)
+			return record, true
+		}
+	}
+	return Record{}, false
+}
+
+// deliverResponses plays back recorded responses up to the next recorded transmission. The caller
+// must hold r.lock.
+func (r *Replayer) deliverResponses() {
+	for len(r.records) > 0 && r.records[0].Direction != DirectionSend {
+		record := r.records[0]
+		r.records = r.records[1:]
+		if record.Direction != DirectionReceive {
+			continue
+		}
+		r.inbox <- r.rewrite(record.Data)
+	}
+}
+
+// rewrite replaces the recorded routing address and request UUID of a response with the values
+// used by the corresponding live request.
+func (r *Replayer) rewrite(data []byte) []byte {
+	var message universal.RoutableMessage
+	if err := proto.Unmarshal(data, &message); err != nil {
+		// Deliver as-is; the dispatcher is responsible for handling garbage.
+		return data
+	}
+	if address, ok := r.addresses[string(message.GetToDestination().GetRoutingAddress())]; ok {
+		message.ToDestination = &universal.Destination{
+			SubDestination: &universal.Destination_RoutingAddress{RoutingAddress: address},
+		}
+	}
+	if uuid, ok := r.uuids[string(message.GetRequestUuid())]; ok {
+		message.RequestUuid = uuid
+	}
+	encoded, err := proto.Marshal(&message)
+	if err != nil {
+		return data
+	}
+	return encoded
+}
@@ -0,0 +1,23 @@
+/*
+Package stream implements the Connector interface over a reliable byte stream, such as a TCP
+connection or a Unix domain socket.
+
+Datagrams are framed using the same 2-byte length prefix used over BLE. This allows a device that
+sits within BLE range of a vehicle (a Raspberry Pi, for example) to relay commands on behalf of a
+remote server, and allows tests to connect a client to a vehicle simulator over a socket.
+
+The client side of a connection is created with [Dial]:
+
+	conn, err := stream.Dial(ctx, "tcp", "relay.local:7654", vin)
+
+The relay creates a [Listener], accepts connections, and forwards datagrams between each client
+and the vehicle using [Relay]:
+
+	listener, err := stream.Listen("tcp", ":7654", vin)
+	client, err := listener.Accept()
+	err = stream.Relay(ctx, client, bleConnection)
+
+The stream does not authenticate or encrypt the connection. Vehicle commands are end-to-end
+authenticated, but the relay should still only be exposed to trusted networks.
+*/
+package stream
@@ -0,0 +1,214 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/framing"
+	"github.com/greenmission/vehicle-command/internal/log"
+	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/protocol"
+)
+
+// ErrClosed indicates a datagram could not be sent because the Connection was closed.
+var ErrClosed = protocol.NewError("stream connection closed", false, false)
+
+// Connection implements the connector.Connector interface over a net.Conn.
+//
+// Both ends of a stream use a Connection: on the client, Receive returns datagrams sent by the
+// vehicle; on the relay, Receive returns datagrams sent by the client.
+type Connection struct {
+	// AuthMethod is returned by PreferredAuthMethod. The default is connector.AuthMethodGCM, which
+	// is appropriate when relaying to a vehicle over BLE. Set this field before passing the
+	// Connection to vehicle.NewVehicle.
+	AuthMethod connector.AuthMethod
+
+	vin       string
+	conn      net.Conn
+	inbox     chan []byte
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewConnection creates a Connection that sends and receives datagrams over conn. The Connection
+// takes ownership of conn.
+func NewConnection(vin string, conn net.Conn) *Connection {
+	c := Connection{
+		AuthMethod: connector.AuthMethodGCM,
+		vin:        vin,
+		conn:       conn,
+		inbox:      make(chan []byte, connector.BufferSize),
+		closed:     make(chan struct{}),
+	}
+	go c.listen()
+	return &c
+}
+
+// Dial connects to a relay or simulator listening on address. The network must be a stream
+// network supported by net.Dial, such as "tcp" or "unix".
+func Dial(ctx context.Context, network, address, vin string) (*Connection, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Connected to %s relay at %s", network, address)
+	return NewConnection(vin, conn), nil
+}
+
+func (c *Connection) listen() {
+	defer close(c.inbox)
+	for {
+		message, err := framing.Read(c.conn, framing.MaxLength)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				if !errors.Is(err, io.EOF) {
+					log.Warning("Stream read error: %s", err)
+				}
+				c.Close()
+			}
+			return
+		}
+		log.Debug("RX: %02x", message)
+		select {
+		case c.inbox <- message:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Connection) PreferredAuthMethod() connector.AuthMethod {
+	return c.AuthMethod
+}
+
+func (c *Connection) RetryInterval() time.Duration {
+	return time.Second
+}
+
+func (c *Connection) Receive() <-chan []byte {
+	return c.inbox
+}
+
+func (c *Connection) VIN() string {
+	return c.vin
+}
+
+// Close terminates the underlying stream. The channel returned by Receive is closed once any
+// pending reads have completed.
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *Connection) Send(ctx context.Context, buffer []byte) error {
+	out, err := framing.Encode(buffer)
+	if err != nil {
+		return &protocol.CommandError{Err: err, PossibleSuccess: false, PossibleTemporary: false}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return &protocol.CommandError{Err: err, PossibleSuccess: false, PossibleTemporary: false}
+	}
+	log.Debug("TX: %02x", buffer)
+	if _, err := c.conn.Write(out); err != nil {
+		// A partial write leaves the stream misaligned, so the connection can't be reused.
+		c.Close()
+		return &protocol.CommandError{Err: err, PossibleSuccess: true, PossibleTemporary: false}
+	}
+	return nil
+}
+
+// Listener accepts stream connections from clients.
+type Listener struct {
+	listener net.Listener
+	vin      string
+}
+
+// Listen announces on the local network address. The vin is used by the Connections returned by
+// Accept.
+func Listen(network, address, vin string) (*Listener, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{listener: listener, vin: vin}, nil
+}
+
+// NewListener wraps an existing net.Listener.
+func NewListener(listener net.Listener, vin string) *Listener {
+	return &Listener{listener: listener, vin: vin}
+}
+
+// Accept waits for the next client connection.
+func (l *Listener) Accept() (*Connection, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Accepted stream connection from %s", conn.RemoteAddr())
+	return NewConnection(l.vin, conn), nil
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops accepting connections. Connections that were already accepted are not closed.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Relay forwards datagrams between client and vehicle until either Connector is closed or ctx
+// expires. Relay does not close either Connector.
+func Relay(ctx context.Context, client, vehicle connector.Connector) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	forward := func(from, to connector.Connector) {
+		for {
+			select {
+			case message, ok := <-from.Receive():
+				if !ok {
+					errs <- nil
+					return
+				}
+				if err := to.Send(ctx, message); err != nil {
+					errs <- err
+					return
+				}
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}
+	go forward(client, vehicle)
+	go forward(vehicle, client)
+
+	err := <-errs
+	cancel()
+	<-errs
+	return err
+}
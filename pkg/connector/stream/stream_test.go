@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testVIN = "0123456789ABCDEFG"
+
+func connectedPair(t *testing.T, network, address string) (*Connection, *Connection) {
+	t.Helper()
+	listener, err := Listen(network, address, testVIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *Connection, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client, err := Dial(ctx, network, listener.Addr().String(), testVIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	return client, server
+}
+
+func expectMessage(t *testing.T, conn *Connection, expected []byte) {
+	t.Helper()
+	select {
+	case message, ok := <-conn.Receive():
+		if !ok {
+			t.Fatalf("Connection closed while waiting for %02x", expected)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("Expected %02x but got %02x", expected, message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %02x", expected)
+	}
+}
+
+func testRoundTrip(t *testing.T, network, address string) {
+	client, server := connectedPair(t, network, address)
+	defer client.Close()
+	defer server.Close()
+
+	ctx := context.Background()
+	messages := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xAB}, 3000)}
+	for _, message := range messages {
+		if err := client.Send(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range messages {
+		expectMessage(t, server, message)
+	}
+
+	if err := server.Send(ctx, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, client, []byte("reply"))
+}
+
+func TestTCP(t *testing.T) {
+	testRoundTrip(t, "tcp", "127.0.0.1:0")
+}
+
+func TestUnixSocket(t *testing.T) {
+	testRoundTrip(t, "unix", filepath.Join(t.TempDir(), "relay.sock"))
+}
+
+func TestRemoteClose(t *testing.T) {
+	client, server := connectedPair(t, "tcp", "127.0.0.1:0")
+	defer client.Close()
+	server.Close()
+
+	select {
+	case _, ok := <-client.Receive():
+		if ok {
+			t.Errorf("Received unexpected message")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Receive channel not closed after peer closed connection")
+	}
+	if err := client.Send(context.Background(), []byte("hello")); err == nil {
+		t.Errorf("Expected error sending on closed connection")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	client, relayClient := connectedPair(t, "tcp", "127.0.0.1:0")
+	defer client.Close()
+
+	// The simulator stands in for a BLE connection to the vehicle.
+	simulatorConn, simulatorRemote := net.Pipe()
+	simulator := NewConnection(testVIN, simulatorRemote)
+	vehicleSide := NewConnection(testVIN, simulatorConn)
+	defer simulator.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(context.Background(), relayClient, vehicleSide)
+	}()
+
+	ctx := context.Background()
+	if err := client.Send(ctx, []byte("unlock")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, simulator, []byte("unlock"))
+	if err := simulator.Send(ctx, []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, client, []byte("ok"))
+
+	client.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected relay error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Relay didn't exit after client disconnected")
+	}
+	relayClient.Close()
+	vehicleSide.Close()
+}
@@ -42,6 +42,10 @@ var (
 	ErrNoSession = NewError("cannot send authenticated command before establishing a vehicle session", false, false)
 	// ErrRequiresKey indicates a client tried to send a command without an ECDHPrivateKey.
 	ErrRequiresKey = NewError("no private key available", false, false)
+	// ErrTransportChanged indicates a Connector could not send a message because it was
+	// authenticated for a transport that is no longer available. The message was not sent. Callers
+	// should authorize the command again using the Connector's current PreferredAuthMethod.
+	ErrTransportChanged = NewError("transport changed before message could be sent", false, true)
 	// ErrInvalidPublicKey indicates a client tried to perform an operation with an invalid public
 	// key. Public keys are NIST-P256 EC keys, encoded in uncompressed form.
 	ErrInvalidPublicKey     = authentication.ErrInvalidPublicKey
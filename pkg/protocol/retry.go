@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how long clients wait between attempts to send a command that failed with
+// a temporary error. Delays grow exponentially from InitialInterval up to MaxInterval, and are
+// randomized by Jitter to avoid synchronized retries from many clients. If an error specifies a
+// longer delay (for example, through an HTTP Retry-After header), the longer delay is used.
+//
+// Zero-valued fields are replaced by the corresponding fields of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// InitialInterval is the delay before the first retry. If zero, the Connector's recommended
+	// RetryInterval is used.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Multiplier is the factor by which the delay grows after each attempt.
+	Multiplier float64
+	// Jitter is the fraction by which each delay is randomly increased or decreased. Set Jitter
+	// to a negative value to disable randomization.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used when a client doesn't specify a RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxInterval: 30 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+}
+
+// RetryDelay returns the minimum delay before retrying that was requested by the source of err,
+// or zero if there is none.
+func RetryDelay(err error) time.Duration {
+	var delayer interface{ RetryDelay() time.Duration }
+	if errors.As(err, &delayer) {
+		return delayer.RetryDelay()
+	}
+	return 0
+}
+
+// Backoff tracks the delay between successive retries of a single operation.
+type Backoff struct {
+	policy RetryPolicy
+	next   time.Duration
+}
+
+// Backoff returns a Backoff for a new operation. The initial delay is baseInterval if
+// p.InitialInterval is zero. The receiver may be nil.
+func (p *RetryPolicy) Backoff(baseInterval time.Duration) *Backoff {
+	policy := DefaultRetryPolicy
+	if p != nil {
+		if p.InitialInterval > 0 {
+			policy.InitialInterval = p.InitialInterval
+		}
+		if p.MaxInterval > 0 {
+			policy.MaxInterval = p.MaxInterval
+		}
+		if p.Multiplier > 0 {
+			policy.Multiplier = p.Multiplier
+		}
+		if p.Jitter != 0 {
+			policy.Jitter = p.Jitter
+		}
+	}
+	if policy.InitialInterval == 0 {
+		policy.InitialInterval = baseInterval
+	}
+	return &Backoff{policy: policy, next: policy.InitialInterval}
+}
+
+// Delay returns the time to wait before the next attempt, given the error returned by the
+// previous attempt.
+func (b *Backoff) Delay(err error) time.Duration {
+	delay := b.next
+	if b.policy.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * b.policy.Jitter * float64(delay))
+	}
+	b.next = time.Duration(float64(b.next) * b.policy.Multiplier)
+	if b.next > b.policy.MaxInterval {
+		b.next = b.policy.MaxInterval
+	}
+	if requested := RetryDelay(err); requested > delay {
+		delay = requested
+	}
+	return delay
+}
+
+// Wait blocks until the next attempt should be made. The err parameter is the error returned by
+// the previous attempt.
+//
+// If ctx has a deadline that expires before the next attempt, Wait returns immediately rather than
+// sleeping until the deadline. The returned error wraps both context.DeadlineExceeded and err, so
+// that callers can inspect the last failure (for example, to find the server's Retry-After
+// delay). If ctx is cancelled while waiting, Wait returns ctx.Err().
+func (b *Backoff) Wait(ctx context.Context, err error) error {
+	delay := b.Delay(err)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return fmt.Errorf("%w before next retry (last error: %w)", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type delayError struct {
+	delay time.Duration
+}
+
+func (e *delayError) Error() string {
+	return "throttled"
+}
+
+func (e *delayError) RetryDelay() time.Duration {
+	return e.delay
+}
+
+func TestBackoffGrowth(t *testing.T) {
+	policy := RetryPolicy{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 2, Jitter: -1}
+	backoff := policy.Backoff(time.Millisecond)
+	expected := []time.Duration{1, 2, 4, 5, 5}
+	for i, seconds := range expected {
+		if delay := backoff.Delay(nil); delay != seconds*time.Second {
+			t.Errorf("Attempt %d: expected delay of %ds but got %s", i, seconds, delay)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{InitialInterval: time.Second, Multiplier: 1, Jitter: 0.5}
+	backoff := policy.Backoff(0)
+	varied := false
+	first := backoff.Delay(nil)
+	for i := 0; i < 100; i++ {
+		delay := backoff.Delay(nil)
+		if delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("Delay %s outside of jitter bounds", delay)
+		}
+		if delay != first {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Errorf("Expected delays to vary")
+	}
+}
+
+func TestBackoffUsesBaseInterval(t *testing.T) {
+	var policy *RetryPolicy
+	delay := policy.Backoff(100 * time.Millisecond).Delay(nil)
+	if delay < 80*time.Millisecond || delay > 120*time.Millisecond {
+		t.Errorf("Unexpected delay %s", delay)
+	}
+}
+
+func TestBackoffHonorsRetryDelay(t *testing.T) {
+	backoff := (&RetryPolicy{InitialInterval: time.Millisecond}).Backoff(0)
+	err := errors.Join(ErrBusy, &delayError{delay: time.Minute})
+	if delay := backoff.Delay(err); delay != time.Minute {
+		t.Errorf("Expected server-specified delay but got %s", delay)
+	}
+	if RetryDelay(ErrBusy) != 0 {
+		t.Errorf("Expected no delay for ErrBusy")
+	}
+}
+
+func TestBackoffWaitRespectsDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	throttled := &delayError{delay: time.Minute}
+	start := time.Now()
+	err := (&RetryPolicy{}).Backoff(time.Millisecond).Wait(ctx, throttled)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Wait slept even though delay exceeds deadline")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, throttled) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if err := (&RetryPolicy{}).Backoff(time.Millisecond).Wait(ctx, ErrBusy); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&RetryPolicy{}).Backoff(time.Second).Wait(ctx, ErrBusy); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -2,13 +2,18 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +21,7 @@ import (
 	"github.com/greenmission/vehicle-command/internal/log"
 	"github.com/greenmission/vehicle-command/pkg/account"
 	"github.com/greenmission/vehicle-command/pkg/cache"
+	"github.com/greenmission/vehicle-command/pkg/connector"
 	"github.com/greenmission/vehicle-command/pkg/connector/inet"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 	"github.com/greenmission/vehicle-command/pkg/vehicle"
@@ -26,24 +32,63 @@ const (
 	maxRequestBodyBytes  = 512
 	vinLength            = 17
 	proxyProtocolVersion = "tesla-http-proxy/1.0.0"
+	requestIDBytes       = 16
 )
 
-func getAccount(req *http.Request) (*account.Account, error) {
+// Client-provided request IDs end up in log messages, so they're restricted to a conservative
+// character set.
+var requestIDRegEx = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the client's X-Request-ID header if it's valid, and otherwise generates a new
+// random ID.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(inet.RequestIDHeader); requestIDRegEx.MatchString(id) {
+		return id
+	}
+	buffer := make([]byte, requestIDBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		// Correlation IDs are a debugging aid and shouldn't cause requests to fail.
+		log.Warning("Failed to generate request ID: %s", err)
+		return ""
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// requestContext returns a Context that expires after p.Timeout and carries req's correlation ID.
+func (p *Proxy) requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	ctx := connector.WithRequestID(context.Background(), connector.RequestID(req.Context()))
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+func (p *Proxy) getAccount(req *http.Request) (*account.Account, error) {
 	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
 	if !ok {
 		return nil, fmt.Errorf("client did not provide an OAuth token")
 	}
-	return account.New(token, proxyProtocolVersion)
+	return account.New(token, proxyProtocolVersion, account.WithHTTPClient(p.HTTPClient))
 }
 
 // Proxy exposes an HTTP API for sending vehicle commands.
 type Proxy struct {
 	Timeout time.Duration
+	// HTTPClient is used for all requests to Tesla's servers. New initializes it using
+	// [inet.NewHTTPClient].
+	HTTPClient *http.Client
+	// FleetStatus is consulted to decide whether to send signed or REST commands to a VIN before
+	// opening a session. New initializes it using [account.NewFleetStatusCache]. If nil, the proxy
+	// only learns that a vehicle requires REST commands when a session handshake fails.
+	FleetStatus *account.FleetStatusCache
+	// SessionStore, if set, shares vehicle sessions with other proxy instances. Sessions are still
+	// cached in memory, but the store is consulted when the proxy opens a new connection to a
+	// vehicle and updated after each command.
+	SessionStore cache.SessionStore
 
 	commandKey  protocol.ECDHPrivateKey
 	sessions    *cache.SessionCache
-	vinLock     sync.Map
 	unsupported sync.Map
+
+	vehicleLock sync.Mutex
+	vehicles    map[string]*sharedVehicle
 }
 
 func (p *Proxy) markUnsupportedVIN(vin string) {
@@ -55,33 +100,129 @@ func (p *Proxy) isNotSupported(vin string) bool {
 	return ok
 }
 
-// lockVIN locks a VIN-specific mutex, blocking until the operation succeeds or ctx expires.
-func (p *Proxy) lockVIN(ctx context.Context, vin string) error {
-	lock := make(chan bool, 1)
-	for {
-		if obj, loaded := p.vinLock.LoadOrStore(vin, lock); loaded {
+// sharedVehicle is a connected Vehicle used by all in-flight requests for a VIN that use the same
+// OAuth token.
+type sharedVehicle struct {
+	// token is the Authorization header of the request that created the Vehicle. The Vehicle's
+	// connection authenticates using this token, so requests with other tokens can't use it.
+	token    string
+	ready    chan struct{} // Closed once car is connected or err is set
+	released chan struct{} // Closed once the last user is done with car
+	car      *vehicle.Vehicle
+	err      error
+	users    int
+	// closing is set once the Vehicle can no longer be acquired.
+	closing bool
+}
+
+// acquireVehicle returns a connected Vehicle with active sessions, reusing the Vehicle of any
+// in-flight request for the same VIN and token. Commands sent by concurrent requests are pipelined
+// or queued by the Vehicle (see [vehicle.Vehicle]). The caller must invoke release once it's done
+// with the Vehicle; the last caller to release it disconnects the Vehicle.
+//
+// At most one Vehicle exists per VIN. All Vehicles load sessions from the same cache entry, so two
+// Vehicles for the same VIN would allocate the same anti-replay counters. Requests that use a
+// different token therefore wait until the current Vehicle has been released.
+func (p *Proxy) acquireVehicle(ctx context.Context, acct *account.Account, vin, token string) (car *vehicle.Vehicle, release func(), err error) {
+	var shared *sharedVehicle
+	var created bool
+	for shared == nil {
+		p.vehicleLock.Lock()
+		if p.vehicles == nil {
+			p.vehicles = make(map[string]*sharedVehicle)
+		}
+		current, ok := p.vehicles[vin]
+		switch {
+		case !ok:
+			shared = &sharedVehicle{
+				token:    token,
+				ready:    make(chan struct{}),
+				released: make(chan struct{}),
+			}
+			p.vehicles[vin] = shared
+			created = true
+		case current.token == token && !current.closing:
+			shared = current
+		}
+		if shared != nil {
+			shared.users++
+		}
+		p.vehicleLock.Unlock()
+
+		if shared == nil {
 			select {
-			case <-obj.(chan bool):
-				// The goroutine that reads from the channel doesn't necessarily own the mutex. This
-				// allows the mutex owner to delete the entry from the map, limiting the size of the
-				// map to the number of concurrent vehicle commands.
+			case <-current.released:
 			case <-ctx.Done():
-				return ctx.Err()
+				return nil, nil, ctx.Err()
 			}
-		} else {
-			return nil
 		}
 	}
+
+	release = func() {
+		p.vehicleLock.Lock()
+		shared.users--
+		last := shared.users == 0
+		if last {
+			shared.closing = true
+		}
+		p.vehicleLock.Unlock()
+		if !last {
+			return
+		}
+		// Disconnect before allowing another Vehicle to be created for the VIN, so that the next
+		// Vehicle sees the sessions saved by this one.
+		if shared.car != nil {
+			shared.car.Disconnect()
+		}
+		p.vehicleLock.Lock()
+		delete(p.vehicles, vin)
+		p.vehicleLock.Unlock()
+		close(shared.released)
+	}
+
+	if created {
+		shared.car, shared.err = p.connectVehicle(ctx, acct, vin)
+		if shared.err != nil {
+			// Don't let later requests reuse the failure.
+			p.vehicleLock.Lock()
+			shared.closing = true
+			p.vehicleLock.Unlock()
+		}
+		close(shared.ready)
+	} else {
+		select {
+		case <-shared.ready:
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		}
+	}
+	if shared.err != nil {
+		release()
+		return nil, nil, shared.err
+	}
+	return shared.car, release, nil
 }
 
-// unlockVIN releases a VIN-specific mutex.
-func (p *Proxy) unlockVIN(vin string) {
-	obj, ok := p.vinLock.Load(vin)
-	if !ok {
-		panic("called unlock without owning mutex")
+// connectVehicle connects to vin and starts sessions with it.
+func (p *Proxy) connectVehicle(ctx context.Context, acct *account.Account, vin string) (*vehicle.Vehicle, error) {
+	var options []vehicle.Option
+	if p.SessionStore != nil {
+		options = append(options, vehicle.WithSessionStore(p.SessionStore))
+	}
+	car, err := acct.GetVehicle(ctx, vin, p.commandKey, p.sessions, options...)
+	if err != nil {
+		return nil, err
 	}
-	p.vinLock.Delete(vin)  // Allow someone else to claim the mutex
-	close(obj.(chan bool)) // Unblock goroutines
+	if err := car.Connect(ctx); err != nil {
+		car.Disconnect()
+		return nil, err
+	}
+	if err := car.StartSession(ctx, nil); err != nil {
+		car.Disconnect()
+		return nil, err
+	}
+	return car, nil
 }
 
 // New creates an http proxy.
@@ -90,9 +231,11 @@ func (p *Proxy) unlockVIN(vin string) {
 // command-authentication key, not a TLS key.)
 func New(ctx context.Context, skey protocol.ECDHPrivateKey, cacheSize int) (*Proxy, error) {
 	return &Proxy{
-		Timeout:    defaultTimeout,
-		commandKey: skey,
-		sessions:   cache.New(cacheSize),
+		Timeout:     defaultTimeout,
+		HTTPClient:  inet.NewHTTPClient(nil),
+		FleetStatus: account.NewFleetStatusCache(account.DefaultFleetStatusTTL),
+		commandKey:  skey,
+		sessions:    cache.New(cacheSize),
 	}, nil
 }
 
@@ -101,6 +244,7 @@ type Response struct {
 	Response   interface{} `json:"response"`
 	Error      string      `json:"error"`
 	ErrDetails string      `json:"error_description"`
+	RequestID  string      `json:"request_id,omitempty"`
 }
 
 type carResponse struct {
@@ -109,31 +253,36 @@ type carResponse struct {
 }
 
 func writeJSONError(w http.ResponseWriter, code int, err error) {
-	reply := Response{}
+	reply := Response{RequestID: w.Header().Get(inet.RequestIDHeader)}
 
 	var httpErr *inet.HttpError
-	var jsonBytes []byte
 	if errors.As(err, &httpErr) {
 		code = httpErr.Code
-		jsonBytes = []byte(err.Error())
-	} else {
-		if err == nil {
-			reply.Error = http.StatusText(code)
-		} else if protocol.IsNominalError(err) {
-			// Response came from the car as opposed to Tesla's servers
-			reply.Response = &carResponse{Reason: err.Error()}
-		} else {
-			reply.Error = err.Error()
+		// Fleet API error bodies usually have the same format as Response. Keep their fields, but
+		// fall back to the raw body if it's something else.
+		if json.Unmarshal([]byte(httpErr.Message), &reply) != nil || reply.Error == "" {
+			reply = Response{Error: httpErr.Error()}
 		}
-		jsonBytes, err = json.Marshal(&reply)
-		if err != nil {
-			log.Error("Error serializing reply %+v: %s", &reply, err)
-			code = http.StatusInternalServerError
-			jsonBytes = []byte("{\"error\": \"internal server error\"}")
+		reply.RequestID = w.Header().Get(inet.RequestIDHeader)
+		if httpErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(httpErr.RetryAfter.Seconds()))))
 		}
+	} else if err == nil {
+		reply.Error = http.StatusText(code)
+	} else if protocol.IsNominalError(err) {
+		// Response came from the car as opposed to Tesla's servers
+		reply.Response = &carResponse{Reason: err.Error()}
+	} else {
+		reply.Error = err.Error()
+	}
+	jsonBytes, err := json.Marshal(&reply)
+	if err != nil {
+		log.Error("Error serializing reply %+v: %s", &reply, err)
+		code = http.StatusInternalServerError
+		jsonBytes = []byte("{\"error\": \"internal server error\"}")
 	}
 	if code != http.StatusOK {
-		log.Error("Returning error %s", http.StatusText(code))
+		log.Error("[%s] Returning error %s", reply.RequestID, http.StatusText(code))
 	}
 	w.WriteHeader(code)
 	w.Header().Add("Content-Type", "application/json")
@@ -152,7 +301,7 @@ var connectionHeaders = []string{
 // forwardRequest is the fallback handler for "/api/1/*".
 // It forwards GET and POST requests to Tesla using the proxy's OAuth token.
 func (p *Proxy) forwardRequest(host string, w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	ctx, cancel := p.requestContext(req)
 	defer cancel()
 
 	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL.String(), req.Body)
@@ -181,12 +330,15 @@ func (p *Proxy) forwardRequest(host string, w http.ResponseWriter, req *http.Req
 		// If the client sent multiple XFF headers, flatten them.
 		proxyReq.Header.Set(xff, strings.Join(previous, ", "))
 	}
+	id := connector.RequestID(ctx)
+	if id != "" {
+		proxyReq.Header.Set(inet.RequestIDHeader, id)
+	}
 	proxyReq.URL.Host = host
 	proxyReq.URL.Scheme = "https"
 
-	log.Debug("Forwarding request to %s", proxyReq.URL.String())
-	client := http.Client{}
-	resp, err := client.Do(proxyReq)
+	log.Debug("[%s] Forwarding request to %s", id, proxyReq.URL.String())
+	resp, err := p.HTTPClient.Do(proxyReq)
 	if err != nil {
 		if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
 			writeJSONError(w, http.StatusGatewayTimeout, urlErr)
@@ -204,15 +356,23 @@ func (p *Proxy) forwardRequest(host string, w http.ResponseWriter, req *http.Req
 	for name, value := range resp.Header {
 		outHeader[name] = value
 	}
+	if id != "" {
+		outHeader.Set(inet.RequestIDHeader, id)
+	}
 
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Info("Received %s request for %s", req.Method, req.URL.Path)
+	id := requestID(req)
+	if id != "" {
+		w.Header().Set(inet.RequestIDHeader, id)
+		req = req.WithContext(connector.WithRequestID(req.Context(), id))
+	}
+	log.Info("[%s] Received %s request for %s", id, req.Method, req.URL.Path)
 
-	acct, err := getAccount(req)
+	acct, err := p.getAccount(req)
 	if err != nil {
 		writeJSONError(w, http.StatusForbidden, err)
 		return
@@ -229,7 +389,14 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			if p.isNotSupported(vin) {
 				p.forwardRequest(acct.Host, w, req)
-			} else {
+				return
+			}
+			switch p.route(req, acct, vin) {
+			case account.RouteREST:
+				p.forwardRequest(acct.Host, w, req)
+			case account.RouteKeyNotPaired:
+				writeJSONError(w, http.StatusForbidden, protocol.ErrKeyNotPaired)
+			default:
 				if err := p.handleVehicleCommand(acct, w, req, command, vin); err == ErrCommandUseRESTAPI {
 					p.forwardRequest(acct.Host, w, req)
 				}
@@ -240,30 +407,35 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	p.forwardRequest(acct.Host, w, req)
 }
 
-func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWriter, req *http.Request, command, vin string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
-	defer cancel()
-
-	// Serialize commands sent to a specific VIN to avoid some complexities associated with sharing
-	// the vehicle.Vehicle object. VCSEC commands fail if they arrive out of order, anyway.
-	if err := p.lockVIN(ctx, vin); err != nil {
-		writeJSONError(w, http.StatusServiceUnavailable, err)
-		return err
+// route uses fleet status to decide how to send commands to vin. If fleet status is unavailable,
+// it returns account.RouteUnknown and the proxy attempts to send signed commands.
+func (p *Proxy) route(req *http.Request, acct *account.Account, vin string) account.Route {
+	if p.FleetStatus == nil {
+		return account.RouteUnknown
 	}
-	defer p.unlockVIN(vin)
-
-	car, commandToExecuteFunc, err := p.loadVehicleAndCommandFromRequest(ctx, acct, w, req, command, vin)
+	ctx, cancel := p.requestContext(req)
+	defer cancel()
+	route, err := p.FleetStatus.Route(ctx, acct, vin)
 	if err != nil {
-		return err
+		log.Warning("[%s] Couldn't fetch fleet status of %s: %s", connector.RequestID(ctx), vin, err)
+	} else {
+		log.Debug("[%s] Sending %s commands to %s", connector.RequestID(ctx), route, vin)
 	}
+	return route
+}
 
-	if err := car.Connect(ctx); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
+func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWriter, req *http.Request, command, vin string) error {
+	ctx, cancel := p.requestContext(req)
+	defer cancel()
+
+	commandToExecuteFunc, err := loadCommandFromRequest(ctx, w, req, command, vin)
+	if err != nil {
 		return err
 	}
-	defer car.Disconnect()
 
-	if err := car.StartSession(ctx, nil); err == protocol.ErrProtocolNotSupported {
+	// Concurrent requests for the same vehicle share a Vehicle, which orders their commands.
+	car, release, err := p.acquireVehicle(ctx, acct, vin, req.Header.Get("Authorization"))
+	if err == protocol.ErrProtocolNotSupported {
 		p.markUnsupportedVIN(vin)
 		p.forwardRequest(acct.Host, w, req)
 		return err
@@ -271,7 +443,8 @@ func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWrite
 		writeJSONError(w, http.StatusInternalServerError, err)
 		return err
 	}
-	defer car.UpdateCachedSessions(p.sessions)
+	defer release()
+	defer p.saveSessions(ctx, car)
 
 	if err = commandToExecuteFunc(car); err == ErrCommandUseRESTAPI {
 		return err
@@ -290,27 +463,23 @@ func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWrite
 	return nil
 }
 
-func (p *Proxy) loadVehicleAndCommandFromRequest(ctx context.Context, acct *account.Account, w http.ResponseWriter, req *http.Request,
-	command, vin string) (*vehicle.Vehicle, func(*vehicle.Vehicle) error, error) {
-
-	log.Debug("Executing %s on %s", command, vin)
-	if req.Method != http.MethodPost {
-		writeJSONError(w, http.StatusMethodNotAllowed, nil)
-		return nil, nil, fmt.Errorf("Wrong http method")
+// saveSessions records car's sessions in the proxy's cache and SessionStore.
+func (p *Proxy) saveSessions(ctx context.Context, car *vehicle.Vehicle) {
+	car.UpdateCachedSessions(p.sessions)
+	if err := car.SaveSessions(ctx); err != nil {
+		log.Warning("[%s] Failed to save sessions for %s: %s", connector.RequestID(ctx), car.VIN(), err)
 	}
+}
 
-	commandToExecuteFunc, err := extractCommandAction(ctx, req, command)
-	if err != nil {
-		return nil, nil, err
-	}
+func loadCommandFromRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, command, vin string) (func(*vehicle.Vehicle) error, error) {
 
-	car, err := acct.GetVehicle(ctx, vin, p.commandKey, p.sessions)
-	if err != nil || car == nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
-		return nil, nil, err
+	log.Debug("[%s] Executing %s on %s", connector.RequestID(ctx), command, vin)
+	if req.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, nil)
+		return nil, fmt.Errorf("Wrong http method")
 	}
 
-	return car, commandToExecuteFunc, err
+	return extractCommandAction(ctx, req, command)
 }
 
 func extractCommandAction(ctx context.Context, req *http.Request, command string) (func(*vehicle.Vehicle) error, error) {
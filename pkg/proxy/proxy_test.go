@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/pkg/account"
+	"github.com/greenmission/vehicle-command/pkg/connector/inet"
+)
+
+func TestRequestIDEchoed(t *testing.T) {
+	p, err := New(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const clientID = "client-request.42"
+	req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles", nil)
+	req.Header.Set(inet.RequestIDHeader, clientID)
+	w := httptest.NewRecorder()
+	// Request fails because there's no Authorization header, which exercises the JSON error path.
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d but got %d", http.StatusForbidden, w.Code)
+	}
+	if id := w.Header().Get(inet.RequestIDHeader); id != clientID {
+		t.Errorf("Expected response header %s but got %s", clientID, id)
+	}
+	var reply Response
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("Invalid JSON response: %s", err)
+	}
+	if reply.RequestID != clientID {
+		t.Errorf("Expected request_id %s but got %s", clientID, reply.RequestID)
+	}
+
+	// Errors returned by Fleet API are rewritten to include the request ID, whether or not their
+	// bodies are JSON.
+	upstream := []struct {
+		body     string
+		expected string
+	}{
+		{`{"response":null,"error":"rate limited","error_description":"slow down"}`, "rate limited"},
+		{"upstream unavailable", "upstream unavailable"},
+	}
+	for _, test := range upstream {
+		w := httptest.NewRecorder()
+		w.Header().Set(inet.RequestIDHeader, clientID)
+		writeJSONError(w, http.StatusInternalServerError, inet.NewHttpError(http.StatusTooManyRequests, test.body, http.Header{"Retry-After": {"3"}}))
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status %d but got %d", http.StatusTooManyRequests, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "3" {
+			t.Errorf("Retry-After header not forwarded")
+		}
+		var reply Response
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("Invalid JSON response for %q: %s", test.body, err)
+		}
+		if reply.RequestID != clientID || reply.Error != test.expected {
+			t.Errorf("Unexpected reply to %q: %+v", test.body, reply)
+		}
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	for _, clientID := range []string{"", "bad id\nwith newline"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles", nil)
+		if clientID != "" {
+			req.Header.Set(inet.RequestIDHeader, clientID)
+		}
+		id := requestID(req)
+		if id == clientID || len(id) != 2*requestIDBytes {
+			t.Errorf("Expected a generated request ID for %q but got %q", clientID, id)
+		}
+	}
+}
+
+func TestForwardRequestUsesHTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response": []}`))
+	}))
+	defer server.Close()
+
+	p, err := New(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HTTPClient = server.Client()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles", nil)
+	w := httptest.NewRecorder()
+	p.forwardRequest(strings.TrimPrefix(server.URL, "https://"), w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestRouteUsesFleetStatus(t *testing.T) {
+	const pairedVIN = "5YJ3E1EA1JF000001"
+	const legacyVIN = "5YJSA1E11GF000003"
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/1/vehicles/fleet_status" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"response": {"key_paired_vins": ["` + pairedVIN + `"], "unpaired_vins": ["` + legacyVIN + `"], "vehicle_info": {}}}`))
+	}))
+	defer server.Close()
+
+	p, err := New(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct, err := account.New("x.e30.y", "", account.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct.Host = strings.TrimPrefix(server.URL, "https://")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+pairedVIN+"/command/honk_horn", nil)
+	if route := p.route(req, acct, pairedVIN); route != account.RouteSigned {
+		t.Errorf("Expected signed route but got %s", route)
+	}
+	if route := p.route(req, acct, pairedVIN); route != account.RouteSigned {
+		t.Errorf("Expected signed route but got %s", route)
+	}
+	if route := p.route(req, acct, legacyVIN); route != account.RouteREST {
+		t.Errorf("Expected REST route but got %s", route)
+	}
+	if requests != 2 {
+		t.Errorf("Expected fleet status to be cached, but server received %d requests", requests)
+	}
+
+	p.FleetStatus = nil
+	if route := p.route(req, acct, legacyVIN); route != account.RouteUnknown {
+		t.Errorf("Expected unknown route but got %s", route)
+	}
+}
+
+// newBlockingProxy returns a Proxy with a command key and a server that rejects every request with
+// a 403 error once unblock is closed. The Authorization header of each request is sent to received.
+func newBlockingProxy(t *testing.T, received chan<- string, unblock <-chan struct{}) (*Proxy, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Authorization")
+		<-unblock
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	skey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(context.Background(), skey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, server
+}
+
+func testAccount(t *testing.T, server *httptest.Server, token string) *account.Account {
+	t.Helper()
+	acct, err := account.New(token, "", account.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct.Host = strings.TrimPrefix(server.URL, "https://")
+	return acct
+}
+
+func TestConcurrentRequestsShareVehicle(t *testing.T) {
+	const vin = "5YJ3E1EA1JF000001"
+	const token = "x.e30.y"
+	received := make(chan string, 10)
+	unblock := make(chan struct{})
+	p, server := newBlockingProxy(t, received, unblock)
+	defer server.Close()
+	acct := testAccount(t, server, token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	acquire := func() {
+		_, release, err := p.acquireVehicle(ctx, acct, vin, "Bearer "+token)
+		if err == nil {
+			release()
+		}
+		errs <- err
+	}
+
+	go acquire()
+	<-received // First request is starting a session
+	go acquire()
+	for {
+		p.vehicleLock.Lock()
+		users := p.vehicles[vin].users
+		p.vehicleLock.Unlock()
+		if users == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(unblock)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("Expected handshake error")
+		}
+	}
+	p.vehicleLock.Lock()
+	defer p.vehicleLock.Unlock()
+	if len(p.vehicles) != 0 {
+		t.Errorf("Failed vehicle wasn't removed")
+	}
+}
+
+func TestRequestsWithDifferentTokensDontShareSessions(t *testing.T) {
+	const vin = "5YJ3E1EA1JF000001"
+	const firstToken = "a.e30.b"
+	const secondToken = "c.e30.d"
+	received := make(chan string, 10)
+	unblock := make(chan struct{})
+	p, server := newBlockingProxy(t, received, unblock)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	acquire := func(token string) {
+		_, release, err := p.acquireVehicle(ctx, testAccount(t, server, token), vin, "Bearer "+token)
+		if err == nil {
+			release()
+		}
+		errs <- err
+	}
+
+	go acquire(firstToken)
+	<-received // First request is starting a session
+	go acquire(secondToken)
+
+	// The second request must not start its own session while the first one is using the VIN.
+	select {
+	case auth := <-received:
+		if auth == "Bearer "+secondToken {
+			t.Fatalf("Second token used vehicle concurrently with the first")
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unblock)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("Expected handshake error")
+		}
+	}
+	close(received)
+	var sawSecond bool
+	for auth := range received {
+		if auth == "Bearer "+secondToken {
+			sawSecond = true
+		}
+	}
+	if !sawSecond {
+		t.Errorf("Second request never connected after the first was released")
+	}
+}
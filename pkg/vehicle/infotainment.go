@@ -24,7 +24,7 @@ func (v *Vehicle) getCarServerResponse(ctx context.Context, action *carserver.Ac
 	if err != nil {
 		return nil, err
 	}
-	responsePayload, err := v.Send(ctx, universal.Domain_DOMAIN_INFOTAINMENT, encodedPayload, v.authMethod)
+	responsePayload, err := v.Send(ctx, universal.Domain_DOMAIN_INFOTAINMENT, encodedPayload, authPreferred)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,103 @@
+package vehicle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/log"
+)
+
+// persistTimeout bounds the time spent writing sessions to a SessionStore in the background.
+const persistTimeout = 10 * time.Second
+
+// WithAutoPersist causes the Vehicle to save its sessions automatically whenever a session is
+// created or updated, or a command is authorized (which advances the session's anti-replay
+// counter). This avoids losing counter progress if the client exits without calling
+// [Vehicle.UpdateCachedSessions] or [Vehicle.SaveSessions].
+//
+// Saves are debounced: after a change, the Vehicle waits for delay before saving, and changes made
+// in the meantime are included in the same save. Sessions are written to the SessionCache passed
+// to [NewVehicle] and to the SessionStore provided by [WithSessionStore], if any. If onPersist is
+// not nil, it's invoked after each save; for example, to export the SessionCache to a file.
+//
+// Pending changes are saved when [Vehicle.Disconnect] is called.
+func WithAutoPersist(delay time.Duration, onPersist func(*Vehicle)) Option {
+	return func(v *Vehicle) {
+		v.persister = &autoPersister{vehicle: v, delay: delay, onPersist: onPersist}
+	}
+}
+
+type autoPersister struct {
+	vehicle   *Vehicle
+	delay     time.Duration
+	onPersist func(*Vehicle)
+
+	lock  sync.Mutex
+	timer *time.Timer
+	// done is closed when the save scheduled by timer completes.
+	done chan struct{}
+
+	// saveLock prevents concurrent saves if a save takes longer than delay.
+	saveLock sync.Mutex
+}
+
+// schedule arranges for sessions to be saved after p.delay, unless a save is already pending.
+func (p *autoPersister) schedule() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.timer == nil {
+		done := make(chan struct{})
+		p.timer = time.AfterFunc(p.delay, func() { p.save(done) })
+		p.done = done
+	}
+}
+
+// flush saves sessions immediately if a save is pending, and waits for any save that is already in
+// progress to complete.
+func (p *autoPersister) flush() {
+	p.lock.Lock()
+	timer, done := p.timer, p.done
+	pending := timer != nil && timer.Stop()
+	p.lock.Unlock()
+	switch {
+	case pending:
+		p.save(done)
+	case timer != nil:
+		// The timer fired, but the save may not have started yet.
+		<-done
+	default:
+		// The timer is cleared while holding saveLock, so a save may be in progress.
+		p.saveLock.Lock()
+		p.saveLock.Unlock()
+	}
+}
+
+// save writes sessions and then closes done.
+func (p *autoPersister) save(done chan struct{}) {
+	defer close(done)
+	p.saveLock.Lock()
+	defer p.saveLock.Unlock()
+
+	// Clear the timer before reading session state so that changes made during the save schedule
+	// another one.
+	p.lock.Lock()
+	p.timer = nil
+	p.done = nil
+	p.lock.Unlock()
+
+	v := p.vehicle
+	if v.sessionCache != nil {
+		if err := v.UpdateCachedSessions(v.sessionCache); err != nil {
+			log.Warning("Failed to update session cache for %s: %s", v.vin, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := v.SaveSessions(ctx); err != nil {
+		log.Warning("Failed to save sessions for %s: %s", v.vin, err)
+	}
+	if p.onPersist != nil {
+		p.onPersist(v)
+	}
+}
@@ -0,0 +1,91 @@
+package vehicle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/greenmission/vehicle-command/internal/dispatcher"
+	"github.com/greenmission/vehicle-command/pkg/cache"
+)
+
+func newPersistingTestVehicle(delay time.Duration) (*Vehicle, *testSender, *atomic.Int32) {
+	vehicle, dispatch := newTestVehicle()
+	vehicle.keyAvailable = true
+	vehicle.cacheKey = cache.Key{VIN: "5YJ30123456789ABC", Fingerprint: cache.Fingerprint([]byte("public key"))}
+	vehicle.sessionCache = cache.New(0)
+	var saves atomic.Int32
+	WithAutoPersist(delay, func(*Vehicle) { saves.Add(1) })(vehicle)
+	dispatch.OnSessionChange(vehicle.persister.schedule)
+	dispatch.sessions = []dispatcher.CacheEntry{{Domain: 2, CreatedAt: time.Now()}}
+	return vehicle, dispatch, &saves
+}
+
+func TestAutoPersistDebounces(t *testing.T) {
+	vehicle, dispatch, saves := newPersistingTestVehicle(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		dispatch.sessionChanged()
+	}
+	deadline := time.Now().Add(time.Second)
+	for saves.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := saves.Load(); n != 1 {
+		t.Errorf("Expected one save but got %d", n)
+	}
+	if _, ok := vehicle.sessionCache.GetSessions(vehicle.cacheKey); !ok {
+		t.Errorf("Sessions weren't saved to cache")
+	}
+}
+
+func TestAutoPersistFlushesOnDisconnect(t *testing.T) {
+	vehicle, dispatch, saves := newPersistingTestVehicle(time.Hour)
+	dispatch.sessionChanged()
+	vehicle.Disconnect()
+	if n := saves.Load(); n != 1 {
+		t.Errorf("Expected pending save on disconnect but got %d saves", n)
+	}
+	if _, ok := vehicle.sessionCache.GetSessions(vehicle.cacheKey); !ok {
+		t.Errorf("Sessions weren't saved to cache")
+	}
+
+	// Nothing is saved if there are no pending changes.
+	vehicle.Disconnect()
+	if n := saves.Load(); n != 1 {
+		t.Errorf("Saved sessions without pending changes")
+	}
+}
+
+func TestAutoPersistFlushWaitsForSaveInProgress(t *testing.T) {
+	vehicle, dispatch, _ := newPersistingTestVehicle(time.Millisecond)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	vehicle.persister.onPersist = func(*Vehicle) {
+		close(started)
+		<-release
+	}
+	dispatch.sessionChanged()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("Save didn't start")
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		vehicle.persister.flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatalf("Flush returned while a save was in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatalf("Flush didn't return after the save completed")
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"context"
 	"crypto/ecdh"
 	"fmt"
-	"time"
 
 	"github.com/greenmission/vehicle-command/pkg/connector"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
@@ -84,6 +83,7 @@ func readUntil(ctx context.Context, recv protocol.Receiver, done isTerminalTest)
 // getVCSECResult sends a payload to VCSEC, retrying as appropriate, and returns nil if the command succeeded.
 func (v *Vehicle) getVCSECResult(ctx context.Context, payload []byte, auth connector.AuthMethod, done isTerminalTest) (*vcsec.FromVCSECMessage, error) {
 	var fromVCSEC *vcsec.FromVCSECMessage
+	backoff := v.dispatcher.Backoff()
 	for {
 		recv, err := v.getReceiver(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY, payload, auth)
 		if err == nil {
@@ -95,11 +95,8 @@ func (v *Vehicle) getVCSECResult(ctx context.Context, payload []byte, auth conne
 			return fromVCSEC, err
 		}
 
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(v.dispatcher.RetryInterval()):
-			continue
+		if err := backoff.Wait(ctx, err); err != nil {
+			return nil, err
 		}
 	}
 }
@@ -119,7 +116,7 @@ func isWhitelistOperationComplete(fromVCSEC *vcsec.FromVCSECMessage) (bool, erro
 }
 
 func (v *Vehicle) executeWhitelistOperation(ctx context.Context, payload []byte) error {
-	_, err := v.getVCSECResult(ctx, payload, v.authMethod, isWhitelistOperationComplete)
+	_, err := v.getVCSECResult(ctx, payload, authPreferred, isWhitelistOperationComplete)
 	return err
 }
 
@@ -170,7 +167,7 @@ func (v *Vehicle) executeRKEAction(ctx context.Context, action vcsec.RKEAction_E
 		return err
 	}
 
-	_, err = v.getVCSECResult(ctx, encodedPayload, v.authMethod, done)
+	_, err = v.getVCSECResult(ctx, encodedPayload, authPreferred, done)
 	return err
 }
 
@@ -222,6 +219,6 @@ func (v *Vehicle) executeClosureAction(ctx context.Context, action vcsec.Closure
 		return err
 	}
 
-	_, err = v.getVCSECResult(ctx, encodedPayload, v.authMethod, done)
+	_, err = v.getVCSECResult(ctx, encodedPayload, authPreferred, done)
 	return err
 }
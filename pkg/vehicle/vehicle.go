@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ecdh"
 	"errors"
+	"sync"
 	"time"
 
 	"google.golang.org/protobuf/proto"
@@ -18,6 +19,11 @@ import (
 	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
 )
 
+// counterReservationSize is the number of anti-replay counters a Vehicle reserves at a time when it
+// shares sessions through a SessionStore. Larger values require fewer writes to the store, but
+// counters that a client reserves and doesn't use are skipped.
+const counterReservationSize = 32
+
 var (
 	// ErrNoFleetAPIConnection indicates the client attempted to send a command that terminates on
 	// Tesla's backend (rather than a vehicle), but the Vehicle Connection does not use connector/inet.
@@ -50,37 +56,149 @@ type sender interface {
 	Cache() []dispatcher.CacheEntry
 	LoadCache(entries []dispatcher.CacheEntry) error
 
-	// Returns the recommended retransmission interval for the Connector
-	RetryInterval() time.Duration
+	// OnSessionChange registers a callback that's invoked when session state changes.
+	OnSessionChange(fn func())
+
+	// Subscribe returns a channel that receives unsolicited messages from the vehicle.
+	Subscribe(ctx context.Context, domain universal.Domain, filter dispatcher.MessageFilter) <-chan *universal.RoutableMessage
+
+	// SetRetryPolicy controls the delay between retry attempts.
+	SetRetryPolicy(policy *protocol.RetryPolicy)
+
+	// Backoff returns a protocol.Backoff for a new operation. The initial delay defaults to the
+	// Connector's recommended retransmission interval.
+	Backoff() *protocol.Backoff
+
+	// HandlerStats returns statistics about pending responses.
+	HandlerStats() dispatcher.HandlerStats
 }
 
+// authPreferred is replaced with the Connector's preferred AuthMethod each time a command is
+// transmitted. Some Connectors, such as failover.Connection, change their preference when they
+// switch transports.
+const authPreferred connector.AuthMethod = -1
+
 // A Vehicle represents a Tesla vehicle.
+//
+// Once connected and with sessions started, a Vehicle is safe for concurrent use: multiple
+// goroutines may send commands at the same time. Infotainment commands are pipelined, while VCSEC
+// commands (such as locking and unlocking) are sent one at a time, in the order they're admitted,
+// since VCSEC rejects commands that arrive out of order. Connect, StartSession, and Disconnect
+// shouldn't be called while commands are in flight.
 type Vehicle struct {
 	dispatcher sender
 	Flags      uint32
 	vin        string
 	conn       connector.Connector
-	authMethod connector.AuthMethod
 
 	keyAvailable bool
+
+	// cacheKey identifies the client's sessions with the vehicle in a SessionCache or
+	// SessionStore.
+	cacheKey     cache.Key
+	sessionCache *cache.SessionCache
+	sessionStore cache.SessionStore
+	persister    *autoPersister
+	storeLock    sync.Mutex
+	storeLoaded  bool
+
+	dispatcherOptions []dispatcher.Option
 }
 
-// NewVehicle creates a new Vehicle. The privateKey and sessionCache may be nil.
-func NewVehicle(conn connector.Connector, privateKey authentication.ECDHPrivateKey, sessionCache *cache.SessionCache) (*Vehicle, error) {
-	dispatch, err := dispatcher.New(conn, privateKey)
-	if err != nil {
-		return nil, err
+// Option configures optional Vehicle behavior.
+type Option func(*Vehicle)
+
+// WithSessionStore shares sessions with other Vehicle objects, possibly in other processes, through
+// store. Stored sessions are loaded the first time [Vehicle.StartSession] is called, and
+// [Vehicle.SaveSessions] writes the Vehicle's sessions back to store. Before authorizing commands,
+// the Vehicle reserves anti-replay counters in store, so Vehicles that share store never reuse
+// each other's counters. This option has no effect if the Vehicle doesn't have a private key.
+func WithSessionStore(store cache.SessionStore) Option {
+	return func(v *Vehicle) {
+		v.sessionStore = store
+	}
+}
+
+// WithSessionInfoTimeout sets how long after sending a request the Vehicle accepts session info
+// included in the response. Increase this on high-latency connections.
+func WithSessionInfoTimeout(timeout time.Duration) Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithSessionInfoTimeout(timeout))
+	}
+}
+
+// WithCommandExpiry sets how long the vehicle accepts an authenticated command after it's sent,
+// when the Context passed to the command doesn't have a deadline. Otherwise the command expires at
+// the Context deadline, but no later than 30 seconds or expiry after it's sent, whichever is longer.
+func WithCommandExpiry(expiry time.Duration) Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithCommandExpiry(expiry))
 	}
+}
+
+// WithReceiverBufferSize sets the number of responses to a single command that can be queued
+// before further responses are dropped.
+func WithReceiverBufferSize(size int) Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithReceiverBufferSize(size))
+	}
+}
+
+// WithSubscriptionBufferSize sets the number of unsolicited messages that can be queued for each
+// subscription (see [Vehicle.Subscribe]) before further messages are dropped.
+func WithSubscriptionBufferSize(size int) Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithSubscriptionBufferSize(size))
+	}
+}
+
+// WithReceiverIdleTimeout sets how long a pending command can go without a response from the
+// vehicle before the Vehicle stops listening for responses to it. This guards against leaks in
+// long-running services; commands sent using the Vehicle's methods are cleaned up automatically.
+func WithReceiverIdleTimeout(timeout time.Duration) Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithReceiverIdleTimeout(timeout))
+	}
+}
+
+// WithLeakDetection logs the stack trace that created each receiver returned by
+// [Vehicle.SendMessage] that isn't closed. This is intended for debugging.
+func WithLeakDetection() Option {
+	return func(v *Vehicle) {
+		v.dispatcherOptions = append(v.dispatcherOptions, dispatcher.WithLeakDetection())
+	}
+}
+
+// NewVehicle creates a new Vehicle. The privateKey and sessionCache may be nil.
+func NewVehicle(conn connector.Connector, privateKey authentication.ECDHPrivateKey, sessionCache *cache.SessionCache, options ...Option) (*Vehicle, error) {
 	vin := conn.VIN()
 	vehicle := &Vehicle{
-		dispatcher:   dispatch,
 		vin:          vin,
 		conn:         conn,
-		authMethod:   conn.PreferredAuthMethod(),
 		keyAvailable: privateKey != nil,
+		sessionCache: sessionCache,
 	}
-	if sessionCache != nil {
-		if sessions, ok := sessionCache.GetEntry(vin); ok {
+	for _, option := range options {
+		option(vehicle)
+	}
+	if privateKey == nil {
+		vehicle.sessionStore = nil
+	} else {
+		vehicle.cacheKey = cache.Key{VIN: vin, Fingerprint: cache.Fingerprint(privateKey.PublicBytes())}
+	}
+	if vehicle.sessionStore != nil {
+		vehicle.dispatcherOptions = append(vehicle.dispatcherOptions, dispatcher.WithCounterReserver(vehicle.reserveCounters))
+	}
+	dispatch, err := dispatcher.New(conn, privateKey, vehicle.dispatcherOptions...)
+	if err != nil {
+		return nil, err
+	}
+	vehicle.dispatcher = dispatch
+	if vehicle.persister != nil {
+		dispatch.OnSessionChange(vehicle.persister.schedule)
+	}
+	if sessionCache != nil && privateKey != nil {
+		if sessions, ok := sessionCache.GetSessions(vehicle.cacheKey); ok {
 			if err := dispatch.LoadCache(sessions); err != nil {
 				return nil, err
 			}
@@ -97,6 +215,20 @@ func (v *Vehicle) PrivateKeyAvailable() bool {
 	return v.keyAvailable
 }
 
+// HandlerStats returns statistics about v's pending commands, which are useful for monitoring
+// long-running services. See [Vehicle.SendMessage].
+func (v *Vehicle) HandlerStats() dispatcher.HandlerStats {
+	return v.dispatcher.HandlerStats()
+}
+
+// SetRetryPolicy controls how long v waits before retrying commands that fail with temporary
+// errors, such as when the vehicle is busy or Fleet API is throttling requests. If policy is nil,
+// [protocol.DefaultRetryPolicy] is used. Retries never extend past the deadline of the context
+// passed to a command.
+func (v *Vehicle) SetRetryPolicy(policy *protocol.RetryPolicy) {
+	v.dispatcher.SetRetryPolicy(policy)
+}
+
 // Connect opens a connection to the vehicle.
 func (v *Vehicle) Connect(ctx context.Context) error {
 	return v.dispatcher.Start(ctx)
@@ -132,6 +264,10 @@ func (v *Vehicle) SessionInfo(ctx context.Context, publicKey *ecdh.PublicKey, do
 // subsystems. The client may specify a subset of domains if it does not need to connect to all of
 // them; for example, a client that only interacts with VCSEC can avoid waking infotainment.
 func (v *Vehicle) StartSession(ctx context.Context, domains []universal.Domain) error {
+	if err := v.loadStoredSessions(ctx); err != nil {
+		return err
+	}
+	backoff := v.dispatcher.Backoff()
 	for {
 		err := v.dispatcher.StartSessions(ctx, domains)
 		if err == nil {
@@ -142,15 +278,23 @@ func (v *Vehicle) StartSession(ctx context.Context, domains []universal.Domain)
 			return err
 		}
 
-		select {
-		case <-time.After(v.dispatcher.RetryInterval()):
-			continue
-		case <-ctx.Done():
-			return ctx.Err()
+		if err := backoff.Wait(ctx, err); err != nil {
+			return err
 		}
 	}
 }
 
+// Subscribe returns a channel that receives messages the vehicle sends on its own initiative, such
+// as notifications of status changes or key events over BLE, rather than in response to a command.
+// Only messages from domain that are accepted by filter are delivered; a nil filter accepts all
+// messages. Use universal.Domain_DOMAIN_BROADCAST to receive messages from all domains.
+//
+// The channel is closed when ctx is done or v is disconnected. Messages are dropped if the caller
+// doesn't keep up with them.
+func (v *Vehicle) Subscribe(ctx context.Context, domain universal.Domain, filter func(*universal.RoutableMessage) bool) <-chan *universal.RoutableMessage {
+	return v.dispatcher.Subscribe(ctx, domain, filter)
+}
+
 // Disconnect closes the connection to v.
 // Calling this method invokes the underlying [connector.Connector.Close] method. The
 // [connector.Connector] interface definition requires that multiple calls to Close() are safe, and so
@@ -158,12 +302,21 @@ func (v *Vehicle) StartSession(ctx context.Context, domains []universal.Domain)
 // be invoked first.
 func (v *Vehicle) Disconnect() {
 	v.dispatcher.Stop()
+	if v.persister != nil {
+		v.persister.flush()
+	}
 	if v.conn != nil {
 		v.conn.Close()
 	}
 }
 
 func (v *Vehicle) getReceiver(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) (protocol.Receiver, error) {
+	if auth == authPreferred {
+		auth = connector.AuthMethodNone
+		if v.conn != nil {
+			auth = v.conn.PreferredAuthMethod()
+		}
+	}
 	message := universal.RoutableMessage{
 		ToDestination: &universal.Destination{
 			SubDestination: &universal.Destination_Domain{
@@ -207,6 +360,9 @@ func (v *Vehicle) trySend(ctx context.Context, domain universal.Domain, payload
 //
 // The SendMessage method only retries on errors for which retransmission of the same message
 // (without modifying anti-replay counters, etc.) is safe and might resolve a transient error.
+//
+// The caller must close the returned Receiver once it's done handling responses. Receivers that
+// aren't closed are cleaned up after an idle timeout (see [WithReceiverIdleTimeout]).
 func (v *Vehicle) SendMessage(ctx context.Context, message *universal.RoutableMessage) (protocol.Receiver, error) {
 	return v.dispatcher.Send(ctx, message, connector.AuthMethodNone)
 }
@@ -221,6 +377,7 @@ func (v *Vehicle) SendMessage(ctx context.Context, message *universal.RoutableMe
 func (v *Vehicle) Send(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) ([]byte, error) {
 	payloadCopy := make([]byte, len(payload))
 	copy(payloadCopy, payload)
+	backoff := v.dispatcher.Backoff()
 	for {
 		response, err := v.trySend(ctx, domain, payloadCopy, auth)
 
@@ -232,11 +389,8 @@ func (v *Vehicle) Send(ctx context.Context, domain universal.Domain, payload []b
 			return nil, err
 		}
 
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(v.dispatcher.RetryInterval()):
-			continue
+		if err := backoff.Wait(ctx, err); err != nil {
+			return nil, err
 		}
 	}
 }
@@ -249,13 +403,63 @@ func (v *Vehicle) Wakeup(ctx context.Context) error {
 	}
 }
 
+// UpdateCachedSessions records v's sessions in c. Sessions are stored under the fingerprint of
+// v's public key, so a SessionCache can be shared by clients with different keys.
 func (v *Vehicle) UpdateCachedSessions(c *cache.SessionCache) error {
-	return c.Update(v.vin, v.dispatcher.Cache())
+	if !v.keyAvailable {
+		return nil
+	}
+	return c.UpdateSessions(v.cacheKey, v.dispatcher.Cache())
 }
 
+// LoadCachedSessions loads v's sessions from c. Sessions that belong to other client keys are
+// ignored.
 func (v *Vehicle) LoadCachedSessions(c *cache.SessionCache) error {
-	if data, ok := c.GetEntry(v.vin); ok {
+	if data, ok := c.GetSessions(v.cacheKey); ok && v.keyAvailable {
 		return v.dispatcher.LoadCache(data)
 	}
 	return errors.New("VIN not in cache")
 }
+
+// loadStoredSessions loads sessions from v's SessionStore, if it has one and hasn't already done so.
+// For each domain, v keeps whichever of its current session and the stored session is newer.
+func (v *Vehicle) loadStoredSessions(ctx context.Context) error {
+	if v.sessionStore == nil {
+		return nil
+	}
+	v.storeLock.Lock()
+	defer v.storeLock.Unlock()
+	if v.storeLoaded {
+		return nil
+	}
+	sessions, _, err := cache.LoadSessions(ctx, v.sessionStore, v.cacheKey)
+	if errors.Is(err, cache.ErrNotFound) {
+		v.storeLoaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Another client may have saved an older session than the one v already has.
+	if err := v.dispatcher.LoadCache(cache.MergeSessions(sessions, v.dispatcher.Cache())); err != nil {
+		return err
+	}
+	v.storeLoaded = true
+	return nil
+}
+
+// reserveCounters reserves a block of anti-replay counters in v's SessionStore, so that Vehicles
+// in other processes that share the store don't authorize commands with the same counters.
+func (v *Vehicle) reserveCounters(ctx context.Context, entry dispatcher.CacheEntry) (dispatcher.CacheEntry, uint32, error) {
+	return cache.ReserveCounters(ctx, v.sessionStore, v.cacheKey, entry, counterReservationSize)
+}
+
+// SaveSessions writes v's sessions to the SessionStore provided by [WithSessionStore]. If another
+// client updated the stored sessions concurrently, the sessions that have advanced furthest are
+// kept. Returns nil if v doesn't have a SessionStore.
+func (v *Vehicle) SaveSessions(ctx context.Context) error {
+	if v.sessionStore == nil {
+		return nil
+	}
+	return cache.SaveSessions(ctx, v.sessionStore, v.cacheKey, v.dispatcher.Cache())
+}
@@ -1,16 +1,25 @@
 package vehicle
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"sync"
 	"testing"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
+	"github.com/greenmission/vehicle-command/internal/authentication"
+	"github.com/greenmission/vehicle-command/internal/connectortest"
 	"github.com/greenmission/vehicle-command/internal/dispatcher"
+	"github.com/greenmission/vehicle-command/pkg/cache"
 	"github.com/greenmission/vehicle-command/pkg/connector"
+	"github.com/greenmission/vehicle-command/pkg/connector/failover"
 	"github.com/greenmission/vehicle-command/pkg/protocol"
 
+	"github.com/greenmission/vehicle-command/pkg/protocol/protobuf/signatures"
 	universal "github.com/greenmission/vehicle-command/pkg/protocol/protobuf/universalmessage"
 )
 
@@ -44,6 +53,9 @@ type testSender struct {
 	errQueue  []error
 
 	ConnectionErrors []error
+
+	sessions       []dispatcher.CacheEntry
+	sessionChanged func()
 }
 
 func (s *testSender) StartSessions(ctx context.Context, domains []universal.Domain) error {
@@ -56,15 +68,30 @@ func (s *testSender) StartSessions(ctx context.Context, domains []universal.Doma
 }
 
 func (s *testSender) Cache() []dispatcher.CacheEntry {
-	return nil
+	return s.sessions
 }
 
 func (s *testSender) LoadCache(entries []dispatcher.CacheEntry) error {
+	s.sessions = entries
+	return nil
+}
+
+func (s *testSender) OnSessionChange(fn func()) {
+	s.sessionChanged = fn
+}
+
+func (s *testSender) Subscribe(ctx context.Context, domain universal.Domain, filter dispatcher.MessageFilter) <-chan *universal.RoutableMessage {
 	return nil
 }
 
-func (s *testSender) RetryInterval() time.Duration {
-	return time.Millisecond
+func (s *testSender) SetRetryPolicy(policy *protocol.RetryPolicy) {}
+
+func (s *testSender) Backoff() *protocol.Backoff {
+	return (&protocol.RetryPolicy{MaxInterval: 10 * time.Millisecond}).Backoff(time.Millisecond)
+}
+
+func (s *testSender) HandlerStats() dispatcher.HandlerStats {
+	return dispatcher.HandlerStats{}
 }
 
 func (s *testSender) EnqueueError(err error) {
@@ -307,3 +334,196 @@ func TestVehicleRetryFail(t *testing.T) {
 		t.Errorf("Unexpected error: %s", err)
 	}
 }
+
+type throttledError struct{}
+
+func (e *throttledError) Error() string             { return "test: throttled" }
+func (e *throttledError) MayHaveSucceeded() bool    { return false }
+func (e *throttledError) Temporary() bool           { return true }
+func (e *throttledError) RetryDelay() time.Duration { return time.Hour }
+
+func TestVehicleSendThrottled(t *testing.T) {
+	vehicle, dispatch := newTestVehicle()
+	if err := vehicle.Connect(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer vehicle.Disconnect()
+
+	dispatch.SendError = &throttledError{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := vehicle.Send(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY, nil, connector.AuthMethodNone)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected Send to give up without waiting for deadline")
+	}
+	var throttled *throttledError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &throttled) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestVehicleSessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewKVStore(cache.NewMemoryKV(), "")
+	key := cache.Key{VIN: "5YJ30123456789ABC", Fingerprint: cache.Fingerprint([]byte("public key"))}
+
+	first, firstDispatch := newTestVehicle()
+	first.sessionStore = store
+	first.cacheKey = key
+	firstDispatch.sessions = []dispatcher.CacheEntry{{Domain: int(universal.Domain_DOMAIN_INFOTAINMENT), CreatedAt: time.Now()}}
+	if err := first.SaveSessions(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	second, secondDispatch := newTestVehicle()
+	second.sessionStore = store
+	second.cacheKey = key
+	if err := second.StartSession(ctx, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(secondDispatch.sessions) != 1 || secondDispatch.sessions[0].Domain != int(universal.Domain_DOMAIN_INFOTAINMENT) {
+		t.Errorf("Sessions weren't loaded from store: %+v", secondDispatch.sessions)
+	}
+
+	// Sessions are only loaded once, so that later handshakes aren't overwritten.
+	secondDispatch.sessions = nil
+	if err := second.StartSession(ctx, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if secondDispatch.sessions != nil {
+		t.Errorf("Sessions were loaded from store more than once")
+	}
+}
+
+func TestVehicleKeepsNewerSessionWhenLoadingStore(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewKVStore(cache.NewMemoryKV(), "")
+	key := cache.Key{VIN: "5YJ30123456789ABC", Fingerprint: cache.Fingerprint([]byte("public key"))}
+	sessionInfo := func(epoch byte) []byte {
+		info, err := proto.Marshal(&signatures.SessionInfo{Epoch: []byte{epoch}, Counter: 1})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return info
+	}
+	domain := int(universal.Domain_DOMAIN_INFOTAINMENT)
+	stored := []dispatcher.CacheEntry{{Domain: domain, SessionInfo: sessionInfo(1), CreatedAt: time.Now().Add(-time.Hour)}}
+	if err := cache.SaveSessions(ctx, store, key, stored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	vehicle, dispatch := newTestVehicle()
+	vehicle.sessionStore = store
+	vehicle.cacheKey = key
+	current := dispatcher.CacheEntry{Domain: domain, SessionInfo: sessionInfo(2), CreatedAt: time.Now()}
+	dispatch.sessions = []dispatcher.CacheEntry{current}
+	if err := vehicle.StartSession(ctx, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(dispatch.sessions) != 1 || !bytes.Equal(dispatch.sessions[0].SessionInfo, current.SessionInfo) {
+		t.Errorf("Older stored session replaced current session: %+v", dispatch.sessions)
+	}
+}
+
+func TestVehicleIgnoresOtherKeysCachedSessions(t *testing.T) {
+	sessions := cache.New(0)
+	otherKey := cache.Key{VIN: "5YJ30123456789ABC", Fingerprint: cache.Fingerprint([]byte("other key"))}
+	sessions.UpdateSessions(otherKey, []dispatcher.CacheEntry{{Domain: int(universal.Domain_DOMAIN_INFOTAINMENT)}})
+
+	vehicle, dispatch := newTestVehicle()
+	vehicle.keyAvailable = true
+	vehicle.cacheKey = cache.Key{VIN: otherKey.VIN, Fingerprint: cache.Fingerprint([]byte("public key"))}
+	if err := vehicle.LoadCachedSessions(sessions); err == nil {
+		t.Errorf("Expected error when loading sessions belonging to another key")
+	}
+	if dispatch.sessions != nil {
+		t.Errorf("Loaded sessions belonging to another key")
+	}
+
+	dispatch.sessions = []dispatcher.CacheEntry{{Domain: int(universal.Domain_DOMAIN_VEHICLE_SECURITY)}}
+	if err := vehicle.UpdateCachedSessions(sessions); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if entries, ok := sessions.GetSessions(otherKey); !ok || len(entries) != 1 || entries[0].Domain != int(universal.Domain_DOMAIN_INFOTAINMENT) {
+		t.Errorf("Other key's sessions were modified: %+v", entries)
+	}
+}
+
+// transportChangeCounter counts the messages its Connector rejects because the transport changed.
+type transportChangeCounter struct {
+	connector.Connector
+	lock    sync.Mutex
+	changes int
+}
+
+func (c *transportChangeCounter) Send(ctx context.Context, buffer []byte) error {
+	err := c.Connector.Send(ctx, buffer)
+	if errors.Is(err, protocol.ErrTransportChanged) {
+		c.lock.Lock()
+		c.changes++
+		c.lock.Unlock()
+	}
+	return err
+}
+
+func TestVehicleReauthorizesAfterTransportChange(t *testing.T) {
+	sim, err := connectortest.NewAuthenticatedVehicle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := connectortest.New(connector.AuthMethodGCM, sim.Handle)
+	remote := connectortest.New(connector.AuthMethodHMAC, sim.Handle)
+	dial := func(ctx context.Context, vin string) (connector.Connector, error) {
+		return local, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn := &transportChangeCounter{
+		Connector: failover.New(ctx, remote, dial, &failover.Config{ProbeInterval: time.Hour}),
+	}
+	defer conn.Close()
+
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := NewVehicle(conn, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := car.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer car.Disconnect()
+	if err := car.StartSession(ctx, []universal.Domain{protocol.DomainInfotainment}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The local link drops after the command has been encrypted for it. The Vehicle must
+	// authorize the command again for the remote transport rather than resend the same message.
+	local.SetSendError(protocol.ErrNotConnected)
+	payload := []byte("honk")
+	reply, err := car.Send(ctx, protocol.DomainInfotainment, payload, authPreferred)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(reply, payload) || sim.Executions(payload) != 1 {
+		t.Errorf("Command wasn't executed once")
+	}
+	if conn.changes != 1 {
+		t.Errorf("Message encrypted for the local transport was sent %d times", conn.changes)
+	}
+	sent := remote.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected one message over remote transport but got %d", len(sent))
+	}
+	var message universal.RoutableMessage
+	if err := proto.Unmarshal(sent[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.GetSignatureData().GetHMAC_PersonalizedData() == nil {
+		t.Errorf("Command sent over remote transport wasn't authorized with HMAC")
+	}
+}